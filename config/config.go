@@ -1,27 +1,75 @@
 package config
 
 import (
+	"sync"
+	"time"
+
 	"github.com/codegangsta/cli"
 	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
 )
 
 type Config struct {
-	KubernetesURL   string
-	CattleURL       string
-	CattleAccessKey string
-	CattleSecretKey string
-	WorkerCount     int
-	HealthCheckPort int
+	KubernetesURL     string
+	Kubeconfig        string
+	KubeconfigContext string
+	InCluster         bool
+	ClientCertAuth    bool
+	DialTimeout       time.Duration
+	TLSTimeout        time.Duration
+	ResponseTimeout   time.Duration
+	KubernetesQPS     float64
+	KubernetesBurst   int
+	MaxRetries        int
+	CattleURL         string
+	CattleAccessKey   string
+	CattleSecretKey   string
+	WorkerCount       int
+	ResyncInterval    time.Duration
+	IncludeNamespaces []string
+	ExcludeNamespaces []string
+	LabelSelectors    string
+	// ChangeProjectionFile holds the rules for the objects published in
+	// change events, see kubernetesevents.PayloadRules
+	ChangeProjectionFile string
+	ChangeMaxPayloadSize int
+	// DataDir holds state kept across restarts, like watch checkpoints and
+	// the dead letter queue
+	DataDir              string
+	DeadLetterMaxEntries int
+	ReconcileInterval    time.Duration
+	ReconcileDryRun      bool
+	HealthCheckPort      int
 }
 
 func Conf(context *cli.Context) Config {
 	config := Config{
-		KubernetesURL:   context.String("kubernetes-url"),
-		CattleURL:       context.String("cattle-url"),
-		CattleAccessKey: context.String("cattle-access-key"),
-		CattleSecretKey: context.String("cattle-secret-key"),
-		WorkerCount:     context.Int("worker-count"),
-		HealthCheckPort: context.Int("health-check-port"),
+		KubernetesURL:        context.String("kubernetes-url"),
+		Kubeconfig:           context.String("kubeconfig"),
+		KubeconfigContext:    context.String("kubeconfig-context"),
+		InCluster:            context.Bool("in-cluster"),
+		ClientCertAuth:       context.Bool("client-cert-auth"),
+		DialTimeout:          time.Duration(context.Int("kubernetes-dial-timeout")) * time.Second,
+		TLSTimeout:           time.Duration(context.Int("kubernetes-tls-timeout")) * time.Second,
+		ResponseTimeout:      time.Duration(context.Int("kubernetes-response-timeout")) * time.Second,
+		KubernetesQPS:        context.Float64("kubernetes-qps"),
+		KubernetesBurst:      context.Int("kubernetes-burst"),
+		MaxRetries:           context.Int("kubernetes-max-retries"),
+		CattleURL:            context.String("cattle-url"),
+		CattleAccessKey:      context.String("cattle-access-key"),
+		CattleSecretKey:      context.String("cattle-secret-key"),
+		WorkerCount:          context.Int("worker-count"),
+		ResyncInterval:       time.Duration(context.Int("resync-interval")) * time.Second,
+		IncludeNamespaces:    context.StringSlice("include-namespace"),
+		ExcludeNamespaces:    context.StringSlice("exclude-namespace"),
+		LabelSelectors:       context.String("label-selector"),
+		ChangeProjectionFile: context.String("change-projection-file"),
+		ChangeMaxPayloadSize: context.Int("change-max-payload-size"),
+		DataDir:              context.String("data-dir"),
+		DeadLetterMaxEntries: context.Int("dead-letter-max-entries"),
+		ReconcileInterval:    time.Duration(context.Int("reconcile-interval")) * time.Second,
+		ReconcileDryRun:      context.Bool("reconcile-dry-run"),
+		HealthCheckPort:      context.Int("health-check-port"),
 	}
 
 	return config
@@ -34,3 +82,36 @@ func GetRancherClient(conf Config) (*client.RancherClient, error) {
 		SecretKey: conf.CattleSecretKey,
 	})
 }
+
+type kubernetesClientKey struct {
+	url  string
+	opts kubernetesclient.ClientOptions
+}
+
+var (
+	kubernetesClientsLock sync.Mutex
+	kubernetesClients     = map[kubernetesClientKey]*kubernetesclient.Client{}
+)
+
+// GetKubernetesClient returns a client for the configured kubernetes API.
+// Every client of the same configuration shares one rate limiter, so the
+// agent as a whole stays under --kubernetes-qps.
+func GetKubernetesClient(conf Config, debug bool) *kubernetesclient.Client {
+	key := kubernetesClientKey{
+		url: conf.KubernetesURL,
+		opts: kubernetesclient.ClientOptions{
+			QPS:        conf.KubernetesQPS,
+			Burst:      conf.KubernetesBurst,
+			MaxRetries: conf.MaxRetries,
+		},
+	}
+
+	kubernetesClientsLock.Lock()
+	defer kubernetesClientsLock.Unlock()
+	client, ok := kubernetesClients[key]
+	if !ok {
+		client = kubernetesclient.NewClientWithOptions(key.url, false, key.opts)
+		kubernetesClients[key] = client
+	}
+	return client.WithDebug(debug)
+}
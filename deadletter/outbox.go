@@ -0,0 +1,213 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v2"
+)
+
+var replayInterval = 10 * time.Second
+
+// Outbox delivers events to Rancher, keeping the ones Rancher couldn't be
+// reached for in a Queue and replaying them in order once it's back. While
+// entries are waiting new events join the end of the queue, so Rancher
+// never sees a newer state of an object before an older one. The queue should
+// be claimed, so no other process replays it at the same time.
+type Outbox struct {
+	queue   *Queue
+	rClient *client.RancherClient
+	// Sends hold a read lock and replays the write lock, so events aren't
+	// delivered directly while the queue is being drained.
+	lock sync.RWMutex
+}
+
+func NewOutbox(queue *Queue, rClient *client.RancherClient) *Outbox {
+	return &Outbox{
+		queue:   queue,
+		rClient: rClient,
+	}
+}
+
+// Client returns a copy of the Rancher client whose external service event
+// and publish creates go through the outbox.
+func (o *Outbox) Client() *client.RancherClient {
+	wrapped := *o.rClient
+	wrapped.ExternalServiceEvent = &externalServiceEvents{
+		ExternalServiceEventOperations: o.rClient.ExternalServiceEvent,
+		outbox:                         o,
+	}
+	wrapped.Publish = &publishes{
+		PublishOperations: o.rClient.Publish,
+		outbox:            o,
+	}
+	return &wrapped
+}
+
+// Run replays waiting entries until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := o.Replay(nil, false); err != nil {
+			log.Debugf("Rancher still isn't accepting queued events: %v", err)
+		}
+	}
+}
+
+// Replay delivers entries in order, all of them when ids is empty. It stops
+// at the first one Rancher can't be reached for, and marks ones it rejects
+// as dead. Dead entries are skipped unless retryDead is set. It returns how
+// many entries were delivered.
+func (o *Outbox) Replay(ids []uint64, retryDead bool) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	entries, err := o.queue.List()
+	if err != nil {
+		return 0, err
+	}
+	selected := map[uint64]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	delivered := 0
+	for _, entry := range entries {
+		if len(ids) > 0 && !selected[entry.ID] {
+			continue
+		}
+		if entry.Dead && !retryDead {
+			continue
+		}
+		err := o.deliverEntry(entry)
+		if err == nil {
+			queueStats.Add("replayed", 1)
+			delivered++
+			if err := o.queue.Remove(entry.ID); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		entry.addAttempt(err)
+		if !retryable(err) {
+			log.Errorf("Rancher rejected queued %s %d, giving up on it: %v", entry.Type, entry.ID, err)
+			queueStats.Add("dead", 1)
+			entry.Dead = true
+		}
+		if updateErr := o.queue.Update(entry); updateErr != nil {
+			return delivered, updateErr
+		}
+		if !entry.Dead {
+			return delivered, err
+		}
+	}
+	if delivered > 0 {
+		log.Infof("Replayed %d queued events to Rancher", delivered)
+	}
+	return delivered, nil
+}
+
+func (o *Outbox) deliverEntry(entry *Entry) error {
+	switch entry.Type {
+	case ExternalServiceEventType:
+		event := &client.ExternalServiceEvent{}
+		if err := json.Unmarshal(entry.Payload, event); err != nil {
+			return err
+		}
+		_, err := o.rClient.ExternalServiceEvent.Create(event)
+		return err
+	case PublishType:
+		publish := &client.Publish{}
+		if err := json.Unmarshal(entry.Payload, publish); err != nil {
+			return err
+		}
+		_, err := o.rClient.Publish.Create(publish)
+		return err
+	}
+	return fmt.Errorf("Unknown dead letter entry type %s", entry.Type)
+}
+
+// send delivers an event, or queues it if older events are waiting or
+// Rancher can't be reached. Errors Rancher answers with are returned as
+// they would be without the outbox.
+func (o *Outbox) send(entryType string, payload interface{}, deliver func() error) error {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	if o.queue.Pending() {
+		_, err := o.queue.Append(entryType, payload, nil)
+		return err
+	}
+
+	err := deliver()
+	if err == nil || !retryable(err) {
+		return err
+	}
+	log.Warnf("Queueing %s Rancher failed to accept: %v", entryType, err)
+	_, err = o.queue.Append(entryType, payload, err)
+	return err
+}
+
+// retryable reports whether delivering again may succeed: Rancher couldn't
+// be reached, failed or asked to slow down.
+func retryable(err error) bool {
+	apiErr, ok := err.(*client.ApiError)
+	if !ok {
+		// Decoding errors of entries can't be fixed by retrying
+		_, syntaxErr := err.(*json.SyntaxError)
+		_, typeErr := err.(*json.UnmarshalTypeError)
+		return !syntaxErr && !typeErr
+	}
+	return apiErr.StatusCode >= 500 || apiErr.StatusCode == 429
+}
+
+type externalServiceEvents struct {
+	client.ExternalServiceEventOperations
+	outbox *Outbox
+}
+
+func (e *externalServiceEvents) Create(event *client.ExternalServiceEvent) (*client.ExternalServiceEvent, error) {
+	created := event
+	err := e.outbox.send(ExternalServiceEventType, event, func() error {
+		result, err := e.ExternalServiceEventOperations.Create(event)
+		if err == nil {
+			created = result
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+type publishes struct {
+	client.PublishOperations
+	outbox *Outbox
+}
+
+func (p *publishes) Create(publish *client.Publish) (*client.Publish, error) {
+	created := publish
+	err := p.outbox.send(PublishType, publish, func() error {
+		result, err := p.PublishOperations.Create(publish)
+		if err == nil {
+			created = result
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
@@ -0,0 +1,280 @@
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rancher/go-rancher/v2"
+)
+
+// MockServiceEventOperations records the events it accepts, failing with
+// err while it's set.
+type MockServiceEventOperations struct {
+	client.ExternalServiceEventClient
+	err      error
+	accepted []string
+}
+
+func (m *MockServiceEventOperations) Create(event *client.ExternalServiceEvent) (*client.ExternalServiceEvent, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.accepted = append(m.accepted, event.ExternalId)
+	return event, nil
+}
+
+func newTestQueue(t *testing.T, maxEntries int) (*Queue, func()) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := Open(dir, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue, func() { os.RemoveAll(dir) }
+}
+
+func TestQueue(t *testing.T) {
+	queue, cleanup := newTestQueue(t, 3)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		if _, err := queue.Append(PublishType, &client.Publish{Name: fmt.Sprint(i)}, errors.New("unreachable")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Entries survive a restart, without the oldest one beyond the bound
+	reopened, err := Open(queue.dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].ID != 2 || entries[2].ID != 4 {
+		t.Fatalf("Expected entries 2 to 4, got %+v", entries)
+	}
+	if entries[0].LastError() != "unreachable" {
+		t.Errorf("Expected the failed attempt to be recorded, got %+v", entries[0].Attempts)
+	}
+	entry, err := reopened.Append(PublishType, &client.Publish{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != 5 {
+		t.Errorf("Expected IDs to continue after a restart, got %d", entry.ID)
+	}
+}
+
+func TestQueueDropsDeadEntriesFirst(t *testing.T) {
+	queue, cleanup := newTestQueue(t, 2)
+	defer cleanup()
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := queue.Append(PublishType, &client.Publish{Name: name}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[1].Dead = true
+	if err := queue.Update(entries[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dead b makes room for c, though a is older
+	if _, err := queue.Append(PublishType, &client.Publish{Name: "c"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = queue.List(); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != 1 || entries[1].ID != 3 {
+		t.Fatalf("Expected entries 1 and 3, got %+v", entries)
+	}
+
+	// Without dead entries the oldest pending one goes
+	if _, err := queue.Append(PublishType, &client.Publish{Name: "d"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = queue.List(); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != 3 || entries[1].ID != 4 {
+		t.Fatalf("Expected entries 3 and 4, got %+v", entries)
+	}
+}
+
+func TestQueuePending(t *testing.T) {
+	queue, cleanup := newTestQueue(t, 0)
+	defer cleanup()
+
+	if queue.Pending() {
+		t.Fatal("Expected an empty queue to have nothing pending")
+	}
+	entry, err := queue.Append(PublishType, &client.Publish{Name: "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Pending() {
+		t.Error("Expected the appended entry to be pending")
+	}
+	entry.Dead = true
+	if err := queue.Update(entry); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Pending() {
+		t.Error("Expected dead entries not to be pending")
+	}
+	if _, err := queue.Append(PublishType, &client.Publish{Name: "b"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pending entries are loaded when the queue is opened
+	reopened, err := Open(queue.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.Pending() {
+		t.Error("Expected b to be pending after reopening")
+	}
+
+	// The admin command purged b, which the next list notices
+	if err := reopened.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Pending() {
+		t.Error("Expected the purge not to be seen before listing")
+	}
+	if _, err := queue.List(); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Pending() {
+		t.Error("Expected the purged entry to no longer be pending")
+	}
+}
+
+func TestQueueClaim(t *testing.T) {
+	queue, cleanup := newTestQueue(t, 0)
+	defer cleanup()
+
+	if err := queue.Claim(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Claim(); err != nil {
+		t.Errorf("Expected claiming again to succeed, got %v", err)
+	}
+	// Locks are per open file, so a second queue stands in for the admin
+	// command
+	other, err := Open(queue.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Claim(); err == nil {
+		t.Error("Expected the queue to be claimed already")
+	}
+
+	queue.claim.Close()
+	if err := other.Claim(); err != nil {
+		t.Errorf("Expected the released queue to be claimed, got %v", err)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	queue, cleanup := newTestQueue(t, 0)
+	defer cleanup()
+	events := &MockServiceEventOperations{}
+	outbox := NewOutbox(queue, &client.RancherClient{ExternalServiceEvent: events})
+	rClient := outbox.Client()
+
+	send := func(id string) error {
+		_, err := rClient.ExternalServiceEvent.Create(&client.ExternalServiceEvent{ExternalId: id})
+		return err
+	}
+
+	if err := send("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rancher is down, so events are queued
+	events.err = errors.New("connection refused")
+	if err := send("b"); err != nil {
+		t.Fatal(err)
+	}
+	events.err = nil
+	// Later events wait behind the queued ones to keep their order
+	if err := send("c"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(events.accepted) != "[a]" {
+		t.Fatalf("Expected only a to be delivered while b is queued, got %v", events.accepted)
+	}
+
+	delivered, err := outbox.Replay(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 2 || fmt.Sprint(events.accepted) != "[a b c]" {
+		t.Fatalf("Expected b and c to be replayed in order, got %d %v", delivered, events.accepted)
+	}
+
+	// Rancher rejecting an event is reported to the sender, not queued
+	events.err = &client.ApiError{StatusCode: 422}
+	if err := send("d"); err == nil {
+		t.Error("Expected a rejected event to fail")
+	}
+	if queue.Pending() {
+		t.Error("Expected rejected events not to be queued")
+	}
+}
+
+func TestOutboxReplayRejected(t *testing.T) {
+	queue, cleanup := newTestQueue(t, 0)
+	defer cleanup()
+	events := &MockServiceEventOperations{}
+	outbox := NewOutbox(queue, &client.RancherClient{ExternalServiceEvent: events})
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := queue.Append(ExternalServiceEventType, &client.ExternalServiceEvent{ExternalId: id}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events.err = &client.ApiError{StatusCode: 503}
+	if _, err := outbox.Replay(nil, false); err == nil {
+		t.Fatal("Expected replay to stop while Rancher is unavailable")
+	}
+	entries, _ := queue.List()
+	if len(entries[0].Attempts) != 1 || len(entries[1].Attempts) != 0 {
+		t.Errorf("Expected only the first entry to be attempted, got %+v", entries)
+	}
+
+	events.err = &client.ApiError{StatusCode: 422}
+	if _, err := outbox.Replay([]uint64{1}, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = queue.List()
+	if !entries[0].Dead || len(entries[0].Attempts) != 2 {
+		t.Fatalf("Expected the rejected entry to be dead after 2 attempts, got %+v", entries[0])
+	}
+
+	// Dead entries no longer hold up the rest
+	events.err = nil
+	if delivered, err := outbox.Replay(nil, false); err != nil || delivered != 1 {
+		t.Fatalf("Expected b to be replayed, got %d %v", delivered, err)
+	}
+	if delivered, err := outbox.Replay(nil, true); err != nil || delivered != 1 {
+		t.Fatalf("Expected the dead entry to be replayed by hand, got %d %v", delivered, err)
+	}
+	if fmt.Sprint(events.accepted) != "[b a]" {
+		t.Errorf("Unexpected deliveries %v", events.accepted)
+	}
+}
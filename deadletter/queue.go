@@ -0,0 +1,330 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ExternalServiceEventType = "externalServiceEvent"
+	PublishType              = "publish"
+
+	// maxAttempts is how many delivery attempts an entry remembers.
+	maxAttempts = 10
+)
+
+var queueStats = expvar.NewMap("deadletter")
+
+// Entry is an event Rancher failed to accept, with the attempts to deliver
+// it so far.
+type Entry struct {
+	ID       uint64          `json:"id"`
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"`
+	Created  time.Time       `json:"created"`
+	Attempts []Attempt       `json:"attempts,omitempty"`
+	// Dead entries failed with an error retrying won't fix, like a 422. They
+	// are kept for inspection but only replayed by hand.
+	Dead bool `json:"dead,omitempty"`
+}
+
+type Attempt struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// LastError is the error of the latest attempt, if any.
+func (e *Entry) LastError() string {
+	if len(e.Attempts) == 0 {
+		return ""
+	}
+	return e.Attempts[len(e.Attempts)-1].Error
+}
+
+func (e *Entry) addAttempt(err error) {
+	e.Attempts = append(e.Attempts, Attempt{Time: time.Now(), Error: err.Error()})
+	if len(e.Attempts) > maxAttempts {
+		e.Attempts = e.Attempts[len(e.Attempts)-maxAttempts:]
+	}
+}
+
+// Queue keeps entries in order as one JSON file each in a directory, so
+// they survive restarts. Once it holds maxEntries the oldest dead entry is
+// dropped, or the oldest pending one when none are dead, which loses an
+// event. Files that disappear are ignored, so the admin command can purge
+// entries while the agent runs.
+type Queue struct {
+	sync.Mutex
+	dir        string
+	maxEntries int
+	nextID     uint64
+	// live and dead hold the IDs of the entries, so neither Pending nor
+	// Append needs to read the directory
+	live map[uint64]bool
+	dead map[uint64]bool
+	// claim is the lock file held by Claim
+	claim *os.File
+}
+
+func Open(dir string, maxEntries int) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:        dir,
+		maxEntries: maxEntries,
+		nextID:     1,
+	}
+	// Listing loads the live entries
+	if _, err := q.List(); err != nil {
+		return nil, err
+	}
+	ids, err := q.ids()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		q.nextID = ids[len(ids)-1] + 1
+	}
+	return q, nil
+}
+
+// Claim takes an exclusive lock on the queue's directory for as long as the
+// process runs, so that only one process replays the entries. It fails right
+// away when another process, like a running agent, holds the lock.
+func (q *Queue) Claim() error {
+	q.Lock()
+	defer q.Unlock()
+	if q.claim != nil {
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(q.dir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("Dead letter queue %s is in use by another process", q.dir)
+		}
+		return err
+	}
+	q.claim = file
+	return nil
+}
+
+// Append adds an entry of type for payload to the end of the queue.
+func (q *Queue) Append(entryType string, payload interface{}, err error) (*Entry, error) {
+	data, marshalErr := json.Marshal(payload)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	for q.maxEntries > 0 && len(q.live)+len(q.dead) >= q.maxEntries {
+		if err := q.dropOldest(); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &Entry{
+		ID:      q.nextID,
+		Type:    entryType,
+		Payload: data,
+		Created: time.Now(),
+	}
+	if err != nil {
+		entry.addAttempt(err)
+	}
+	if err := q.write(entry); err != nil {
+		return nil, err
+	}
+	q.live[entry.ID] = true
+	q.nextID++
+	queueStats.Add("queued", 1)
+	return entry, nil
+}
+
+// List returns the entries in the order they were added. It also catches
+// up with entries purged by another process, which Pending then no longer
+// counts.
+func (q *Queue) List() ([]*Entry, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	ids, err := q.ids()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	live := map[uint64]bool{}
+	dead := map[uint64]bool{}
+	for _, id := range ids {
+		entry, err := q.read(id)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Skipping unreadable dead letter entry %d: %v", id, err)
+			continue
+		}
+		entries = append(entries, entry)
+		if entry.Dead {
+			dead[id] = true
+		} else {
+			live[id] = true
+		}
+	}
+	q.live = live
+	q.dead = dead
+	return entries, nil
+}
+
+// Pending reports whether any entries are waiting to be replayed.
+func (q *Queue) Pending() bool {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.live) > 0
+}
+
+// Update saves the attempts and state of an entry still in the queue.
+func (q *Queue) Update(entry *Entry) error {
+	q.Lock()
+	defer q.Unlock()
+	if _, err := os.Stat(q.path(entry.ID)); err != nil {
+		// Purged meanwhile
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := q.write(entry); err != nil {
+		return err
+	}
+	if entry.Dead {
+		delete(q.live, entry.ID)
+		q.dead[entry.ID] = true
+	} else {
+		delete(q.dead, entry.ID)
+		q.live[entry.ID] = true
+	}
+	return nil
+}
+
+func (q *Queue) Remove(id uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	return q.remove(id)
+}
+
+func (q *Queue) remove(id uint64) error {
+	if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(q.live, id)
+	delete(q.dead, id)
+	return nil
+}
+
+// dropOldest makes room in a full queue. Dead entries go first, since they
+// are only replayed by hand. Dropping a pending entry loses an event Rancher
+// never got, so it is logged as an error. The caller must hold the lock.
+func (q *Queue) dropOldest() error {
+	if id, ok := lowest(q.dead); ok {
+		log.Warnf("Dead letter queue is full with %d entries, dropping dead entry %d", len(q.live)+len(q.dead), id)
+		queueStats.Add("droppedDead", 1)
+		return q.remove(id)
+	}
+	id, _ := lowest(q.live)
+	log.Errorf("Dead letter queue is full with %d entries, dropping entry %d, which Rancher will never get", len(q.live), id)
+	queueStats.Add("dropped", 1)
+	return q.remove(id)
+}
+
+// lowest returns the lowest of ids, the oldest entry.
+func lowest(ids map[uint64]bool) (uint64, bool) {
+	var min uint64
+	found := false
+	for id := range ids {
+		if !found || id < min {
+			min = id
+			found = true
+		}
+	}
+	return min, found
+}
+
+func (q *Queue) path(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", id))
+}
+
+// write replaces the entry's file through a rename, so a crash never
+// leaves half an entry behind.
+func (q *Queue) write(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(q.dir, ".entry")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path(entry.ID))
+}
+
+func (q *Queue) read(id uint64) (*Entry, error) {
+	data, err := ioutil.ReadFile(q.path(id))
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ids lists the IDs of the entry files in order.
+func (q *Queue) ids() ([]uint64, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint64{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
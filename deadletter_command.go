@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+
+	"github.com/rancher/kubernetes-agent/config"
+	"github.com/rancher/kubernetes-agent/deadletter"
+)
+
+var deadLetterCommand = cli.Command{
+	Name:  "dead-letter",
+	Usage: "Inspect, replay or purge the events Rancher failed to accept",
+	Subcommands: []cli.Command{
+		{
+			Name:   "list",
+			Usage:  "List queued events in the order they will be replayed",
+			Action: listDeadLetters,
+		},
+		{
+			Name:  "replay",
+			Usage: "Send queued events to Rancher now, all of them or the given IDs: replay [--dead] [ID...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dead",
+					Usage: "Also replay events Rancher rejected",
+				},
+			},
+			Action: replayDeadLetters,
+		},
+		{
+			Name:  "purge",
+			Usage: "Remove the given queued events, or all of them: purge [--all] [ID...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Remove every queued event",
+				},
+			},
+			Action: purgeDeadLetters,
+		},
+	},
+}
+
+func deadLetterDir(dataDir string) string {
+	return filepath.Join(dataDir, "deadletter")
+}
+
+func openDeadLetters(c *cli.Context) *deadletter.Queue {
+	dataDir := c.GlobalString("data-dir")
+	if dataDir == "" {
+		log.Fatal("No --data-dir to find queued events in")
+	}
+	queue, err := deadletter.Open(deadLetterDir(dataDir), c.GlobalInt("dead-letter-max-entries"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return queue
+}
+
+func entryIDs(c *cli.Context) []uint64 {
+	ids := []uint64{}
+	for _, arg := range c.Args() {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid entry ID %s", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func listDeadLetters(c *cli.Context) {
+	entries, err := openDeadLetters(c).List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tCREATED\tATTEMPTS\tSTATE\tLAST ERROR")
+	for _, entry := range entries {
+		state := "pending"
+		if entry.Dead {
+			state = "dead"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", entry.ID, entry.Type, entry.Created.Format(time.RFC3339),
+			len(entry.Attempts), state, entry.LastError())
+	}
+	w.Flush()
+}
+
+func replayDeadLetters(c *cli.Context) {
+	queue := openDeadLetters(c)
+	// A running agent replays the queue itself
+	if err := queue.Claim(); err != nil {
+		log.Fatalf("%v, stop the agent to replay events by hand", err)
+	}
+	rClient, err := config.GetRancherClient(config.Config{
+		CattleURL:       c.GlobalString("cattle-url"),
+		CattleAccessKey: c.GlobalString("cattle-access-key"),
+		CattleSecretKey: c.GlobalString("cattle-secret-key"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	delivered, err := deadletter.NewOutbox(queue, rClient).Replay(entryIDs(c), c.Bool("dead"))
+	fmt.Printf("Replayed %d events\n", delivered)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func purgeDeadLetters(c *cli.Context) {
+	queue := openDeadLetters(c)
+	// A running agent removes the entries it replays
+	if err := queue.Claim(); err != nil {
+		log.Fatalf("%v, stop the agent to purge events", err)
+	}
+	ids := entryIDs(c)
+	if c.Bool("all") {
+		entries, err := queue.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+	} else if len(ids) == 0 {
+		log.Fatal("Give the IDs of the events to purge, or --all")
+	}
+	for _, id := range ids {
+		if err := queue.Remove(id); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Purged %d events\n", len(ids))
+}
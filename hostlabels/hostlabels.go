@@ -3,11 +3,10 @@ package hostlabels
 import (
 	"fmt"
 	"os"
-	"time"
 
-	cache "github.com/patrickmn/go-cache"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-agent/kubernetesevents"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -15,14 +14,16 @@ import (
 const (
 	metadataURLTemplate = "http://%v/2015-12-19"
 	rancherLabelKey     = "io.rancher.labels"
-	cacheExpiryMinutes  = 5 * time.Minute
 
 	// DefaultMetadataAddress specifies the default value to use if nothing is specified
 	DefaultMetadataAddress = "169.254.169.250"
 )
 
-// StartHostLabelSync ...
-func StartHostLabelSync(interval int, kClient *kubernetesclient.Client) error {
+// StartHostLabelSync keeps the labels of the kubernetes nodes in line with
+// the labels of their rancher hosts. Nodes are read from the shared node
+// informer, which should have synced, and only written to the API server
+// when they change.
+func StartHostLabelSync(interval int, kClient *kubernetesclient.Client, nodes *kubernetesevents.SharedInformer) error {
 	metadataAddress := os.Getenv("RANCHER_METADATA_ADDRESS")
 	if metadataAddress == "" {
 		metadataAddress = DefaultMetadataAddress
@@ -34,11 +35,10 @@ func StartHostLabelSync(interval int, kClient *kubernetesclient.Client) error {
 		log.Errorf("Error initializing metadata client: [%v]", err)
 		return err
 	}
-	expiringCache := cache.New(cacheExpiryMinutes, 1*time.Minute)
 	h := &hostLabelSyncer{
 		kClient:        kClient,
 		metadataClient: metadataClient,
-		cache:          expiringCache,
+		nodes:          nodes.Store(),
 	}
 	metadataClient.OnChange(interval, h.syncHostLabels)
 	return nil
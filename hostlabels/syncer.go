@@ -1,60 +1,75 @@
 package hostlabels
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	cache "github.com/patrickmn/go-cache"
 
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-agent/kubernetesevents"
 	"github.com/rancher/kubernetes-model/model"
 	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type hostLabelSyncer struct {
-	kClient            *kubernetesclient.Client
-	metadataClient     metadata.Client
-	cache              *cache.Cache
-	cacheExpiryMinutes time.Duration
+	kClient        *kubernetesclient.Client
+	metadataClient metadata.Client
+	nodes          *kubernetesevents.Store
 }
 
+const (
+	syncTimeout   = 2 * time.Minute
+	maxRetryCount = 3
+)
+
 func (h *hostLabelSyncer) syncHostLabels(version string) {
-	err := sync(h.kClient, h.metadataClient, h.cache)
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	err := sync(ctx, h.kClient, h.metadataClient, h.nodes)
 	if err != nil {
 		log.Errorf("Error syncing host labels: [%v]", err)
 	}
 }
 
-func getKubeNode(kClient *kubernetesclient.Client, hostname string) (*model.Node, error) {
-	node, err := kClient.Node.ByName(hostname)
+// cachedNode reads a node from the shared informer store, which holds every
+// node once the informer synced. Nodes it doesn't have yet are picked up by
+// the next sync.
+func cachedNode(nodes *kubernetesevents.Store, name string) (*model.Node, bool, error) {
+	obj, ok := nodes.Get("", name)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(obj)
 	if err != nil {
-		log.Errorf("Error getting node: [%s] by name from kubernetes, err: [%v]", hostname, err)
-		// This node might not have been added to kuberentes cluster yet, so skip it
+		return nil, false, err
+	}
+	node := &model.Node{}
+	if err := json.Unmarshal(data, node); err != nil {
+		return nil, false, err
 	}
-	return node, err
+	return node, true, nil
 }
 
-func sync(kClient *kubernetesclient.Client, metadataClient metadata.Client, c *cache.Cache) error {
+func sync(ctx context.Context, kClient *kubernetesclient.Client, metadataClient metadata.Client, nodes *kubernetesevents.Store) error {
 	hosts, err := metadataClient.GetHosts()
 	if err != nil {
 		log.Errorf("Error reading host list from metadata service: [%v], retrying", err)
 		return err
 	}
 	for _, host := range hosts {
-		nodeInt, ok := c.Get(host.Hostname)
+		node, ok, err := cachedNode(nodes, host.Hostname)
+		if err != nil {
+			return err
+		}
 		if !ok {
-			temp_node, err := getKubeNode(kClient, host.Hostname)
-			if err != nil {
-				log.Errorf("Error getting node: [%s] by name from kubernetes, err: [%v]", host.Hostname, err)
-				// This node might not have been added to kuberentes cluster yet, so skip it
-				continue
-			}
-			c.Set(host.Hostname, temp_node, 0)
-			nodeInt = temp_node
+			log.Infof("Node [%s] not found in kubernetes, skipping", host.Hostname)
+			// This node might not have been added to kuberentes cluster yet, so skip it
+			continue
 		}
-		node := nodeInt.(*model.Node)
 		if node.Metadata.Annotations == nil {
 			node.Metadata.Annotations = make(map[string]interface{})
 		}
@@ -93,53 +108,68 @@ func sync(kClient *kubernetesclient.Client, metadataClient metadata.Client, c *c
 				changed = true
 			}
 		}
-		retryCount := 0
-		maxRetryCount := 3
-		for changed {
-			node, err := getKubeNode(kClient, host.Hostname)
-			if err != nil {
-				log.Errorf("Error getting node: [%s] by name from kubernetes: [%v]", host.Hostname, err)
-				continue
-			}
-			c.Set(host.Hostname, node, 0)
-			if node.Metadata.Annotations == nil {
-				node.Metadata.Annotations = make(map[string]interface{})
+		if !changed {
+			continue
+		}
+		patch, err := labelsPatch(node, host.Labels)
+		if err != nil {
+			return err
+		}
+		// Patch only the labels we manage so concurrent node status updates
+		// by the kubelet aren't overwritten or cause conflicts
+		for retryCount := 0; ; retryCount++ {
+			// The informer picks up the patched node from its watch
+			_, err := kClient.Node.PatchNodeContext(ctx, host.Hostname, kubernetesclient.MergePatchType, patch)
+			if err == nil {
+				break
 			}
-			rancherLabelsMetadataStore := node.Metadata.Annotations
-			for k, v1 := range host.Labels {
-				if !isValidLabelValue(v1) {
-					log.Infof("skipping invalid label %s=%s", k, v1)
-					continue
-				}
-				node.Metadata.Labels[k] = v1
-				rancherLabelsMetadataStore[toKMetaLabel(k)] = ""
-
+			log.Errorf("Error updating node [%s] with new host labels, err :[%v]", host.Hostname, err)
+			if kubernetesclient.IsNotFound(err) {
+				// The node was removed from the cluster since it was cached
+				break
 			}
-			for k := range node.Metadata.Labels {
-				if _, ok := rancherLabelsMetadataStore[toKMetaLabel(k)]; !ok {
-					// This is not a rancher managed label
-					continue
-				}
-				if _, ok := host.Labels[k]; !ok {
-					delete(node.Metadata.Labels, k)
-					delete(rancherLabelsMetadataStore, toKMetaLabel(k))
-				}
+			if retryCount >= maxRetryCount {
+				break
 			}
-
-			_, err = kClient.Node.ReplaceNode(node)
-			if err != nil {
-				log.Errorf("Error updating node [%s] with new host labels, err :[%v]", host.Hostname, err)
-				if retryCount < maxRetryCount {
-					retryCount = retryCount + 1
-					continue
-				}
+			if err := kubernetesclient.Backoff(ctx, retryCount); err != nil {
+				break
 			}
-			changed = false
 		}
 	}
 	return nil
 }
 
+// labelsPatch builds a merge patch that sets the valid host labels on the node
+// and removes the rancher managed labels the host no longer has.
+func labelsPatch(node *model.Node, hostLabels map[string]string) ([]byte, error) {
+	labels := map[string]interface{}{}
+	annotations := map[string]interface{}{}
+	for k, v := range hostLabels {
+		if !isValidLabelValue(v) {
+			log.Infof("skipping invalid label %s=%s", k, v)
+			continue
+		}
+		labels[k] = v
+		annotations[toKMetaLabel(k)] = ""
+	}
+	for k := range node.Metadata.Labels {
+		if _, ok := node.Metadata.Annotations[toKMetaLabel(k)]; !ok {
+			// This is not a rancher managed label
+			continue
+		}
+		if _, ok := hostLabels[k]; !ok {
+			labels[k] = nil
+			annotations[toKMetaLabel(k)] = nil
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	})
+}
+
 func isValidLabelValue(label string) bool {
 	errs := validation.IsValidLabelValue(label)
 	if len(errs) > 0 {
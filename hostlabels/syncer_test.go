@@ -1,6 +1,7 @@
 package hostlabels
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net"
@@ -11,9 +12,9 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	cache "github.com/patrickmn/go-cache"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-agent/kubernetesevents"
 	"github.com/rancher/kubernetes-model/model"
 )
 
@@ -39,6 +40,9 @@ func (f *fakeMetadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 type fakeKubeNodeHandler struct {
 	nodes map[string]*model.Node
+	// patchFailures is the number of patches to answer with a conflict
+	patchFailures int
+	patchTimes    []time.Time
 }
 
 type tcpKeepAliveListener struct {
@@ -56,6 +60,17 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 }
 
 func (f *fakeKubeNodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// List Nodes
+	if r.Method == http.MethodGet && r.URL.Path == "/api/v1/nodes" {
+		list := &model.NodeList{}
+		for _, node := range f.nodes {
+			list.Items = append(list.Items, *node)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		hb, _ := json.Marshal(list)
+		w.Write(hb)
+		return
+	}
 	// GET Node
 	if r.Method == http.MethodGet {
 		pathArray := strings.Split(r.URL.Path, "/")
@@ -64,6 +79,33 @@ func (f *fakeKubeNodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		hb, _ := json.Marshal(f.nodes[name])
 		w.Write(hb)
 	}
+	// Patch Node
+	if r.Method == http.MethodPatch {
+		f.patchTimes = append(f.patchTimes, time.Now())
+		if f.patchFailures > 0 {
+			f.patchFailures--
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if r.Header.Get("Content-Type") != string(kubernetesclient.MergePatchType) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		pathArray := strings.Split(r.URL.Path, "/")
+		name := pathArray[len(pathArray)-1]
+		original := map[string]interface{}{}
+		nb, _ := json.Marshal(f.nodes[name])
+		json.Unmarshal(nb, &original)
+		patch := map[string]interface{}{}
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &patch)
+
+		patched, _ := json.Marshal(mergePatch(original, patch))
+		node := &model.Node{}
+		json.Unmarshal(patched, node)
+		f.nodes[name] = node
+		w.Write(patched)
+	}
 	// Replace Node
 	if r.Method == http.MethodPut {
 		node := &model.Node{}
@@ -74,6 +116,26 @@ func (f *fakeKubeNodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// mergePatch applies an RFC 7386 merge patch
+func mergePatch(original, patch map[string]interface{}) map[string]interface{} {
+	for k, v := range patch {
+		if v == nil {
+			delete(original, k)
+			continue
+		}
+		patchMap, ok := v.(map[string]interface{})
+		originalMap, isMap := original[k].(map[string]interface{})
+		if ok && isMap {
+			original[k] = mergePatch(originalMap, patchMap)
+		} else if ok {
+			original[k] = mergePatch(map[string]interface{}{}, patchMap)
+		} else {
+			original[k] = v
+		}
+	}
+	return original
+}
+
 func TestMain(m *testing.M) {
 	metadataHandler = &fakeMetadataHandler{
 		hosts: []metadata.Host{},
@@ -102,6 +164,7 @@ func TestMain(m *testing.M) {
 		Addr:    "0.0.0.0:42501",
 		Handler: kubeMux,
 	}
+	kubeMux.Handle("/api/v1/nodes", kubeHandler)
 	kubeMux.Handle("/api/v1/nodes/", kubeHandler)
 	ksrvLn, err := net.Listen("tcp", ksrv.Addr)
 	if err != nil {
@@ -123,10 +186,23 @@ func TestMain(m *testing.M) {
 	os.Exit(returnVal)
 }
 
+// cacheNode puts node in the store the way the node informer would.
+func cacheNode(t *testing.T, nodes *kubernetesevents.Store, node *model.Node) {
+	data, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &kubernetesclient.Unstructured{}
+	if err := json.Unmarshal(data, obj); err != nil {
+		t.Fatal(err)
+	}
+	nodes.Add(obj)
+}
+
 func TestDetectsRemoval(t *testing.T) {
 	metadataClient := metadata.NewClient(fakeMetadataURL)
 	kubeClient := kubernetesclient.NewClient(kubeURL, false)
-	c := cache.New(1*time.Minute, 1*time.Minute)
+	nodes := kubernetesevents.NewStore(kubernetesevents.DefaultIndexers)
 
 	metadataHandler.hosts = []metadata.Host{
 		{
@@ -148,7 +224,8 @@ func TestDetectsRemoval(t *testing.T) {
 		},
 	}
 
-	sync(kubeClient, metadataClient, c)
+	cacheNode(t, nodes, kubeHandler.nodes["test1"])
+	sync(context.Background(), kubeClient, metadataClient, nodes)
 
 	if _, ok := kubeHandler.nodes["test1"].Metadata.Labels["test1"]; ok {
 		t.Error("Label test1 was not detected as removed")
@@ -158,7 +235,7 @@ func TestDetectsRemoval(t *testing.T) {
 func TestDetectsAddition(t *testing.T) {
 	metadataClient := metadata.NewClient(fakeMetadataURL)
 	kubeClient := kubernetesclient.NewClient(kubeURL, false)
-	c := cache.New(1*time.Minute, 1*time.Minute)
+	nodes := kubernetesevents.NewStore(kubernetesevents.DefaultIndexers)
 
 	metadataHandler.hosts = []metadata.Host{
 		{
@@ -182,7 +259,8 @@ func TestDetectsAddition(t *testing.T) {
 		},
 	}
 
-	sync(kubeClient, metadataClient, c)
+	cacheNode(t, nodes, kubeHandler.nodes["test2"])
+	sync(context.Background(), kubeClient, metadataClient, nodes)
 
 	if _, ok := kubeHandler.nodes["test2"].Metadata.Labels["test2"]; !ok {
 		t.Error("Label test2 was not detected as added")
@@ -196,7 +274,7 @@ func TestDetectsAddition(t *testing.T) {
 func TestDetectsChange(t *testing.T) {
 	metadataClient := metadata.NewClient(fakeMetadataURL)
 	kubeClient := kubernetesclient.NewClient(kubeURL, false)
-	c := cache.New(1*time.Minute, 1*time.Minute)
+	nodes := kubernetesevents.NewStore(kubernetesevents.DefaultIndexers)
 
 	metadataHandler.hosts = []metadata.Host{
 		{
@@ -220,7 +298,8 @@ func TestDetectsChange(t *testing.T) {
 		},
 	}
 
-	sync(kubeClient, metadataClient, c)
+	cacheNode(t, nodes, kubeHandler.nodes["test3"])
+	sync(context.Background(), kubeClient, metadataClient, nodes)
 
 	if val := kubeHandler.nodes["test3"].Metadata.Labels["test3"]; val != "val3" {
 		t.Error("Label test3 was not detected as changed")
@@ -230,3 +309,121 @@ func TestDetectsChange(t *testing.T) {
 		t.Error("Annotation was not set on addition of new label")
 	}
 }
+
+func TestPreservesConcurrentNodeUpdates(t *testing.T) {
+	metadataClient := metadata.NewClient(fakeMetadataURL)
+	kubeClient := kubernetesclient.NewClient(kubeURL, false)
+	nodes := kubernetesevents.NewStore(kubernetesevents.DefaultIndexers)
+
+	metadataHandler.hosts = []metadata.Host{
+		{
+			Name:     "test4",
+			Hostname: "test4",
+			Labels: map[string]string{
+				"test4": "val4",
+			},
+		},
+	}
+
+	cacheNode(t, nodes, &model.Node{
+		Metadata: &model.ObjectMeta{
+			Name: "test4",
+		},
+	})
+
+	// The kubelet updated the node after it was cached
+	kubeHandler.nodes["test4"] = &model.Node{
+		Metadata: &model.ObjectMeta{
+			Labels: map[string]interface{}{
+				"kubelet": "label",
+			},
+			Name: "test4",
+		},
+		Status: &model.NodeStatus{
+			Phase: "Running",
+		},
+	}
+
+	sync(context.Background(), kubeClient, metadataClient, nodes)
+
+	node := kubeHandler.nodes["test4"]
+	if val := node.Metadata.Labels["test4"]; val != "val4" {
+		t.Error("Label test4 was not detected as added")
+	}
+	if _, ok := node.Metadata.Labels["kubelet"]; !ok {
+		t.Error("Concurrently added label was overwritten")
+	}
+	if node.Status == nil || node.Status.Phase != "Running" {
+		t.Error("Concurrently updated status was overwritten")
+	}
+}
+
+func TestRetriesPatchWithBackoff(t *testing.T) {
+	metadataClient := metadata.NewClient(fakeMetadataURL)
+	kubeClient := kubernetesclient.NewClient(kubeURL, false)
+	nodes := kubernetesevents.NewStore(kubernetesevents.DefaultIndexers)
+
+	metadataHandler.hosts = []metadata.Host{
+		{
+			Name:     "test5",
+			Hostname: "test5",
+			Labels: map[string]string{
+				"test5": "val5",
+			},
+		},
+	}
+
+	kubeHandler.nodes["test5"] = &model.Node{
+		Metadata: &model.ObjectMeta{
+			Name: "test5",
+		},
+	}
+	kubeHandler.patchFailures = 2
+	kubeHandler.patchTimes = nil
+	defer func() { kubeHandler.patchFailures = 0 }()
+
+	cacheNode(t, nodes, kubeHandler.nodes["test5"])
+	sync(context.Background(), kubeClient, metadataClient, nodes)
+
+	if _, ok := kubeHandler.nodes["test5"].Metadata.Labels["test5"]; !ok {
+		t.Error("Label test5 was not added after the conflicts")
+	}
+	if len(kubeHandler.patchTimes) != 3 {
+		t.Fatalf("Expected 3 patches, got %d", len(kubeHandler.patchTimes))
+	}
+	for i := 1; i < len(kubeHandler.patchTimes); i++ {
+		if kubeHandler.patchTimes[i].Sub(kubeHandler.patchTimes[i-1]) < 50*time.Millisecond {
+			t.Errorf("Patch %d was retried without backing off", i)
+		}
+	}
+}
+
+func TestSkipsUncachedNodes(t *testing.T) {
+	metadataClient := metadata.NewClient(fakeMetadataURL)
+	kubeClient := kubernetesclient.NewClient(kubeURL, false)
+	nodes := kubernetesevents.NewStore(kubernetesevents.DefaultIndexers)
+
+	metadataHandler.hosts = []metadata.Host{
+		{
+			Name:     "test6",
+			Hostname: "test6",
+			Labels: map[string]string{
+				"test6": "val6",
+			},
+		},
+	}
+
+	// The informer hasn't seen the node yet
+	kubeHandler.nodes["test6"] = &model.Node{
+		Metadata: &model.ObjectMeta{
+			Name: "test6",
+		},
+	}
+
+	if err := sync(context.Background(), kubeClient, metadataClient, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kubeHandler.nodes["test6"].Metadata.Labels["test6"]; ok {
+		t.Error("The uncached node was read from the API")
+	}
+}
@@ -3,48 +3,135 @@ package kubernetesclient
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 const (
-	caLocation = "/etc/kubernetes/ssl/ca.pem"
+	caLocation   = "/etc/kubernetes/ssl/ca.pem"
+	certLocation = "/etc/kubernetes/ssl/cert.pem"
+	keyLocation  = "/etc/kubernetes/ssl/key.pem"
 )
 
+// credentials holds everything needed to authenticate against the kubernetes
+// API, regardless of where it was loaded from.
+type credentials struct {
+	token       string
+	tokenFile   *fileToken
+	username    string
+	password    string
+	caData      []byte
+	certificate *tls.Certificate
+	keyPair     *fileKeyPair
+	insecure    bool
+}
+
 var (
-	token  string
-	caData []byte
+	credsLock sync.RWMutex
+	creds     = &credentials{}
 )
 
-func Init() error {
-	bytes, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
-		return fmt.Errorf("Failed to read token from stdin: %v", err)
-	}
-	token = strings.TrimSpace(string(bytes))
-	if token == "" {
-		return errors.New("No token passed in from stdin")
-	}
+func setCredentials(c *credentials) {
+	credsLock.Lock()
+	creds = c
+	credsLock.Unlock()
 
-	caData, err = ioutil.ReadFile(caLocation)
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	resetTransport()
+}
+
+func getCredentials() *credentials {
+	credsLock.RLock()
+	defer credsLock.RUnlock()
+	return creds
+}
+
+// Init reads the bearer token from stdin and the CA from the location
+// populated by entry.sh. With clientCertAuth the Rancher issued cert.pem and
+// key.pem are presented as a client certificate instead, and stdin isn't read,
+// since nothing may ever write to it.
+func Init(clientCertAuth bool) error {
+	caData, err := ioutil.ReadFile(caLocation)
 	if err != nil {
 		return fmt.Errorf("Failed to read CA cert %s: %v", caLocation, err)
 	}
 
+	c := &credentials{
+		caData: caData,
+	}
+	if clientCertAuth {
+		c.keyPair, err = newFileKeyPair(certLocation, keyLocation)
+		if err != nil {
+			return err
+		}
+	} else {
+		bytes, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("Failed to read token from stdin: %v", err)
+		}
+		c.token = strings.TrimSpace(string(bytes))
+		if c.token == "" {
+			return errors.New("No token passed in from stdin")
+		}
+	}
+
+	setCredentials(c)
 	return nil
 }
 
+func (c *credentials) bearerToken() string {
+	if c.tokenFile != nil {
+		return c.tokenFile.Token()
+	}
+	return c.token
+}
+
 func GetAuthorizationHeader() string {
-	return fmt.Sprintf("Bearer %s", token)
+	c := getCredentials()
+	if token := c.bearerToken(); token != "" {
+		return fmt.Sprintf("Bearer %s", token)
+	}
+	if c.username != "" || c.password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(c.username + ":" + c.password))
+		return fmt.Sprintf("Basic %s", auth)
+	}
+	return ""
+}
+
+// SetAuthorizationHeader adds the Authorization header to the given headers
+// when the configured credentials call for one. Client certificate
+// authentication doesn't need a header at all.
+func SetAuthorizationHeader(header http.Header) {
+	if auth := GetAuthorizationHeader(); auth != "" {
+		header.Set("Authorization", auth)
+	}
 }
 
 func GetTLSClientConfig() *tls.Config {
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(caData)
-	return &tls.Config{
-		RootCAs: certPool,
+	c := getCredentials()
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.insecure,
+	}
+	if len(c.caData) > 0 {
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(c.caData) {
+			log.Warn("No valid certificates found in the configured CA data")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	if c.keyPair != nil {
+		tlsConfig.GetClientCertificate = c.keyPair.getClientCertificate
+	} else if c.certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.certificate}
 	}
+	return tlsConfig
 }
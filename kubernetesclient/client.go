@@ -2,21 +2,61 @@ package kubernetesclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 const byNamePath string = "/api/v1/namespaces/%s/%s/%s"
 
+// ClientOptions controls how hard a client may push the API server.
+type ClientOptions struct {
+	// QPS is the sustained number of requests per second. Zero disables the
+	// rate limiter.
+	QPS float64
+	// Burst is the number of requests that may be sent at once above QPS
+	Burst int
+	// MaxRetries is how often a request that failed transiently is repeated
+	MaxRetries int
+}
+
+var DefaultClientOptions = ClientOptions{
+	QPS:        20,
+	Burst:      40,
+	MaxRetries: 5,
+}
+
 func NewClient(apiURL string, debug bool) *Client {
+	return NewClientWithOptions(apiURL, debug, DefaultClientOptions)
+}
+
+func NewClientWithOptions(apiURL string, debug bool, opts ClientOptions) *Client {
+	return newClient(baseClient{
+		BaseURL:     apiURL,
+		debug:       debug,
+		rateLimiter: newTokenBucket(opts.QPS, opts.Burst),
+		maxRetries:  opts.MaxRetries,
+		stats:       newRequestStats(),
+	})
+}
+
+// WithDebug returns a client that shares the rate limit and stats of c, so
+// that the QPS limit holds across both, and prints its requests when debug
+// is set.
+func (c *Client) WithDebug(debug bool) *Client {
+	base := c.baseClient
+	base.debug = debug
+	return newClient(base)
+}
+
+func newClient(base baseClient) *Client {
 	client := &Client{
-		baseClient: baseClient{
-			BaseURL: apiURL,
-			debug:   debug,
-		},
+		baseClient: base,
 	}
 
 	client.Pod = newPodClient(client)
@@ -24,6 +64,7 @@ func NewClient(apiURL string, debug bool) *Client {
 	client.ReplicationController = newReplicationControllerClient(client)
 	client.Service = newServiceClient(client)
 	client.Node = newNodeClient(client)
+	client.Discovery = newDiscoveryClient(client)
 
 	return client
 }
@@ -35,56 +76,50 @@ type Client struct {
 	ReplicationController ReplicationControllerOperations
 	Service               ServiceOperations
 	Node                  NodeOperations
+	Discovery             *DiscoveryClient
+}
+
+// Stats returns the request and retry counters of this client.
+func (c *Client) Stats() RequestStats {
+	return c.stats.snapshot()
 }
 
 type baseClient struct {
-	BaseURL string
-	debug   bool
+	BaseURL     string
+	debug       bool
+	rateLimiter *tokenBucket
+	maxRetries  int
+	stats       *requestStats
 }
 
-func (c *baseClient) doByName(resourceType string, namespace string, name string, responseObject interface{}) error {
+func (c *baseClient) doByName(ctx context.Context, resourceType string, namespace string, name string, responseObject interface{}) error {
 	path := fmt.Sprintf(byNamePath, namespace, resourceType, name)
-	err := c.doGet(path, responseObject)
+	err := c.doGet(ctx, path, responseObject)
 	return err
 }
 
-func (c *baseClient) doGet(path string, respObject interface{}) error {
+func (c *baseClient) doGet(ctx context.Context, path string, respObject interface{}) error {
 	url := c.BaseURL + path
-	return c.doNoBodyRequest("GET", url, respObject)
+	return c.doNoBodyRequest(ctx, "GET", url, respObject)
 }
 
-func (c *baseClient) doDelete(path string, respObject interface{}) error {
+func (c *baseClient) doDelete(ctx context.Context, path string, respObject interface{}) error {
 	url := c.BaseURL + path
-	return c.doNoBodyRequest("DELETE", url, respObject)
+	return c.doNoBodyRequest(ctx, "DELETE", url, respObject)
 }
 
-func (c *baseClient) doNoBodyRequest(method string, url string, respObject interface{}) error {
-	client := c.newHttpClient()
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Authorization", GetAuthorizationHeader())
-
+func (c *baseClient) doNoBodyRequest(ctx context.Context, method string, url string, respObject interface{}) error {
 	if c.debug {
 		fmt.Println("Request => " + method + " " + url)
 	}
 
-	resp, err := client.Do(req)
+	resp, byteContent, err := c.doRequest(ctx, method, url, "", nil)
 	if err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
-
 	if resp.StatusCode != 200 {
-		return newApiError(resp, url)
-	}
-
-	byteContent, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+		return newApiError(resp, url, byteContent)
 	}
 
 	if c.debug {
@@ -94,52 +129,41 @@ func (c *baseClient) doNoBodyRequest(method string, url string, respObject inter
 	return json.Unmarshal(byteContent, respObject)
 }
 
-func (c *baseClient) doPost(path string, inputObject interface{}, respObject interface{}) error {
-	return c.doModify(path, "POST", inputObject, respObject)
+func (c *baseClient) doPost(ctx context.Context, path string, inputObject interface{}, respObject interface{}) error {
+	return c.doModify(ctx, path, "POST", inputObject, respObject)
 }
 
-func (c *baseClient) doPut(path string, inputObject interface{}, respObject interface{}) error {
-	return c.doModify(path, "PUT", inputObject, respObject)
+func (c *baseClient) doPut(ctx context.Context, path string, inputObject interface{}, respObject interface{}) error {
+	return c.doModify(ctx, path, "PUT", inputObject, respObject)
 }
 
-func (c *baseClient) doModify(path string, method string, inputObject interface{}, respObject interface{}) error {
-	url := c.BaseURL + path
+func (c *baseClient) doPatch(ctx context.Context, path string, patchType PatchType, patch []byte, respObject interface{}) error {
+	return c.doBodyRequest(ctx, path, "PATCH", string(patchType), patch, respObject)
+}
 
-	var input io.Reader
+func (c *baseClient) doModify(ctx context.Context, path string, method string, inputObject interface{}, respObject interface{}) error {
 	bodyContent, err := json.Marshal(inputObject)
 	if err != nil {
 		return err
 	}
-	input = bytes.NewBuffer(bodyContent)
+	return c.doBodyRequest(ctx, path, method, "application/json", bodyContent, respObject)
+}
+
+func (c *baseClient) doBodyRequest(ctx context.Context, path string, method string, contentType string, bodyContent []byte, respObject interface{}) error {
+	url := c.BaseURL + path
 
 	if c.debug {
 		fmt.Println(method + " " + url)
 		fmt.Println("Request => " + string(bodyContent))
 	}
 
-	client := c.newHttpClient()
-	req, err := http.NewRequest(method, url, input)
+	resp, byteContent, err := c.doRequest(ctx, method, url, contentType, bodyContent)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	req.Header.Set("Authorization", GetAuthorizationHeader())
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		return newApiError(resp, url)
-	}
-
-	byteContent, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+		return newApiError(resp, url, byteContent)
 	}
 
 	if c.debug {
@@ -149,41 +173,65 @@ func (c *baseClient) doModify(path string, method string, inputObject interface{
 	return json.Unmarshal(byteContent, respObject)
 }
 
-func (c *baseClient) newHttpClient() *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: GetTLSClientConfig(),
-		},
+// doRequest sends a request once the rate limiter allows it, repeating it
+// with backoff while it fails transiently. Its attempts are counted by the
+// client's stats and by the CallStats of ctx, if it has one. It returns the final response
+// together with its body, which has already been read and closed.
+func (c *baseClient) doRequest(ctx context.Context, method string, url string, contentType string, bodyContent []byte) (*http.Response, []byte, error) {
+	client := c.newHttpClient()
+	call := callStatsFrom(ctx)
+	for attempt := 0; ; attempt++ {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			return nil, nil, err
+		}
+
+		var body io.Reader
+		if bodyContent != nil {
+			body = bytes.NewReader(bodyContent)
+		}
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		req = req.WithContext(ctx)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		SetAuthorizationHeader(req.Header)
+
+		resp, err := client.Do(req)
+		var byteContent []byte
+		if err == nil {
+			byteContent, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		c.stats.attempt(resp)
+		call.attempt(resp)
+
+		delay, retry := retryDelay(method, resp, err, attempt)
+		if !retry || attempt >= c.maxRetries || ctx.Err() != nil {
+			if err != nil || resp.StatusCode >= 300 {
+				c.stats.failure()
+			}
+			return resp, byteContent, err
+		}
+
+		c.stats.retry(method)
+		call.retry()
+		if err != nil {
+			log.Warnf("Retrying %s %s in %v after attempt %d failed: %v", method, url, delay, attempt+1, err)
+		} else {
+			log.Warnf("Retrying %s %s in %v after attempt %d failed with status %d", method, url, delay, attempt+1, resp.StatusCode)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, nil, err
+		}
 	}
 }
 
-type ApiError struct {
-	StatusCode int
-	Url        string
-	Msg        string
-	Status     string
-	Body       string
-}
-
-func (e ApiError) Error() string {
-	return e.Msg
-}
-
-func newApiError(resp *http.Response, url string) *ApiError {
-	contents, err := ioutil.ReadAll(resp.Body)
-	var body string
-	if err != nil {
-		body = "Unreadable body."
-	} else {
-		body = string(contents)
-	}
-	formattedMsg := fmt.Sprintf("Bad response from [%s], statusCode [%d]. Status [%s]. Body: [%s]",
-		url, resp.StatusCode, resp.Status, body)
-	return &ApiError{
-		Url:        url,
-		Msg:        formattedMsg,
-		StatusCode: resp.StatusCode,
-		Status:     resp.Status,
-		Body:       body,
-	}
+// newHttpClient returns a client on top of the transport shared by all
+// requests, so connections to the API server are pooled and reused.
+func (c *baseClient) newHttpClient() *http.Client {
+	return NewHTTPClient()
 }
@@ -65,7 +65,7 @@ func cleanupService(client *Client, namespace string, name string) error {
 	_, err := client.Service.DeleteService(namespace, name)
 	// _, err := client.Service.ByName(namespace, name)
 	if err != nil {
-		if apiError, ok := err.(*ApiError); ok && apiError.StatusCode == 404 {
+		if IsNotFound(err) {
 			return nil
 		} else {
 			return err
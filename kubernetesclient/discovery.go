@@ -0,0 +1,316 @@
+package kubernetesclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	coreAPIPath  = "/api"
+	groupAPIPath = "/apis"
+)
+
+var versionPattern = regexp.MustCompile(`^v\d+((alpha|beta)\d+)?$`)
+
+// GroupVersionResource identifies a kind of resource served by the API.
+// Group is empty for the core API.
+type GroupVersionResource struct {
+	Group    string
+	Version  string
+	Resource string
+}
+
+func (gvr GroupVersionResource) GroupVersion() string {
+	if gvr.Group == "" {
+		return gvr.Version
+	}
+	return gvr.Group + "/" + gvr.Version
+}
+
+// Path returns the path the resource is served under across all namespaces.
+func (gvr GroupVersionResource) Path() string {
+	return groupVersionPath(gvr.GroupVersion()) + "/" + gvr.Resource
+}
+
+// NamespacedPath returns the path the resource is served under in namespace.
+func (gvr GroupVersionResource) NamespacedPath(namespace string) string {
+	return groupVersionPath(gvr.GroupVersion()) + "/namespaces/" + namespace + "/" + gvr.Resource
+}
+
+func (gvr GroupVersionResource) String() string {
+	if gvr.Group == "" {
+		return gvr.Resource + "." + gvr.Version
+	}
+	return gvr.Resource + "." + gvr.Version + "." + gvr.Group
+}
+
+func groupVersionPath(groupVersion string) string {
+	if strings.Contains(groupVersion, "/") {
+		return groupAPIPath + "/" + groupVersion
+	}
+	return coreAPIPath + "/" + groupVersion
+}
+
+// APIResource describes a resource as reported by discovery.
+type APIResource struct {
+	Name       string   `json:"name"`
+	Namespaced bool     `json:"namespaced"`
+	Kind       string   `json:"kind"`
+	Verbs      []string `json:"verbs"`
+}
+
+func (r APIResource) HasVerb(verb string) bool {
+	for _, v := range r.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+type apiVersions struct {
+	Versions []string `json:"versions"`
+}
+
+type groupVersionForDiscovery struct {
+	GroupVersion string `json:"groupVersion"`
+	Version      string `json:"version"`
+}
+
+type apiGroup struct {
+	Name             string                     `json:"name"`
+	Versions         []groupVersionForDiscovery `json:"versions"`
+	PreferredVersion groupVersionForDiscovery   `json:"preferredVersion"`
+}
+
+type apiGroupList struct {
+	Groups []apiGroup `json:"groups"`
+}
+
+type apiResourceList struct {
+	GroupVersion string        `json:"groupVersion"`
+	Resources    []APIResource `json:"resources"`
+}
+
+// discoveredGroup holds the resources of every version of a group, preferred
+// version first.
+type discoveredGroup struct {
+	name      string
+	versions  []string
+	resources map[string][]APIResource
+}
+
+// DiscoveryClient finds out which resources the API server serves. The
+// result is read once and cached for the lifetime of the client, except for
+// the group versions that couldn't be read, like those of an aggregated API
+// that is down.
+type DiscoveryClient struct {
+	client *Client
+
+	sync.Mutex
+	groups      []discoveredGroup
+	unavailable []GroupVersionResource
+}
+
+func newDiscoveryClient(client *Client) *DiscoveryClient {
+	return &DiscoveryClient{
+		client: client,
+	}
+}
+
+func (d *DiscoveryClient) serverGroups(ctx context.Context) ([]discoveredGroup, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.groups != nil {
+		return d.groups, nil
+	}
+
+	core := &apiVersions{}
+	if err := d.client.doGet(ctx, coreAPIPath, core); err != nil {
+		return nil, err
+	}
+	groupList := &apiGroupList{}
+	if err := d.client.doGet(ctx, groupAPIPath, groupList); err != nil {
+		return nil, err
+	}
+
+	groups := []discoveredGroup{{name: "", versions: core.Versions}}
+	for _, group := range groupList.Groups {
+		discovered := discoveredGroup{name: group.Name}
+		if group.PreferredVersion.Version != "" {
+			discovered.versions = append(discovered.versions, group.PreferredVersion.Version)
+		}
+		for _, version := range group.Versions {
+			if version.Version != group.PreferredVersion.Version {
+				discovered.versions = append(discovered.versions, version.Version)
+			}
+		}
+		groups = append(groups, discovered)
+	}
+
+	var unavailable []GroupVersionResource
+	for i := range groups {
+		groups[i].resources = map[string][]APIResource{}
+		for _, version := range groups[i].versions {
+			gvr := GroupVersionResource{Group: groups[i].name, Version: version}
+			if err := d.readGroupVersion(ctx, groups, gvr); err != nil {
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				log.Warnf("Skipping unavailable API group version [%s]: %v", gvr.GroupVersion(), err)
+				unavailable = append(unavailable, gvr)
+			}
+		}
+	}
+
+	d.groups = groups
+	d.unavailable = unavailable
+	return groups, nil
+}
+
+// readGroupVersion stores the resources of gvr's group version in groups.
+func (d *DiscoveryClient) readGroupVersion(ctx context.Context, groups []discoveredGroup, gvr GroupVersionResource) error {
+	resources := &apiResourceList{}
+	if err := d.client.doGet(ctx, groupVersionPath(gvr.GroupVersion()), resources); err != nil {
+		return err
+	}
+	for i := range groups {
+		if groups[i].name == gvr.Group {
+			groups[i].resources[gvr.Version] = resources.Resources
+		}
+	}
+	return nil
+}
+
+// retryUnavailable reads the group versions that failed before again. It
+// returns the ones still unavailable.
+func (d *DiscoveryClient) retryUnavailable(ctx context.Context) []GroupVersionResource {
+	d.Lock()
+	defer d.Unlock()
+	var unavailable []GroupVersionResource
+	for _, gvr := range d.unavailable {
+		if err := d.readGroupVersion(ctx, d.groups, gvr); err != nil {
+			log.Warnf("API group version [%s] is still unavailable: %v", gvr.GroupVersion(), err)
+			unavailable = append(unavailable, gvr)
+		}
+	}
+	d.unavailable = unavailable
+	return unavailable
+}
+
+// UnknownResourceError is returned by ResolveResource for a resource the API
+// server doesn't serve, as opposed to one that couldn't be looked up.
+type UnknownResourceError struct {
+	Name string
+}
+
+func (e UnknownResourceError) Error() string {
+	return fmt.Sprintf("The server doesn't have a resource type [%s]", e.Name)
+}
+
+// IsUnknownResource is true when the API server doesn't serve a resource, a
+// mistake that looking it up again won't fix.
+func IsUnknownResource(err error) bool {
+	_, ok := err.(UnknownResourceError)
+	return ok
+}
+
+// ResolveResource maps a resource name such as "deployments" to the group
+// and version the API server prefers for it. The name may be qualified with
+// a group, "deployments.apps", or pinned to a version, "deployments.v1.apps"
+// or "pods.v1" for the core API. The singular kind, "Deployment", is
+// accepted too.
+//
+// Group versions that couldn't be read are skipped. They only make this
+// fail when the resource isn't found elsewhere, and are read again first.
+// Only a resource missing from every group version is an
+// UnknownResourceError.
+func (d *DiscoveryClient) ResolveResource(ctx context.Context, name string) (GroupVersionResource, APIResource, error) {
+	groups, err := d.serverGroups(ctx)
+	if err != nil {
+		return GroupVersionResource{}, APIResource{}, err
+	}
+	if gvr, r, ok := d.find(groups, name); ok {
+		return gvr, r, nil
+	}
+
+	d.Lock()
+	retry := len(d.unavailable) > 0
+	d.Unlock()
+	if !retry {
+		return GroupVersionResource{}, APIResource{}, UnknownResourceError{Name: name}
+	}
+	unavailable := d.retryUnavailable(ctx)
+	if gvr, r, ok := d.find(groups, name); ok {
+		return gvr, r, nil
+	}
+	if len(unavailable) == 0 {
+		return GroupVersionResource{}, APIResource{}, UnknownResourceError{Name: name}
+	}
+	groupVersions := make([]string, len(unavailable))
+	for i, gvr := range unavailable {
+		groupVersions[i] = gvr.GroupVersion()
+	}
+	return GroupVersionResource{}, APIResource{}, fmt.Errorf("Couldn't find resource type [%s], API group versions %s are unavailable", name, strings.Join(groupVersions, ", "))
+}
+
+func (d *DiscoveryClient) find(groups []discoveredGroup, name string) (GroupVersionResource, APIResource, bool) {
+	resource, version, group, qualified := parseResourceName(name)
+
+	d.Lock()
+	defer d.Unlock()
+	// Look at the preferred version of every group before falling back to
+	// the others, so a resource served by several groups resolves the same
+	// way kubectl would.
+	for _, preferredOnly := range []bool{true, false} {
+		for _, g := range groups {
+			if qualified && g.name != group {
+				continue
+			}
+			for i, v := range g.versions {
+				if version != "" && v != version {
+					continue
+				}
+				if version == "" && preferredOnly && i > 0 {
+					break
+				}
+				for _, r := range g.resources[v] {
+					if strings.Contains(r.Name, "/") {
+						// A subresource such as pods/log
+						continue
+					}
+					if r.Name == resource || strings.EqualFold(r.Kind, resource) {
+						return GroupVersionResource{Group: g.name, Version: v, Resource: r.Name}, r, true
+					}
+				}
+			}
+		}
+	}
+	return GroupVersionResource{}, APIResource{}, false
+}
+
+// parseResourceName splits resource[.version][.group]. qualified is set when
+// a group or version was given, in which case group may be "" for the core
+// API.
+func parseResourceName(name string) (resource, version, group string, qualified bool) {
+	parts := strings.SplitN(name, ".", 2)
+	resource = parts[0]
+	if len(parts) == 1 {
+		return resource, "", "", false
+	}
+	rest := parts[1]
+	parts = strings.SplitN(rest, ".", 2)
+	if versionPattern.MatchString(parts[0]) {
+		version = parts[0]
+		if len(parts) == 2 {
+			group = parts[1]
+		}
+		return resource, version, group, true
+	}
+	return resource, "", rest, true
+}
@@ -0,0 +1,192 @@
+package kubernetesclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var discoveryResponses = map[string]string{
+	"/api": `{"kind": "APIVersions", "versions": ["v1"]}`,
+	"/apis": `{"kind": "APIGroupList", "groups": [
+		{"name": "apps", "versions": [{"groupVersion": "apps/v1", "version": "v1"}, {"groupVersion": "apps/v1beta2", "version": "v1beta2"}],
+		 "preferredVersion": {"groupVersion": "apps/v1", "version": "v1"}},
+		{"name": "extensions", "versions": [{"groupVersion": "extensions/v1beta1", "version": "v1beta1"}],
+		 "preferredVersion": {"groupVersion": "extensions/v1beta1", "version": "v1beta1"}},
+		{"name": "networking.k8s.io", "versions": [{"groupVersion": "networking.k8s.io/v1", "version": "v1"}],
+		 "preferredVersion": {"groupVersion": "networking.k8s.io/v1", "version": "v1"}}
+	]}`,
+	"/api/v1": `{"groupVersion": "v1", "resources": [
+		{"name": "pods", "namespaced": true, "kind": "Pod", "verbs": ["get", "list", "watch"]},
+		{"name": "pods/log", "namespaced": true, "kind": "Pod", "verbs": ["get"]},
+		{"name": "bindings", "namespaced": true, "kind": "Binding", "verbs": ["create"]},
+		{"name": "nodes", "namespaced": false, "kind": "Node", "verbs": ["get", "list", "watch"]}
+	]}`,
+	"/apis/apps/v1": `{"groupVersion": "apps/v1", "resources": [
+		{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["get", "list", "watch"]}
+	]}`,
+	"/apis/apps/v1beta2": `{"groupVersion": "apps/v1beta2", "resources": [
+		{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["get", "list", "watch"]},
+		{"name": "legacies", "namespaced": true, "kind": "Legacy", "verbs": ["get", "list", "watch"]}
+	]}`,
+	"/apis/extensions/v1beta1": `{"groupVersion": "extensions/v1beta1", "resources": [
+		{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["get", "list", "watch"]},
+		{"name": "ingresses", "namespaced": true, "kind": "Ingress", "verbs": ["get", "list", "watch"]}
+	]}`,
+	"/apis/networking.k8s.io/v1": `{"groupVersion": "networking.k8s.io/v1", "resources": [
+		{"name": "ingresses", "namespaced": true, "kind": "Ingress", "verbs": ["get", "list", "watch"]},
+		{"name": "networkpolicies", "namespaced": true, "kind": "NetworkPolicy", "verbs": ["get", "list", "watch"]}
+	]}`,
+}
+
+func newDiscoveryServer() (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		response, ok := discoveryResponses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	return server, &requests
+}
+
+func TestResolveResource(t *testing.T) {
+	server, requests := newDiscoveryServer()
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+
+	tests := []struct {
+		name     string
+		expected GroupVersionResource
+		path     string
+	}{
+		{"pods", GroupVersionResource{"", "v1", "pods"}, "/api/v1/pods"},
+		{"Pod", GroupVersionResource{"", "v1", "pods"}, "/api/v1/pods"},
+		{"pods.v1", GroupVersionResource{"", "v1", "pods"}, "/api/v1/pods"},
+		{"deployments", GroupVersionResource{"apps", "v1", "deployments"}, "/apis/apps/v1/deployments"},
+		{"deployments.apps", GroupVersionResource{"apps", "v1", "deployments"}, "/apis/apps/v1/deployments"},
+		{"deployments.v1beta2.apps", GroupVersionResource{"apps", "v1beta2", "deployments"}, "/apis/apps/v1beta2/deployments"},
+		{"deployments.extensions", GroupVersionResource{"extensions", "v1beta1", "deployments"}, "/apis/extensions/v1beta1/deployments"},
+		{"ingresses", GroupVersionResource{"extensions", "v1beta1", "ingresses"}, "/apis/extensions/v1beta1/ingresses"},
+		{"ingresses.v1.networking.k8s.io", GroupVersionResource{"networking.k8s.io", "v1", "ingresses"}, "/apis/networking.k8s.io/v1/ingresses"},
+		{"networkpolicies", GroupVersionResource{"networking.k8s.io", "v1", "networkpolicies"}, "/apis/networking.k8s.io/v1/networkpolicies"},
+		{"legacies", GroupVersionResource{"apps", "v1beta2", "legacies"}, "/apis/apps/v1beta2/legacies"},
+	}
+	for _, test := range tests {
+		gvr, _, err := client.Discovery.ResolveResource(context.Background(), test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if gvr != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, gvr)
+		}
+		if gvr.Path() != test.path {
+			t.Errorf("%s: expected path %s, got %s", test.name, test.path, gvr.Path())
+		}
+	}
+
+	for _, name := range []string{"widgets", "pods.v2", "deployments.batch", "log"} {
+		if _, _, err := client.Discovery.ResolveResource(context.Background(), name); !IsUnknownResource(err) {
+			t.Errorf("Expected %s to be unknown, got %v", name, err)
+		}
+	}
+
+	// One request for /api, /apis and each of the 5 group versions
+	if *requests != 7 {
+		t.Errorf("Expected discovery to be read once, got %d requests", *requests)
+	}
+}
+
+func TestResolveResourceVerbs(t *testing.T) {
+	server, _ := newDiscoveryServer()
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+
+	_, resource, err := client.Discovery.ResolveResource(context.Background(), "bindings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resource.HasVerb("watch") || !resource.Namespaced {
+		t.Errorf("Unexpected resource %+v", resource)
+	}
+}
+
+func TestResolveResourceSkipsUnavailableGroups(t *testing.T) {
+	var metricsUp int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apis":
+			w.Write([]byte(`{"kind": "APIGroupList", "groups": [
+				{"name": "apps", "versions": [{"groupVersion": "apps/v1", "version": "v1"}],
+				 "preferredVersion": {"groupVersion": "apps/v1", "version": "v1"}},
+				{"name": "metrics.k8s.io", "versions": [{"groupVersion": "metrics.k8s.io/v1beta1", "version": "v1beta1"}],
+				 "preferredVersion": {"groupVersion": "metrics.k8s.io/v1beta1", "version": "v1beta1"}}
+			]}`))
+		case "/apis/metrics.k8s.io/v1beta1":
+			if atomic.LoadInt32(&metricsUp) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"groupVersion": "metrics.k8s.io/v1beta1", "resources": [
+				{"name": "pods", "namespaced": true, "kind": "PodMetrics", "verbs": ["get", "list"]}
+			]}`))
+		default:
+			if response, ok := discoveryResponses[r.URL.Path]; ok {
+				w.Write([]byte(response))
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{})
+
+	gvr, _, err := client.Discovery.ResolveResource(context.Background(), "deployments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvr != (GroupVersionResource{"apps", "v1", "deployments"}) {
+		t.Errorf("Unexpected resource %+v", gvr)
+	}
+
+	_, _, err = client.Discovery.ResolveResource(context.Background(), "pods.metrics.k8s.io")
+	if err == nil || !strings.Contains(err.Error(), "metrics.k8s.io/v1beta1") || IsUnknownResource(err) {
+		t.Errorf("Expected the unavailable group version to be reported, got %v", err)
+	}
+
+	atomic.StoreInt32(&metricsUp, 1)
+	gvr, _, err = client.Discovery.ResolveResource(context.Background(), "pods.metrics.k8s.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvr != (GroupVersionResource{"metrics.k8s.io", "v1beta1", "pods"}) {
+		t.Errorf("Unexpected resource %+v", gvr)
+	}
+}
+
+func TestGroupVersionResourcePaths(t *testing.T) {
+	gvr := GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	if path := gvr.NamespacedPath("default"); path != "/apis/apps/v1/namespaces/default/deployments" {
+		t.Errorf("Unexpected path %s", path)
+	}
+	gvr = GroupVersionResource{Version: "v1", Resource: "services"}
+	if path := gvr.NamespacedPath("default"); path != "/api/v1/namespaces/default/services" {
+		t.Errorf("Unexpected path %s", path)
+	}
+	if gvr.String() != "services.v1" {
+		t.Errorf("Unexpected string %s", gvr)
+	}
+}
@@ -0,0 +1,165 @@
+package kubernetesclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ResourceOperations works on any resource, including custom resources, as
+// unstructured objects.
+type ResourceOperations interface {
+	Namespace(namespace string) ResourceOperations
+	// GetNamespace returns the namespace set by Namespace, empty for all
+	GetNamespace() string
+	GroupVersionResource() GroupVersionResource
+	Get(name string) (*Unstructured, error)
+	GetContext(ctx context.Context, name string) (*Unstructured, error)
+	List(opts ListOptions) (*UnstructuredList, error)
+	ListContext(ctx context.Context, opts ListOptions) (*UnstructuredList, error)
+	Watch(opts ListOptions) (*Watcher, error)
+	WatchContext(ctx context.Context, opts ListOptions) (*Watcher, error)
+	Create(resource *Unstructured) (*Unstructured, error)
+	CreateContext(ctx context.Context, resource *Unstructured) (*Unstructured, error)
+	Update(resource *Unstructured) (*Unstructured, error)
+	UpdateContext(ctx context.Context, resource *Unstructured) (*Unstructured, error)
+	Patch(name string, patchType PatchType, patch []byte) (*Unstructured, error)
+	PatchContext(ctx context.Context, name string, patchType PatchType, patch []byte) (*Unstructured, error)
+	Delete(name string) (*Unstructured, error)
+	DeleteContext(ctx context.Context, name string) (*Unstructured, error)
+}
+
+// Resource returns a client for the resource, across all namespaces until
+// Namespace narrows it down. Use Discovery to find the GroupVersionResource
+// of a kind.
+func (c *Client) Resource(resource GroupVersionResource) ResourceOperations {
+	return &ResourceClient{
+		client:   c,
+		resource: resource,
+	}
+}
+
+type ResourceClient struct {
+	client    *Client
+	resource  GroupVersionResource
+	namespace string
+}
+
+func (c *ResourceClient) Namespace(namespace string) ResourceOperations {
+	return &ResourceClient{
+		client:    c.client,
+		resource:  c.resource,
+		namespace: namespace,
+	}
+}
+
+func (c *ResourceClient) GetNamespace() string {
+	return c.namespace
+}
+
+func (c *ResourceClient) GroupVersionResource() GroupVersionResource {
+	return c.resource
+}
+
+func (c *ResourceClient) collectionPath(namespace string) string {
+	if namespace == "" {
+		return c.resource.Path()
+	}
+	return c.resource.NamespacedPath(namespace)
+}
+
+func (c *ResourceClient) namePath(namespace string, name string) string {
+	return c.collectionPath(namespace) + "/" + name
+}
+
+// objectNamespace prefers the namespace of the client over the one set on
+// the object.
+func (c *ResourceClient) objectNamespace(resource *Unstructured) string {
+	if c.namespace != "" {
+		return c.namespace
+	}
+	return resource.GetNamespace()
+}
+
+func (c *ResourceClient) Get(name string) (*Unstructured, error) {
+	return c.GetContext(context.Background(), name)
+}
+
+func (c *ResourceClient) GetContext(ctx context.Context, name string) (*Unstructured, error) {
+	resp := &Unstructured{}
+	err := c.client.doGet(ctx, c.namePath(c.namespace, name), resp)
+	return resp, err
+}
+
+func (c *ResourceClient) List(opts ListOptions) (*UnstructuredList, error) {
+	return c.ListContext(context.Background(), opts)
+}
+
+func (c *ResourceClient) ListContext(ctx context.Context, opts ListOptions) (*UnstructuredList, error) {
+	list := &UnstructuredList{}
+	err := c.client.doList(ctx, c.collectionPath(c.namespace), opts, func(page []byte) error {
+		pageList := &UnstructuredList{}
+		if err := json.Unmarshal(page, pageList); err != nil {
+			return err
+		}
+		pageList.Items = append(list.Items, pageList.Items...)
+		*list = *pageList
+		return nil
+	})
+	return list, err
+}
+
+func (c *ResourceClient) Watch(opts ListOptions) (*Watcher, error) {
+	return c.WatchContext(context.Background(), opts)
+}
+
+// WatchContext opens a watch that ends when ctx is done.
+func (c *ResourceClient) WatchContext(ctx context.Context, opts ListOptions) (*Watcher, error) {
+	return c.client.watch(ctx, c.collectionPath(c.namespace), opts)
+}
+
+func (c *ResourceClient) Create(resource *Unstructured) (*Unstructured, error) {
+	return c.CreateContext(context.Background(), resource)
+}
+
+func (c *ResourceClient) CreateContext(ctx context.Context, resource *Unstructured) (*Unstructured, error) {
+	resp := &Unstructured{}
+	err := c.client.doPost(ctx, c.collectionPath(c.objectNamespace(resource)), resource, resp)
+	return resp, err
+}
+
+func (c *ResourceClient) Update(resource *Unstructured) (*Unstructured, error) {
+	return c.UpdateContext(context.Background(), resource)
+}
+
+func (c *ResourceClient) UpdateContext(ctx context.Context, resource *Unstructured) (*Unstructured, error) {
+	name := resource.GetName()
+	if name == "" {
+		return nil, fmt.Errorf("Can't update a %s without a name", c.resource.Resource)
+	}
+	resp := &Unstructured{}
+	err := c.client.doPut(ctx, c.namePath(c.objectNamespace(resource), name), resource, resp)
+	return resp, err
+}
+
+func (c *ResourceClient) Patch(name string, patchType PatchType, patch []byte) (*Unstructured, error) {
+	return c.PatchContext(context.Background(), name, patchType, patch)
+}
+
+func (c *ResourceClient) PatchContext(ctx context.Context, name string, patchType PatchType, patch []byte) (*Unstructured, error) {
+	resp := &Unstructured{}
+	err := c.client.doPatch(ctx, c.namePath(c.namespace, name), patchType, patch, resp)
+	return resp, err
+}
+
+// Delete returns the deleted object, or the Status the API server sent in
+// its place.
+func (c *ResourceClient) Delete(name string) (*Unstructured, error) {
+	return c.DeleteContext(context.Background(), name)
+}
+
+func (c *ResourceClient) DeleteContext(ctx context.Context, name string) (*Unstructured, error) {
+	resp := &Unstructured{}
+	err := c.client.doDelete(ctx, c.namePath(c.namespace, name), resp)
+	return resp, err
+}
@@ -0,0 +1,163 @@
+package kubernetesclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var certificates = GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+const certificate = `{
+  "apiVersion": "cert-manager.io/v1",
+  "kind": "Certificate",
+  "metadata": {"name": "web", "namespace": "default", "resourceVersion": "10"},
+  "spec": {"secretName": "web-tls", "dnsNames": ["example.com"], "duration": "2160h"}
+}`
+
+type recordedRequest struct {
+	method      string
+	path        string
+	query       string
+	contentType string
+	body        string
+}
+
+func newResourceServer(t *testing.T, requests *[]recordedRequest) *httptest.Server {
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "ADDED", "object": `+certificate+`}`))
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "ERROR", "object": {"kind": "Status", "code": 410, "reason": "Expired"}}`))
+			// Hold the connection open until the client goes away
+			conn.ReadMessage()
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		*requests = append(*requests, recordedRequest{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"), string(body)})
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/apis/cert-manager.io/v1/certificates":
+			w.Write([]byte(`{"kind": "CertificateList", "metadata": {"resourceVersion": "12"}, "items": [` + certificate + `]}`))
+		case len(body) > 0:
+			w.Write(body)
+		default:
+			w.Write([]byte(certificate))
+		}
+	}))
+}
+
+func TestResourceClient(t *testing.T) {
+	var requests []recordedRequest
+	server := newResourceServer(t, &requests)
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+	certs := client.Resource(certificates)
+
+	list, err := certs.List(ListOptions{LabelSelector: "app=web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].GetName() != "web" || list.GetResourceVersion() != "12" {
+		t.Errorf("Unexpected list %+v", list)
+	}
+
+	cert, err := certs.Namespace("default").Get("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretName := NestedString(cert.Object, "spec", "secretName"); secretName != "web-tls" {
+		t.Errorf("Unexpected secret name %s", secretName)
+	}
+
+	if _, err := certs.Create(cert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certs.Update(cert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certs.Namespace("default").Patch("web", MergePatchType, []byte(`{"spec": {"duration": "720h"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certs.Namespace("default").Delete("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []recordedRequest{
+		{"GET", "/apis/cert-manager.io/v1/certificates", "labelSelector=app%3Dweb", "", ""},
+		{"GET", "/apis/cert-manager.io/v1/namespaces/default/certificates/web", "", "", ""},
+		{"POST", "/apis/cert-manager.io/v1/namespaces/default/certificates", "", "application/json", ""},
+		{"PUT", "/apis/cert-manager.io/v1/namespaces/default/certificates/web", "", "application/json", ""},
+		{"PATCH", "/apis/cert-manager.io/v1/namespaces/default/certificates/web", "", string(MergePatchType), `{"spec": {"duration": "720h"}}`},
+		{"DELETE", "/apis/cert-manager.io/v1/namespaces/default/certificates/web", "", "", ""},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected %d requests, got %+v", len(expected), requests)
+	}
+	for i, e := range expected {
+		r := requests[i]
+		if r.method != e.method || r.path != e.path || r.query != e.query || r.contentType != e.contentType {
+			t.Errorf("Expected request %+v, got %+v", e, r)
+		}
+		if e.body != "" && r.body != e.body {
+			t.Errorf("Expected body %s, got %s", e.body, r.body)
+		}
+	}
+
+	// Unknown fields of the custom resource are sent back unchanged
+	written := decodeForComparison(t, []byte(requests[3].body))
+	if !reflect.DeepEqual(written, decodeForComparison(t, []byte(certificate))) {
+		t.Errorf("Unexpected object written back: %s", requests[3].body)
+	}
+}
+
+func TestResourceWatch(t *testing.T) {
+	var requests []recordedRequest
+	server := newResourceServer(t, &requests)
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher, err := client.Resource(certificates).WatchContext(ctx, ListOptions{ResourceVersion: "12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-watcher.ResultChan()
+	if event.Type != EventAdded || event.Object.GetName() != "web" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	event = <-watcher.ResultChan()
+	if event.Type != EventError || NestedString(event.Object.Object, "reason") != StatusReasonExpired {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-watcher.ResultChan():
+		if ok {
+			t.Error("Expected the result channel to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch didn't stop when the context was cancelled")
+	}
+	if err := watcher.Err(); err != nil {
+		t.Errorf("Expected no error after stopping, got %v", err)
+	}
+}
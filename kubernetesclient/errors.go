@@ -0,0 +1,162 @@
+package kubernetesclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rancher/kubernetes-model/model"
+)
+
+// Reasons the API server gives in a Status object
+const (
+	StatusReasonNotFound        = "NotFound"
+	StatusReasonAlreadyExists   = "AlreadyExists"
+	StatusReasonConflict        = "Conflict"
+	StatusReasonGone            = "Gone"
+	StatusReasonExpired         = "Expired"
+	StatusReasonForbidden       = "Forbidden"
+	StatusReasonTooManyRequests = "TooManyRequests"
+	StatusReasonServerTimeout   = "ServerTimeout"
+)
+
+type ApiError struct {
+	StatusCode int
+	Url        string
+	Msg        string
+	Status     string
+	Body       string
+
+	// Decoded from the Status object in the response body, when there is one
+	Reason            string
+	Message           string
+	Details           *model.StatusDetails
+	RetryAfterSeconds int
+}
+
+func (e ApiError) Error() string {
+	return e.Msg
+}
+
+func newApiError(resp *http.Response, url string, contents []byte) *ApiError {
+	body := string(contents)
+	formattedMsg := fmt.Sprintf("Bad response from [%s], statusCode [%d]. Status [%s]. Body: [%s]",
+		url, resp.StatusCode, resp.Status, body)
+	apiError := &ApiError{
+		Url:        url,
+		Msg:        formattedMsg,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+	}
+
+	status := &model.Status{}
+	if json.Unmarshal(contents, status) == nil && status.Kind == "Status" {
+		apiError.setStatus(status)
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && apiError.RetryAfterSeconds == 0 {
+		apiError.RetryAfterSeconds = seconds
+	}
+	return apiError
+}
+
+// NewApiErrorFromStatus turns a Status object, such as the one carried by a
+// watch ERROR event, into an error.
+func NewApiErrorFromStatus(status *model.Status) *ApiError {
+	apiError := &ApiError{
+		StatusCode: int(status.Code),
+		Msg:        fmt.Sprintf("Status [%s] with code [%d]. Reason [%s]. Message: [%s]", status.Status, status.Code, status.Reason, status.Message),
+		Status:     status.Status,
+	}
+	apiError.setStatus(status)
+	return apiError
+}
+
+func (e *ApiError) setStatus(status *model.Status) {
+	e.Reason = status.Reason
+	e.Message = status.Message
+	e.Details = status.Details
+	if status.Details != nil {
+		e.RetryAfterSeconds = int(status.Details.RetryAfterSeconds)
+	}
+}
+
+// Causes returns the individual problems the API server reported, if any.
+func (e *ApiError) Causes() []model.StatusCause {
+	if e.Details == nil {
+		return nil
+	}
+	return e.Details.Causes
+}
+
+type causer interface {
+	Cause() error
+}
+
+// asApiError finds an ApiError in err, looking through errors wrapped with
+// github.com/pkg/errors.
+func asApiError(err error) (*ApiError, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *ApiError:
+			return e, e != nil
+		case ApiError:
+			return &e, true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			return nil, false
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
+
+// hasReason matches the reason given by the API server, falling back to the
+// HTTP status code when the response had no Status body.
+func hasReason(err error, code int, reasons ...string) bool {
+	apiError, ok := asApiError(err)
+	if !ok {
+		return false
+	}
+	if apiError.Reason == "" {
+		return code != 0 && apiError.StatusCode == code
+	}
+	for _, reason := range reasons {
+		if apiError.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func IsNotFound(err error) bool {
+	return hasReason(err, http.StatusNotFound, StatusReasonNotFound)
+}
+
+func IsAlreadyExists(err error) bool {
+	return hasReason(err, 0, StatusReasonAlreadyExists)
+}
+
+func IsConflict(err error) bool {
+	return hasReason(err, http.StatusConflict, StatusReasonConflict)
+}
+
+// IsGone is true when a watch or list asked for a resourceVersion that is no
+// longer available.
+func IsGone(err error) bool {
+	return hasReason(err, http.StatusGone, StatusReasonGone, StatusReasonExpired)
+}
+
+func IsForbidden(err error) bool {
+	return hasReason(err, http.StatusForbidden, StatusReasonForbidden)
+}
+
+func IsTooManyRequests(err error) bool {
+	return hasReason(err, http.StatusTooManyRequests, StatusReasonTooManyRequests)
+}
+
+func IsServerTimeout(err error) bool {
+	return hasReason(err, 0, StatusReasonServerTimeout)
+}
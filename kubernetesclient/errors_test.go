@@ -0,0 +1,80 @@
+package kubernetesclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestApiErrorDecodesStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{
+			"kind": "Status",
+			"apiVersion": "v1",
+			"status": "Failure",
+			"message": "Service \"test\" is invalid",
+			"reason": "Invalid",
+			"details": {
+				"name": "test",
+				"kind": "Service",
+				"causes": [{"reason": "FieldValueRequired", "message": "Required value", "field": "spec.ports"}],
+				"retryAfterSeconds": 3
+			},
+			"code": 422
+		}`))
+	}))
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+	_, err := client.Service.ByName("default", "test")
+
+	apiError, ok := err.(*ApiError)
+	if !ok {
+		t.Fatalf("Expected an ApiError, got %#v", err)
+	}
+	if apiError.Reason != "Invalid" || apiError.Message != `Service "test" is invalid` {
+		t.Errorf("Status was not decoded: %+v", apiError)
+	}
+	if causes := apiError.Causes(); len(causes) != 1 || causes[0].Field != "spec.ports" {
+		t.Errorf("Unexpected causes %+v", causes)
+	}
+	if apiError.RetryAfterSeconds != 3 {
+		t.Errorf("Unexpected retryAfterSeconds %d", apiError.RetryAfterSeconds)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		check func(error) bool
+		want  bool
+	}{
+		{"not found reason", &ApiError{StatusCode: 404, Reason: StatusReasonNotFound}, IsNotFound, true},
+		{"not found without status", &ApiError{StatusCode: 404}, IsNotFound, true},
+		{"not found wrapped", errors.Wrap(&ApiError{StatusCode: 404}, "lookup pod"), IsNotFound, true},
+		{"not found value", ApiError{StatusCode: 404}, IsNotFound, true},
+		{"other error", errors.New("connection refused"), IsNotFound, false},
+		{"nil", nil, IsNotFound, false},
+		{"conflict", &ApiError{StatusCode: 409, Reason: StatusReasonConflict}, IsConflict, true},
+		{"already exists is not a conflict", &ApiError{StatusCode: 409, Reason: StatusReasonAlreadyExists}, IsConflict, false},
+		{"already exists", &ApiError{StatusCode: 409, Reason: StatusReasonAlreadyExists}, IsAlreadyExists, true},
+		{"gone", &ApiError{StatusCode: 410, Reason: StatusReasonGone}, IsGone, true},
+		{"expired", &ApiError{StatusCode: 410, Reason: StatusReasonExpired}, IsGone, true},
+		{"gone without status", &ApiError{StatusCode: 410}, IsGone, true},
+		{"forbidden", &ApiError{StatusCode: 403, Reason: StatusReasonForbidden}, IsForbidden, true},
+		{"too many requests", &ApiError{StatusCode: 429}, IsTooManyRequests, true},
+		{"server timeout", &ApiError{StatusCode: 500, Reason: StatusReasonServerTimeout}, IsServerTimeout, true},
+		{"plain 500", &ApiError{StatusCode: 500}, IsServerTimeout, false},
+	}
+	for _, test := range tests {
+		if got := test.check(test.err); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
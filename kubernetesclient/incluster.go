@@ -0,0 +1,41 @@
+package kubernetesclient
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+var (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// InitInCluster loads the service account token and CA mounted into every
+// pod and returns the API server URL advertised through the service
+// environment variables. The token is re-read whenever it rotates on disk.
+func InitInCluster() (string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", errors.New("Unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+
+	token, err := newFileToken(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return "", err
+	}
+
+	caFile := filepath.Join(serviceAccountDir, "ca.crt")
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read CA cert %s: %v", caFile, err)
+	}
+
+	setCredentials(&credentials{
+		tokenFile: token,
+		caData:    caData,
+	})
+	return "https://" + net.JoinHostPort(host, port), nil
+}
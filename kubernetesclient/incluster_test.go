@@ -0,0 +1,66 @@
+package kubernetesclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInClusterTokenRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPEM, _ := generateTestCert(t, "ca")
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("token-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDir, oldInterval := serviceAccountDir, fileCheckInterval
+	serviceAccountDir, fileCheckInterval = dir, 0
+	defer func() {
+		serviceAccountDir, fileCheckInterval = oldDir, oldInterval
+	}()
+	os.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	os.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	defer os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	defer os.Unsetenv("KUBERNETES_SERVICE_PORT")
+
+	server, err := InitInCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "https://10.0.0.1:443" {
+		t.Errorf("Unexpected server %s", server)
+	}
+	if header := GetAuthorizationHeader(); header != "Bearer token-1" {
+		t.Errorf("Unexpected authorization header %s", header)
+	}
+	if GetTLSClientConfig().RootCAs == nil {
+		t.Error("Service account CA was not loaded")
+	}
+
+	if err := ioutil.WriteFile(tokenPath, []byte("token-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if header := GetAuthorizationHeader(); header != "Bearer token-2" {
+		t.Errorf("Rotated token was not picked up, got %s", header)
+	}
+
+	os.Remove(tokenPath)
+	if header := GetAuthorizationHeader(); header != "Bearer token-2" {
+		t.Errorf("Expected the last good token while the file is missing, got %s", header)
+	}
+}
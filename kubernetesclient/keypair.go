@@ -0,0 +1,79 @@
+package kubernetesclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fileKeyPair is a client certificate backed by files that are re-read when
+// they change on disk, for instance when Rancher re-issues the certificates.
+type fileKeyPair struct {
+	sync.Mutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	checked     time.Time
+}
+
+func newFileKeyPair(certFile, keyFile string) (*fileKeyPair, error) {
+	f := &fileKeyPair{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileKeyPair) reload() error {
+	certInfo, err := os.Stat(f.certFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read client certificate %s: %v", f.certFile, err)
+	}
+	keyInfo, err := os.Stat(f.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read client key %s: %v", f.keyFile, err)
+	}
+	f.checked = time.Now()
+	if f.certificate != nil && certInfo.ModTime().Equal(f.certModTime) && keyInfo.ModTime().Equal(f.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load client certificate %s: %v", f.certFile, err)
+	}
+	if f.certificate != nil {
+		log.Infof("Reloaded client certificate from %s", f.certFile)
+	}
+	f.certificate = &cert
+	f.certModTime = certInfo.ModTime()
+	f.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// Certificate returns the current certificate, picking up re-issued files
+// when needed. The last good certificate is kept while the pair is being
+// rewritten and doesn't match yet.
+func (f *fileKeyPair) Certificate() *tls.Certificate {
+	f.Lock()
+	defer f.Unlock()
+	if time.Since(f.checked) >= fileCheckInterval {
+		if err := f.reload(); err != nil {
+			log.Warnf("Keeping previous client certificate: %v", err)
+		}
+	}
+	return f.certificate
+}
+
+func (f *fileKeyPair) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return f.Certificate(), nil
+}
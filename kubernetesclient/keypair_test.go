@@ -0,0 +1,88 @@
+package kubernetesclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeyPair(t *testing.T, dir, commonName string, modTime time.Time) {
+	certPEM, keyPEM := generateTestCert(t, commonName)
+	for name, content := range map[string][]byte{"cert.pem": certPEM, "key.pem": keyPEM} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldInterval := fileCheckInterval
+	fileCheckInterval = 0
+	defer func() {
+		fileCheckInterval = oldInterval
+	}()
+
+	writeKeyPair(t, dir, "first", time.Now())
+	keyPair, err := newFileKeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caData := certificatePEM(server.Certificate())
+	setCredentials(&credentials{caData: caData, keyPair: keyPair})
+
+	if cn := clientCommonName(t, server.URL); cn != "first" {
+		t.Errorf("Expected the first certificate to be presented, got %s", cn)
+	}
+
+	writeKeyPair(t, dir, "second", time.Now().Add(time.Minute))
+	if cn := clientCommonName(t, server.URL); cn != "second" {
+		t.Errorf("Expected the re-issued certificate to be presented, got %s", cn)
+	}
+}
+
+func clientCommonName(t *testing.T, url string) string {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: GetTLSClientConfig(),
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func certificatePEM(cert *x509.Certificate) []byte {
+	return pemEncode("CERTIFICATE", cert.Raw)
+}
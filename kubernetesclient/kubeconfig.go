@@ -0,0 +1,265 @@
+package kubernetesclient
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Kubeconfig is the subset of the standard kubeconfig file format the agent
+// understands. Several files can be merged together, in which case the first
+// occurrence of a named cluster, user or context wins, just like kubectl.
+type Kubeconfig struct {
+	CurrentContext string          `yaml:"current-context"`
+	Clusters       []NamedCluster  `yaml:"clusters"`
+	AuthInfos      []NamedAuthInfo `yaml:"users"`
+	Contexts       []NamedContext  `yaml:"contexts"`
+}
+
+type NamedCluster struct {
+	Name    string  `yaml:"name"`
+	Cluster Cluster `yaml:"cluster"`
+}
+
+type Cluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type NamedAuthInfo struct {
+	Name     string   `yaml:"name"`
+	AuthInfo AuthInfo `yaml:"user"`
+}
+
+type AuthInfo struct {
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+}
+
+type NamedContext struct {
+	Name    string  `yaml:"name"`
+	Context Context `yaml:"context"`
+}
+
+type Context struct {
+	Cluster   string `yaml:"cluster"`
+	AuthInfo  string `yaml:"user"`
+	Namespace string `yaml:"namespace"`
+}
+
+// LoadKubeconfig reads one or more kubeconfig files. The path may be a list
+// separated by the OS path list separator, as with the KUBECONFIG variable.
+// Relative file references inside each file are resolved against the
+// directory of that file.
+func LoadKubeconfig(path string) (*Kubeconfig, error) {
+	merged := &Kubeconfig{}
+	loaded := 0
+	for _, file := range filepath.SplitList(path) {
+		if file == "" {
+			continue
+		}
+		kc, err := loadKubeconfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = kc.CurrentContext
+		}
+		merged.Clusters = append(merged.Clusters, kc.Clusters...)
+		merged.AuthInfos = append(merged.AuthInfos, kc.AuthInfos...)
+		merged.Contexts = append(merged.Contexts, kc.Contexts...)
+		loaded++
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("No kubeconfig file given in [%s]", path)
+	}
+	return merged, nil
+}
+
+func loadKubeconfigFile(file string) (*Kubeconfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read kubeconfig %s: %v", file, err)
+	}
+	kc := &Kubeconfig{}
+	if err := yaml.Unmarshal(content, kc); err != nil {
+		return nil, fmt.Errorf("Failed to parse kubeconfig %s: %v", file, err)
+	}
+
+	dir := filepath.Dir(file)
+	for i := range kc.Clusters {
+		c := &kc.Clusters[i].Cluster
+		c.CertificateAuthority = resolvePath(dir, c.CertificateAuthority)
+	}
+	for i := range kc.AuthInfos {
+		a := &kc.AuthInfos[i].AuthInfo
+		a.ClientCertificate = resolvePath(dir, a.ClientCertificate)
+		a.ClientKey = resolvePath(dir, a.ClientKey)
+		a.TokenFile = resolvePath(dir, a.TokenFile)
+	}
+	return kc, nil
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func (k *Kubeconfig) context(name string) (*Context, error) {
+	if name == "" {
+		name = k.CurrentContext
+	}
+	if name == "" {
+		return nil, fmt.Errorf("No context specified and kubeconfig has no current-context")
+	}
+	for _, c := range k.Contexts {
+		if c.Name == name {
+			return &c.Context, nil
+		}
+	}
+	return nil, fmt.Errorf("Context [%s] not found in kubeconfig", name)
+}
+
+func (k *Kubeconfig) cluster(name string) (*Cluster, error) {
+	for _, c := range k.Clusters {
+		if c.Name == name {
+			return &c.Cluster, nil
+		}
+	}
+	return nil, fmt.Errorf("Cluster [%s] not found in kubeconfig", name)
+}
+
+func (k *Kubeconfig) authInfo(name string) (*AuthInfo, error) {
+	for _, a := range k.AuthInfos {
+		if a.Name == name {
+			return &a.AuthInfo, nil
+		}
+	}
+	return nil, fmt.Errorf("User [%s] not found in kubeconfig", name)
+}
+
+// InitFromKubeconfig loads the credentials of the given context, or the
+// current context if none is given, and returns the API server URL of its
+// cluster.
+func InitFromKubeconfig(path string, contextName string) (string, error) {
+	kc, err := LoadKubeconfig(path)
+	if err != nil {
+		return "", err
+	}
+	c, err := kc.credentials(contextName)
+	if err != nil {
+		return "", err
+	}
+	server, err := kc.server(contextName)
+	if err != nil {
+		return "", err
+	}
+	setCredentials(c)
+	return server, nil
+}
+
+func (k *Kubeconfig) server(contextName string) (string, error) {
+	ctx, err := k.context(contextName)
+	if err != nil {
+		return "", err
+	}
+	cluster, err := k.cluster(ctx.Cluster)
+	if err != nil {
+		return "", err
+	}
+	if cluster.Server == "" {
+		return "", fmt.Errorf("Cluster [%s] has no server", ctx.Cluster)
+	}
+	return strings.TrimSuffix(cluster.Server, "/"), nil
+}
+
+func (k *Kubeconfig) credentials(contextName string) (*credentials, error) {
+	ctx, err := k.context(contextName)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := k.cluster(ctx.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &credentials{
+		insecure: cluster.InsecureSkipTLSVerify,
+	}
+	c.caData, err = fileOrData(cluster.CertificateAuthority, cluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load CA for cluster [%s]: %v", ctx.Cluster, err)
+	}
+
+	if ctx.AuthInfo == "" {
+		return c, nil
+	}
+	authInfo, err := k.authInfo(ctx.AuthInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	c.token = authInfo.Token
+	if c.token == "" && authInfo.TokenFile != "" {
+		c.tokenFile, err = newFileToken(authInfo.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.username = authInfo.Username
+	c.password = authInfo.Password
+
+	if authInfo.ClientCertificateData == "" && authInfo.ClientKeyData == "" &&
+		authInfo.ClientCertificate != "" && authInfo.ClientKey != "" {
+		c.keyPair, err = newFileKeyPair(authInfo.ClientCertificate, authInfo.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	certData, err := fileOrData(authInfo.ClientCertificate, authInfo.ClientCertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load client certificate for user [%s]: %v", ctx.AuthInfo, err)
+	}
+	keyData, err := fileOrData(authInfo.ClientKey, authInfo.ClientKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load client key for user [%s]: %v", ctx.AuthInfo, err)
+	}
+	if len(certData) > 0 || len(keyData) > 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client certificate for user [%s]: %v", ctx.AuthInfo, err)
+		}
+		c.certificate = &cert
+	}
+
+	return c, nil
+}
+
+// fileOrData returns the decoded inline data if present, otherwise the
+// contents of the referenced file.
+func fileOrData(file string, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
@@ -0,0 +1,195 @@
+package kubernetesclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev-cluster
+  cluster:
+    server: https://dev.example.com:6443/
+    certificate-authority: ca.pem
+- name: prod-cluster
+  cluster:
+    server: https://prod.example.com
+    insecure-skip-tls-verify: true
+users:
+- name: dev-user
+  user:
+    token: dev-token
+- name: prod-user
+  user:
+    username: admin
+    password: secret
+- name: cert-user
+  user:
+    client-certificate-data: %CERT%
+    client-key-data: %KEY%
+contexts:
+- name: dev
+  context:
+    cluster: dev-cluster
+    user: dev-user
+- name: prod
+  context:
+    cluster: prod-cluster
+    user: prod-user
+- name: cert
+  context:
+    cluster: prod-cluster
+    user: cert-user
+`
+
+func writeTestKubeconfig(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := generateTestCert(t, "client")
+	content := testKubeconfig
+	content = strings.Replace(content, "%CERT%", base64.StdEncoding.EncodeToString(certPEM), -1)
+	content = strings.Replace(content, "%KEY%", base64.StdEncoding.EncodeToString(keyPEM), -1)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestKubeconfigCurrentContext(t *testing.T) {
+	dir := writeTestKubeconfig(t)
+	defer os.RemoveAll(dir)
+
+	server, err := InitFromKubeconfig(filepath.Join(dir, "config"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "https://dev.example.com:6443" {
+		t.Errorf("Unexpected server %s", server)
+	}
+	if header := GetAuthorizationHeader(); header != "Bearer dev-token" {
+		t.Errorf("Unexpected authorization header %s", header)
+	}
+	tlsConfig := GetTLSClientConfig()
+	if tlsConfig.RootCAs == nil {
+		t.Error("CA referenced relative to the kubeconfig was not loaded")
+	}
+	if tlsConfig.InsecureSkipVerify {
+		t.Error("Expected TLS verification to be enabled")
+	}
+}
+
+func TestKubeconfigContextSelection(t *testing.T) {
+	dir := writeTestKubeconfig(t)
+	defer os.RemoveAll(dir)
+
+	server, err := InitFromKubeconfig(filepath.Join(dir, "config"), "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "https://prod.example.com" {
+		t.Errorf("Unexpected server %s", server)
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	if header := GetAuthorizationHeader(); header != expected {
+		t.Errorf("Unexpected authorization header %s", header)
+	}
+	if !GetTLSClientConfig().InsecureSkipVerify {
+		t.Error("Expected insecure-skip-tls-verify to be honored")
+	}
+
+	if _, err := InitFromKubeconfig(filepath.Join(dir, "config"), "missing"); err == nil {
+		t.Error("Expected an error for an unknown context")
+	}
+}
+
+func TestKubeconfigClientCertificate(t *testing.T) {
+	dir := writeTestKubeconfig(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := InitFromKubeconfig(filepath.Join(dir, "config"), "cert"); err != nil {
+		t.Fatal(err)
+	}
+	if header := GetAuthorizationHeader(); header != "" {
+		t.Errorf("Expected no authorization header, got %s", header)
+	}
+	if len(GetTLSClientConfig().Certificates) != 1 {
+		t.Error("Expected the client certificate to be presented")
+	}
+}
+
+func TestKubeconfigMerge(t *testing.T) {
+	dir := writeTestKubeconfig(t)
+	defer os.RemoveAll(dir)
+
+	override := `
+current-context: prod
+clusters:
+- name: prod-cluster
+  cluster:
+    server: https://override.example.com
+`
+	overridePath := filepath.Join(dir, "override")
+	if err := ioutil.WriteFile(overridePath, []byte(override), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := overridePath + string(filepath.ListSeparator) + filepath.Join(dir, "config")
+	server, err := InitFromKubeconfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "https://override.example.com" {
+		t.Errorf("Expected the first file to win, got server %s", server)
+	}
+}
+
+func generateTestCert(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pemEncode("CERTIFICATE", der), pemEncode("EC PRIVATE KEY", keyDer)
+}
+
+func pemEncode(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
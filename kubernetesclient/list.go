@@ -0,0 +1,87 @@
+package kubernetesclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ListOptions narrows down and pages through list requests.
+type ListOptions struct {
+	LabelSelector string
+	FieldSelector string
+	// ResourceVersion only applies to the first page of a list.
+	ResourceVersion string
+	// Limit is the page size. When set, List follows continue tokens until
+	// the whole collection has been fetched.
+	Limit int64
+	// Continue resumes a list from a token handed out by an earlier request.
+	Continue string
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.LabelSelector != "" {
+		q.Set("labelSelector", o.LabelSelector)
+	}
+	if o.FieldSelector != "" {
+		q.Set("fieldSelector", o.FieldSelector)
+	}
+	// The continue token pins the version of the first page, and the API
+	// rejects it together with a resourceVersion
+	if o.ResourceVersion != "" && o.Continue == "" {
+		q.Set("resourceVersion", o.ResourceVersion)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.FormatInt(o.Limit, 10))
+	}
+	if o.Continue != "" {
+		q.Set("continue", o.Continue)
+	}
+	return q
+}
+
+type listContinuation struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+}
+
+// doList requests path with the given options and hands the raw body of each
+// page to onPage, following continue tokens while a limit is set.
+func (c *baseClient) doList(ctx context.Context, path string, opts ListOptions, onPage func([]byte) error) error {
+	for {
+		pagePath := path
+		if q := opts.query().Encode(); q != "" {
+			pagePath = pagePath + "?" + q
+		}
+
+		var page json.RawMessage
+		if err := c.doGet(ctx, pagePath, &page); err != nil {
+			return err
+		}
+		if err := onPage(page); err != nil {
+			return err
+		}
+
+		var next listContinuation
+		if err := json.Unmarshal(page, &next); err != nil {
+			return err
+		}
+		if opts.Limit <= 0 || next.Metadata.Continue == "" {
+			return nil
+		}
+		opts.Continue = next.Metadata.Continue
+	}
+}
+
+// namespacedPath returns the path for a namespaced collection, or the
+// collection across all namespaces when namespace is empty.
+func namespacedPath(allNamespacesPath string, namespacePath string, namespace string) string {
+	if namespace == "" {
+		return allNamespacesPath
+	}
+	return fmt.Sprintf(namespacePath, namespace)
+}
@@ -0,0 +1,84 @@
+package kubernetesclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rancher/kubernetes-model/model"
+)
+
+func TestListFollowsContinueTokens(t *testing.T) {
+	pages := map[string][]string{
+		"":       {"a", "b"},
+		"page-2": {"c", "d"},
+		"page-3": {"e"},
+	}
+	next := map[string]string{
+		"":       "page-2",
+		"page-2": "page-3",
+	}
+	var queries []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/services" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		q := r.URL.Query()
+		queries = append(queries, r.URL.RawQuery)
+		if q.Get("labelSelector") != "app=web" || q.Get("limit") != "2" {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+		}
+
+		token := q.Get("continue")
+		if rv := q.Get("resourceVersion"); (token == "") != (rv == "0") {
+			t.Errorf("Expected resourceVersion only on the first page, got %s", r.URL.RawQuery)
+		}
+		list := map[string]interface{}{
+			"kind":     "ServiceList",
+			"metadata": map[string]interface{}{"resourceVersion": "42", "continue": next[token]},
+		}
+		items := []interface{}{}
+		for _, name := range pages[token] {
+			items = append(items, map[string]interface{}{"metadata": map[string]interface{}{"name": name}})
+		}
+		list["items"] = items
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+	list, err := client.Service.List("default", ListOptions{LabelSelector: "app=web", Limit: 2, ResourceVersion: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queries) != 3 {
+		t.Errorf("Expected 3 page requests, got %v", queries)
+	}
+	if names := serviceNames(list); names != "abcde" {
+		t.Errorf("Expected all pages to be merged in order, got %s", names)
+	}
+	if list.Metadata.ResourceVersion != "42" {
+		t.Errorf("Unexpected resourceVersion %s", list.Metadata.ResourceVersion)
+	}
+
+	queries = nil
+	list, err = client.Service.List("default", ListOptions{LabelSelector: "app=web", Limit: 2, Continue: "page-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := serviceNames(list); names != "e" || len(queries) != 1 {
+		t.Errorf("Expected to resume from the continue token, got %s", names)
+	}
+}
+
+func serviceNames(list *model.ServiceList) string {
+	names := ""
+	for _, svc := range list.Items {
+		names += svc.Metadata.Name
+	}
+	return names
+}
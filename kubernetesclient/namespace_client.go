@@ -1,19 +1,32 @@
 package kubernetesclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/rancher/kubernetes-model/model"
 )
 
+var NamespaceResource = GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
 const NamespacePath string = "/api/v1/namespaces/"
 const NamespaceByNamePath string = "/api/v1/namespaces/%s"
 
 type NamespaceOperations interface {
 	ByName(name string) (*model.Namespace, error)
+	ByNameContext(ctx context.Context, name string) (*model.Namespace, error)
+	List(opts ListOptions) (*model.NamespaceList, error)
+	ListContext(ctx context.Context, opts ListOptions) (*model.NamespaceList, error)
 	CreateNamespace(resource *model.Namespace) (*model.Namespace, error)
+	CreateNamespaceContext(ctx context.Context, resource *model.Namespace) (*model.Namespace, error)
 	ReplaceNamespace(namespace string, resource *model.Namespace) (*model.Namespace, error)
+	ReplaceNamespaceContext(ctx context.Context, namespace string, resource *model.Namespace) (*model.Namespace, error)
+	PatchNamespace(name string, patchType PatchType, patch []byte) (*model.Namespace, error)
+	PatchNamespaceContext(ctx context.Context, name string, patchType PatchType, patch []byte) (*model.Namespace, error)
 	DeleteNamespace(namespace string) (*model.Status, error)
+	DeleteNamespaceContext(ctx context.Context, namespace string) (*model.Status, error)
 }
 
 func newNamespaceClient(client *Client) *NamespaceClient {
@@ -27,28 +40,74 @@ type NamespaceClient struct {
 }
 
 func (c *NamespaceClient) ByName(name string) (*model.Namespace, error) {
+	return c.ByNameContext(context.Background(), name)
+}
+
+func (c *NamespaceClient) ByNameContext(ctx context.Context, name string) (*model.Namespace, error) {
 	resp := &model.Namespace{}
 	path := fmt.Sprintf(NamespaceByNamePath, name)
-	err := c.client.doGet(path, resp)
+	err := c.client.doGet(ctx, path, resp)
 	return resp, err
 }
 
+func (c *NamespaceClient) List(opts ListOptions) (*model.NamespaceList, error) {
+	return c.ListContext(context.Background(), opts)
+}
+
+func (c *NamespaceClient) ListContext(ctx context.Context, opts ListOptions) (*model.NamespaceList, error) {
+	list := &model.NamespaceList{}
+	path := strings.TrimSuffix(NamespacePath, "/")
+	err := c.client.doList(ctx, path, opts, func(page []byte) error {
+		pageList := &model.NamespaceList{}
+		if err := json.Unmarshal(page, pageList); err != nil {
+			return err
+		}
+		pageList.Items = append(list.Items, pageList.Items...)
+		*list = *pageList
+		return nil
+	})
+	return list, err
+}
+
 func (c *NamespaceClient) CreateNamespace(resource *model.Namespace) (*model.Namespace, error) {
+	return c.CreateNamespaceContext(context.Background(), resource)
+}
+
+func (c *NamespaceClient) CreateNamespaceContext(ctx context.Context, resource *model.Namespace) (*model.Namespace, error) {
 	resp := &model.Namespace{}
-	err := c.client.doPost(NamespacePath, resource, resp)
+	err := c.client.doPost(ctx, NamespacePath, resource, resp)
 	return resp, err
 }
 
 func (c *NamespaceClient) ReplaceNamespace(name string, resource *model.Namespace) (*model.Namespace, error) {
+	return c.ReplaceNamespaceContext(context.Background(), name, resource)
+}
+
+func (c *NamespaceClient) ReplaceNamespaceContext(ctx context.Context, name string, resource *model.Namespace) (*model.Namespace, error) {
+	resp := &model.Namespace{}
+	path := fmt.Sprintf(NamespaceByNamePath, name)
+	err := c.client.doPut(ctx, path, resource, resp)
+	return resp, err
+}
+
+func (c *NamespaceClient) PatchNamespace(name string, patchType PatchType, patch []byte) (*model.Namespace, error) {
+	return c.PatchNamespaceContext(context.Background(), name, patchType, patch)
+}
+
+func (c *NamespaceClient) PatchNamespaceContext(ctx context.Context, name string, patchType PatchType, patch []byte) (*model.Namespace, error) {
 	resp := &model.Namespace{}
 	path := fmt.Sprintf(NamespaceByNamePath, name)
-	err := c.client.doPut(path, resource, resp)
+	err := c.client.doPatch(ctx, path, patchType, patch, resp)
 	return resp, err
 }
 
 func (c *NamespaceClient) DeleteNamespace(name string) (*model.Status, error) {
+	return c.DeleteNamespaceContext(context.Background(), name)
+}
+
+func (c *NamespaceClient) DeleteNamespaceContext(ctx context.Context, name string) (*model.Status, error) {
 	status := &model.Status{}
 	path := fmt.Sprintf(NamespaceByNamePath, name)
-	err := c.client.doDelete(path, status)
+	err := c.client.doDelete(ctx, path, status)
 	return status, err
 }
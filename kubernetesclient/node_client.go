@@ -1,19 +1,33 @@
 package kubernetesclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/rancher/kubernetes-model/model"
 )
 
+var NodeResource = GroupVersionResource{Version: "v1", Resource: "nodes"}
+
 const NodePath string = "/api/v1/nodes"
 const NodeByNamePath string = "/api/v1/nodes/%s"
 
 type NodeOperations interface {
 	ByName(name string) (*model.Node, error)
+	ByNameContext(ctx context.Context, name string) (*model.Node, error)
+	List(opts ListOptions) (*model.NodeList, error)
+	ListContext(ctx context.Context, opts ListOptions) (*model.NodeList, error)
 	CreateNode(resource *model.Node) (*model.Node, error)
-	ReplaceNode(resource *model.Node) (*model.Node, error)
+	CreateNodeContext(ctx context.Context, resource *model.Node) (*model.Node, error)
+	ByNameUnstructured(name string) (*Unstructured, error)
+	ByNameUnstructuredContext(ctx context.Context, name string) (*Unstructured, error)
+	ReplaceNodeUnstructured(resource *Unstructured) (*Unstructured, error)
+	ReplaceNodeUnstructuredContext(ctx context.Context, resource *Unstructured) (*Unstructured, error)
+	PatchNode(name string, patchType PatchType, patch []byte) (*model.Node, error)
+	PatchNodeContext(ctx context.Context, name string, patchType PatchType, patch []byte) (*model.Node, error)
 	DeleteNode(name string) (*model.Status, error)
+	DeleteNodeContext(ctx context.Context, name string) (*model.Status, error)
 }
 
 func newNodeClient(client *Client) *NodeClient {
@@ -27,29 +41,90 @@ type NodeClient struct {
 }
 
 func (c *NodeClient) ByName(name string) (*model.Node, error) {
+	return c.ByNameContext(context.Background(), name)
+}
+
+func (c *NodeClient) ByNameContext(ctx context.Context, name string) (*model.Node, error) {
 	resp := &model.Node{}
 	path := fmt.Sprintf(NodeByNamePath, name)
-	err := c.client.doGet(path, resp)
+	err := c.client.doGet(ctx, path, resp)
 	return resp, err
 }
 
+func (c *NodeClient) ByNameUnstructured(name string) (*Unstructured, error) {
+	return c.ByNameUnstructuredContext(context.Background(), name)
+}
+
+func (c *NodeClient) ByNameUnstructuredContext(ctx context.Context, name string) (*Unstructured, error) {
+	resp := &Unstructured{}
+	path := fmt.Sprintf(NodeByNamePath, name)
+	err := c.client.doGet(ctx, path, resp)
+	return resp, err
+}
+
+func (c *NodeClient) List(opts ListOptions) (*model.NodeList, error) {
+	return c.ListContext(context.Background(), opts)
+}
+
+func (c *NodeClient) ListContext(ctx context.Context, opts ListOptions) (*model.NodeList, error) {
+	list := &model.NodeList{}
+	path := NodePath
+	err := c.client.doList(ctx, path, opts, func(page []byte) error {
+		pageList := &model.NodeList{}
+		if err := json.Unmarshal(page, pageList); err != nil {
+			return err
+		}
+		pageList.Items = append(list.Items, pageList.Items...)
+		*list = *pageList
+		return nil
+	})
+	return list, err
+}
+
 func (c *NodeClient) CreateNode(resource *model.Node) (*model.Node, error) {
+	return c.CreateNodeContext(context.Background(), resource)
+}
+
+func (c *NodeClient) CreateNodeContext(ctx context.Context, resource *model.Node) (*model.Node, error) {
 	resp := &model.Node{}
 	path := fmt.Sprintf(NodePath)
-	err := c.client.doPost(path, resource, resp)
+	err := c.client.doPost(ctx, path, resource, resp)
+	return resp, err
+}
+
+// ReplaceNodeUnstructured writes back a node read with ByNameUnstructured.
+// There is no typed replace, since writing back a model.Node drops the fields
+// the model doesn't know about. Prefer PatchNode when only some fields
+// change.
+func (c *NodeClient) ReplaceNodeUnstructured(resource *Unstructured) (*Unstructured, error) {
+	return c.ReplaceNodeUnstructuredContext(context.Background(), resource)
+}
+
+func (c *NodeClient) ReplaceNodeUnstructuredContext(ctx context.Context, resource *Unstructured) (*Unstructured, error) {
+	resp := &Unstructured{}
+	path := fmt.Sprintf(NodeByNamePath, resource.GetName())
+	err := c.client.doPut(ctx, path, resource, resp)
 	return resp, err
 }
 
-func (c *NodeClient) ReplaceNode(resource *model.Node) (*model.Node, error) {
+func (c *NodeClient) PatchNode(name string, patchType PatchType, patch []byte) (*model.Node, error) {
+	return c.PatchNodeContext(context.Background(), name, patchType, patch)
+}
+
+func (c *NodeClient) PatchNodeContext(ctx context.Context, name string, patchType PatchType, patch []byte) (*model.Node, error) {
 	resp := &model.Node{}
-	path := fmt.Sprintf(NodeByNamePath, resource.Metadata.Name)
-	err := c.client.doPut(path, resource, resp)
+	path := fmt.Sprintf(NodeByNamePath, name)
+	err := c.client.doPatch(ctx, path, patchType, patch, resp)
 	return resp, err
 }
 
 func (c *NodeClient) DeleteNode(name string) (*model.Status, error) {
+	return c.DeleteNodeContext(context.Background(), name)
+}
+
+func (c *NodeClient) DeleteNodeContext(ctx context.Context, name string) (*model.Status, error) {
 	status := &model.Status{}
 	path := fmt.Sprintf(NodeByNamePath, name)
-	err := c.client.doDelete(path, status)
+	err := c.client.doDelete(ctx, path, status)
 	return status, err
 }
@@ -0,0 +1,15 @@
+package kubernetesclient
+
+// PatchType is the content type that tells the API server how to apply a
+// patch.
+type PatchType string
+
+const (
+	// JSONPatchType is an RFC 6902 list of operations
+	JSONPatchType PatchType = "application/json-patch+json"
+	// MergePatchType is an RFC 7386 merge patch, where null deletes a field
+	MergePatchType PatchType = "application/merge-patch+json"
+	// StrategicMergePatchType is the kubernetes flavour of merge patch that
+	// merges lists by their patch merge key instead of replacing them
+	StrategicMergePatchType PatchType = "application/strategic-merge-patch+json"
+)
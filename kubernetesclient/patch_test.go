@@ -0,0 +1,45 @@
+package kubernetesclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPatchNode(t *testing.T) {
+	tests := []struct {
+		patchType PatchType
+		patch     string
+	}{
+		{MergePatchType, `{"metadata": {"labels": {"io.rancher.host.os": "linux", "stale": null}}}`},
+		{JSONPatchType, `[{"op": "add", "path": "/metadata/labels/io.rancher.host.os", "value": "linux"}, {"op": "remove", "path": "/metadata/labels/stale"}]`},
+		{StrategicMergePatchType, `{"spec": {"taints": [{"key": "dedicated", "effect": "NoSchedule"}]}}`},
+	}
+	for _, test := range tests {
+		var method, contentType, body string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/nodes/node-1" {
+				t.Errorf("Unexpected path %s", r.URL.Path)
+			}
+			data, _ := ioutil.ReadAll(r.Body)
+			method, contentType, body = r.Method, r.Header.Get("Content-Type"), string(data)
+			w.Write([]byte(`{"kind": "Node", "metadata": {"name": "node-1", "labels": {"io.rancher.host.os": "linux"}}}`))
+		}))
+
+		setCredentials(&credentials{})
+		client := NewClient(server.URL, false)
+		node, err := client.Node.PatchNode("node-1", test.patchType, []byte(test.patch))
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.patchType, err)
+		}
+
+		if method != http.MethodPatch || contentType != string(test.patchType) || body != test.patch {
+			t.Errorf("%s: unexpected request %s %s %s", test.patchType, method, contentType, body)
+		}
+		if node.Metadata.Name != "node-1" || node.Metadata.Labels["io.rancher.host.os"] != "linux" {
+			t.Errorf("%s: unexpected node %+v", test.patchType, node.Metadata)
+		}
+	}
+}
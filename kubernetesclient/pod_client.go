@@ -1,19 +1,30 @@
 package kubernetesclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/rancher/kubernetes-model/model"
 )
 
+const PodAllNamespacesPath string = "/api/v1/pods"
 const PodPath string = "/api/v1/namespaces/%s/pods"
 const PodByNamePath string = "/api/v1/namespaces/%s/pods/%s"
 
 type PodOperations interface {
 	ByName(namespace string, name string) (*model.Pod, error)
+	ByNameContext(ctx context.Context, namespace string, name string) (*model.Pod, error)
+	List(namespace string, opts ListOptions) (*model.PodList, error)
+	ListContext(ctx context.Context, namespace string, opts ListOptions) (*model.PodList, error)
 	CreatePod(namespace string, resource *model.Pod) (*model.Pod, error)
+	CreatePodContext(ctx context.Context, namespace string, resource *model.Pod) (*model.Pod, error)
 	ReplacePod(namespace string, resource *model.Pod) (*model.Pod, error)
+	ReplacePodContext(ctx context.Context, namespace string, resource *model.Pod) (*model.Pod, error)
+	PatchPod(namespace string, name string, patchType PatchType, patch []byte) (*model.Pod, error)
+	PatchPodContext(ctx context.Context, namespace string, name string, patchType PatchType, patch []byte) (*model.Pod, error)
 	DeletePod(namespace string, name string) (*model.Status, error)
+	DeletePodContext(ctx context.Context, namespace string, name string) (*model.Status, error)
 }
 
 func newPodClient(client *Client) *PodClient {
@@ -27,29 +38,77 @@ type PodClient struct {
 }
 
 func (c *PodClient) ByName(namespace string, name string) (*model.Pod, error) {
+	return c.ByNameContext(context.Background(), namespace, name)
+}
+
+func (c *PodClient) ByNameContext(ctx context.Context, namespace string, name string) (*model.Pod, error) {
 	resp := &model.Pod{}
 	path := fmt.Sprintf(PodByNamePath, namespace, name)
-	err := c.client.doGet(path, resp)
+	err := c.client.doGet(ctx, path, resp)
 	return resp, err
 }
 
+// List returns the pods in namespace, or in all namespaces when namespace
+// is empty.
+func (c *PodClient) List(namespace string, opts ListOptions) (*model.PodList, error) {
+	return c.ListContext(context.Background(), namespace, opts)
+}
+
+func (c *PodClient) ListContext(ctx context.Context, namespace string, opts ListOptions) (*model.PodList, error) {
+	list := &model.PodList{}
+	path := namespacedPath(PodAllNamespacesPath, PodPath, namespace)
+	err := c.client.doList(ctx, path, opts, func(page []byte) error {
+		pageList := &model.PodList{}
+		if err := json.Unmarshal(page, pageList); err != nil {
+			return err
+		}
+		pageList.Items = append(list.Items, pageList.Items...)
+		*list = *pageList
+		return nil
+	})
+	return list, err
+}
+
 func (c *PodClient) CreatePod(namespace string, resource *model.Pod) (*model.Pod, error) {
+	return c.CreatePodContext(context.Background(), namespace, resource)
+}
+
+func (c *PodClient) CreatePodContext(ctx context.Context, namespace string, resource *model.Pod) (*model.Pod, error) {
 	resp := &model.Pod{}
 	path := fmt.Sprintf(PodPath, namespace)
-	err := c.client.doPost(path, resource, resp)
+	err := c.client.doPost(ctx, path, resource, resp)
 	return resp, err
 }
 
 func (c *PodClient) ReplacePod(namespace string, resource *model.Pod) (*model.Pod, error) {
+	return c.ReplacePodContext(context.Background(), namespace, resource)
+}
+
+func (c *PodClient) ReplacePodContext(ctx context.Context, namespace string, resource *model.Pod) (*model.Pod, error) {
 	resp := &model.Pod{}
 	path := fmt.Sprintf(PodByNamePath, namespace, resource.Metadata.Name)
-	err := c.client.doPut(path, resource, resp)
+	err := c.client.doPut(ctx, path, resource, resp)
+	return resp, err
+}
+
+func (c *PodClient) PatchPod(namespace string, name string, patchType PatchType, patch []byte) (*model.Pod, error) {
+	return c.PatchPodContext(context.Background(), namespace, name, patchType, patch)
+}
+
+func (c *PodClient) PatchPodContext(ctx context.Context, namespace string, name string, patchType PatchType, patch []byte) (*model.Pod, error) {
+	resp := &model.Pod{}
+	path := fmt.Sprintf(PodByNamePath, namespace, name)
+	err := c.client.doPatch(ctx, path, patchType, patch, resp)
 	return resp, err
 }
 
 func (c *PodClient) DeletePod(namespace string, name string) (*model.Status, error) {
+	return c.DeletePodContext(context.Background(), namespace, name)
+}
+
+func (c *PodClient) DeletePodContext(ctx context.Context, namespace string, name string) (*model.Status, error) {
 	status := &model.Status{}
 	path := fmt.Sprintf(PodByNamePath, namespace, name)
-	err := c.client.doDelete(path, status)
+	err := c.client.doDelete(ctx, path, status)
 	return status, err
 }
@@ -0,0 +1,71 @@
+package kubernetesclient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst requests and refills at qps
+// tokens per second.
+type tokenBucket struct {
+	sync.Mutex
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil, meaning no limit, when qps isn't positive.
+func newTokenBucket(qps float64, burst int) *tokenBucket {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		qps:    qps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	if b == nil {
+		return ctx.Err()
+	}
+
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.qps
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	// Reserve a token, going into debt if there is none left
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.qps * float64(time.Second))
+	}
+	b.Unlock()
+
+	if delay == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand back the reservation
+		b.Lock()
+		b.tokens++
+		b.Unlock()
+		return ctx.Err()
+	}
+}
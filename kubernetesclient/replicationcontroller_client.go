@@ -1,19 +1,30 @@
 package kubernetesclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/rancher/kubernetes-model/model"
 )
 
+const ReplicationControllerAllNamespacesPath string = "/api/v1/replicationcontrollers"
 const ReplicationControllerPath string = "/api/v1/namespaces/%s/replicationcontrollers"
 const ReplicationControllerByNamePath string = "/api/v1/namespaces/%s/replicationcontrollers/%s"
 
 type ReplicationControllerOperations interface {
 	ByName(namespace string, name string) (*model.ReplicationController, error)
+	ByNameContext(ctx context.Context, namespace string, name string) (*model.ReplicationController, error)
+	List(namespace string, opts ListOptions) (*model.ReplicationControllerList, error)
+	ListContext(ctx context.Context, namespace string, opts ListOptions) (*model.ReplicationControllerList, error)
 	CreateReplicationController(namespace string, resource *model.ReplicationController) (*model.ReplicationController, error)
+	CreateReplicationControllerContext(ctx context.Context, namespace string, resource *model.ReplicationController) (*model.ReplicationController, error)
 	ReplaceReplicationController(namespace string, resource *model.ReplicationController) (*model.ReplicationController, error)
+	ReplaceReplicationControllerContext(ctx context.Context, namespace string, resource *model.ReplicationController) (*model.ReplicationController, error)
+	PatchReplicationController(namespace string, name string, patchType PatchType, patch []byte) (*model.ReplicationController, error)
+	PatchReplicationControllerContext(ctx context.Context, namespace string, name string, patchType PatchType, patch []byte) (*model.ReplicationController, error)
 	DeleteReplicationController(namespace string, name string) (*model.Status, error)
+	DeleteReplicationControllerContext(ctx context.Context, namespace string, name string) (*model.Status, error)
 }
 
 func newReplicationControllerClient(client *Client) *ReplicationControllerClient {
@@ -27,29 +38,77 @@ type ReplicationControllerClient struct {
 }
 
 func (c *ReplicationControllerClient) ByName(namespace string, name string) (*model.ReplicationController, error) {
+	return c.ByNameContext(context.Background(), namespace, name)
+}
+
+func (c *ReplicationControllerClient) ByNameContext(ctx context.Context, namespace string, name string) (*model.ReplicationController, error) {
 	resp := &model.ReplicationController{}
 	path := fmt.Sprintf(ReplicationControllerByNamePath, namespace, name)
-	err := c.client.doGet(path, resp)
+	err := c.client.doGet(ctx, path, resp)
 	return resp, err
 }
 
+// List returns the replicationcontrollers in namespace, or in all namespaces when namespace
+// is empty.
+func (c *ReplicationControllerClient) List(namespace string, opts ListOptions) (*model.ReplicationControllerList, error) {
+	return c.ListContext(context.Background(), namespace, opts)
+}
+
+func (c *ReplicationControllerClient) ListContext(ctx context.Context, namespace string, opts ListOptions) (*model.ReplicationControllerList, error) {
+	list := &model.ReplicationControllerList{}
+	path := namespacedPath(ReplicationControllerAllNamespacesPath, ReplicationControllerPath, namespace)
+	err := c.client.doList(ctx, path, opts, func(page []byte) error {
+		pageList := &model.ReplicationControllerList{}
+		if err := json.Unmarshal(page, pageList); err != nil {
+			return err
+		}
+		pageList.Items = append(list.Items, pageList.Items...)
+		*list = *pageList
+		return nil
+	})
+	return list, err
+}
+
 func (c *ReplicationControllerClient) CreateReplicationController(namespace string, resource *model.ReplicationController) (*model.ReplicationController, error) {
+	return c.CreateReplicationControllerContext(context.Background(), namespace, resource)
+}
+
+func (c *ReplicationControllerClient) CreateReplicationControllerContext(ctx context.Context, namespace string, resource *model.ReplicationController) (*model.ReplicationController, error) {
 	resp := &model.ReplicationController{}
 	path := fmt.Sprintf(ReplicationControllerPath, namespace)
-	err := c.client.doPost(path, resource, resp)
+	err := c.client.doPost(ctx, path, resource, resp)
 	return resp, err
 }
 
 func (c *ReplicationControllerClient) ReplaceReplicationController(namespace string, resource *model.ReplicationController) (*model.ReplicationController, error) {
+	return c.ReplaceReplicationControllerContext(context.Background(), namespace, resource)
+}
+
+func (c *ReplicationControllerClient) ReplaceReplicationControllerContext(ctx context.Context, namespace string, resource *model.ReplicationController) (*model.ReplicationController, error) {
 	resp := &model.ReplicationController{}
 	path := fmt.Sprintf(ReplicationControllerByNamePath, namespace, resource.Metadata.Name)
-	err := c.client.doPut(path, resource, resp)
+	err := c.client.doPut(ctx, path, resource, resp)
+	return resp, err
+}
+
+func (c *ReplicationControllerClient) PatchReplicationController(namespace string, name string, patchType PatchType, patch []byte) (*model.ReplicationController, error) {
+	return c.PatchReplicationControllerContext(context.Background(), namespace, name, patchType, patch)
+}
+
+func (c *ReplicationControllerClient) PatchReplicationControllerContext(ctx context.Context, namespace string, name string, patchType PatchType, patch []byte) (*model.ReplicationController, error) {
+	resp := &model.ReplicationController{}
+	path := fmt.Sprintf(ReplicationControllerByNamePath, namespace, name)
+	err := c.client.doPatch(ctx, path, patchType, patch, resp)
 	return resp, err
 }
 
 func (c *ReplicationControllerClient) DeleteReplicationController(namespace string, name string) (*model.Status, error) {
+	return c.DeleteReplicationControllerContext(context.Background(), namespace, name)
+}
+
+func (c *ReplicationControllerClient) DeleteReplicationControllerContext(ctx context.Context, namespace string, name string) (*model.Status, error) {
 	status := &model.Status{}
 	path := fmt.Sprintf(ReplicationControllerByNamePath, namespace, name)
-	err := c.client.doDelete(path, status)
+	err := c.client.doDelete(ctx, path, status)
 	return status, err
 }
@@ -0,0 +1,232 @@
+package kubernetesclient
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	retryBaseDelay     = 200 * time.Millisecond
+	retryMaxDelay      = 10 * time.Second
+	retryMaxRetryAfter = time.Minute
+)
+
+// clientStats publishes the request counts of all clients on /debug/vars of
+// the health check port.
+var clientStats = expvar.NewMap("kubernetesClient")
+
+// RequestStats counts the requests made by a client, so the agent can
+// observe how often the API server pushes back. CallStats counts the
+// attempts of a single call.
+type RequestStats struct {
+	// Requests is every attempt sent to the API server, including retries
+	Requests int64
+	// Retries is the number of attempts that were repeated
+	Retries int64
+	// Throttled is the number of 429 responses received
+	Throttled int64
+	// Failures is the number of requests that failed after all attempts
+	Failures int64
+	// RetriesByMethod breaks Retries down by HTTP method
+	RetriesByMethod map[string]int64
+}
+
+type requestStats struct {
+	sync.Mutex
+	stats RequestStats
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		stats: RequestStats{
+			RetriesByMethod: map[string]int64{},
+		},
+	}
+}
+
+func (s *requestStats) attempt(resp *http.Response) {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.Requests++
+	clientStats.Add("requests", 1)
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		s.stats.Throttled++
+		clientStats.Add("throttled", 1)
+	}
+}
+
+func (s *requestStats) retry(method string) {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.Retries++
+	s.stats.RetriesByMethod[method]++
+	clientStats.Add("retries", 1)
+	clientStats.Add("retries"+method, 1)
+}
+
+func (s *requestStats) failure() {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.Failures++
+	clientStats.Add("failures", 1)
+}
+
+func (s *requestStats) snapshot() RequestStats {
+	s.Lock()
+	defer s.Unlock()
+	snapshot := s.stats
+	snapshot.RetriesByMethod = make(map[string]int64, len(s.stats.RetriesByMethod))
+	for method, count := range s.stats.RetriesByMethod {
+		snapshot.RetriesByMethod[method] = count
+	}
+	return snapshot
+}
+
+// CallStats counts the attempts of the requests made with a context from
+// WithCallStats, so a caller can tell what one call cost, unlike the totals
+// of RequestStats.
+type CallStats struct {
+	sync.Mutex
+	attempts  int
+	retries   int
+	throttled int
+}
+
+type callStatsKey struct{}
+
+// WithCallStats returns a context whose requests are counted by the returned
+// CallStats. Requests made with a context derived from it are counted too.
+func WithCallStats(ctx context.Context) (context.Context, *CallStats) {
+	stats := &CallStats{}
+	return context.WithValue(ctx, callStatsKey{}, stats), stats
+}
+
+// callStatsFrom returns the CallStats of ctx, nil if it has none.
+func callStatsFrom(ctx context.Context) *CallStats {
+	stats, _ := ctx.Value(callStatsKey{}).(*CallStats)
+	return stats
+}
+
+// Attempts returns the number of attempts sent, including retries.
+func (s *CallStats) Attempts() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.attempts
+}
+
+// Retries returns the number of attempts that were repeated.
+func (s *CallStats) Retries() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.retries
+}
+
+// Throttled returns the number of 429 responses received.
+func (s *CallStats) Throttled() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.throttled
+}
+
+func (s *CallStats) attempt(resp *http.Response) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attempts++
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		s.throttled++
+	}
+}
+
+func (s *CallStats) retry() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.retries++
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryDelay decides whether a failed attempt should be repeated and how long
+// to wait before doing so. A 429 is safe to repeat for any method since the
+// API server rejected the request without acting on it.
+func retryDelay(method string, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	switch {
+	case err != nil:
+		if !isIdempotent(method) || !isConnectionReset(err) {
+			return 0, false
+		}
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		if !isIdempotent(method) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			delay := time.Duration(seconds) * time.Second
+			if delay > retryMaxRetryAfter {
+				delay = retryMaxRetryAfter
+			}
+			return delay, true
+		}
+	}
+	return backoff(attempt), true
+}
+
+// backoff doubles the delay with every attempt and picks a random point in
+// the upper half so that clients don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Backoff waits before repeating a failed attempt, for callers retrying on
+// their own, like after a conflict. It returns early with the context's error
+// when ctx is done.
+func Backoff(ctx context.Context, attempt int) error {
+	return sleep(ctx, backoff(attempt))
+}
+
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sleep waits for d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,203 @@
+package kubernetesclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newFlakyServer(failures int32, status int, header http.Header) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{"kind": "Node", "metadata": {"name": "node-1"}}`))
+	}))
+	return server, &calls
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+	server, calls := newFlakyServer(2, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{MaxRetries: 3})
+
+	node, err := client.Node.ByName("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Metadata.Name != "node-1" {
+		t.Errorf("Unexpected node %+v", node.Metadata)
+	}
+	if *calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", *calls)
+	}
+	stats := client.Stats()
+	if stats.Requests != 3 || stats.Retries != 2 || stats.RetriesByMethod["GET"] != 2 || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCallStats(t *testing.T) {
+	server, _ := newFlakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{MaxRetries: 3})
+
+	ctx, call := WithCallStats(context.Background())
+	if _, err := client.Node.ByNameContext(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if call.Attempts() != 2 || call.Retries() != 1 || call.Throttled() != 1 {
+		t.Errorf("Expected 2 attempts, 1 retry and 1 throttled, got %d, %d and %d", call.Attempts(), call.Retries(), call.Throttled())
+	}
+
+	// Calls without CallStats aren't counted by the ones of other calls
+	if _, err := client.Node.ByName("node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if call.Attempts() != 2 {
+		t.Errorf("Expected 2 attempts, got %d", call.Attempts())
+	}
+	if stats := client.Stats(); stats.Requests != 3 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	server, calls := newFlakyServer(10, http.StatusInternalServerError, nil)
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{MaxRetries: 1})
+
+	_, err := client.Node.ByName("node-1")
+	if apiError, ok := asApiError(err); !ok || apiError.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected a 500 error, got %v", err)
+	}
+	if *calls != 2 {
+		t.Errorf("Expected 2 attempts, got %d", *calls)
+	}
+	if stats := client.Stats(); stats.Failures != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestDoesNotRetryNonIdempotentServerErrors(t *testing.T) {
+	server, calls := newFlakyServer(1, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{MaxRetries: 3})
+
+	if _, err := client.Node.PatchNode("node-1", MergePatchType, []byte(`{}`)); err == nil {
+		t.Fatal("Expected the PATCH to fail")
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 attempt, got %d", *calls)
+	}
+}
+
+func TestRetriesThrottledRequests(t *testing.T) {
+	server, calls := newFlakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{MaxRetries: 3})
+
+	if _, err := client.Node.PatchNode("node-1", MergePatchType, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 2 {
+		t.Errorf("Expected 2 attempts, got %d", *calls)
+	}
+	if stats := client.Stats(); stats.Throttled != 1 || stats.RetriesByMethod["PATCH"] != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}
+	if delay, retry := retryDelay("POST", resp, nil, 0); !retry || delay != 7*time.Second {
+		t.Errorf("Expected Retry-After to be honored, got %v %v", delay, retry)
+	}
+
+	resp = &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"3600"}}}
+	if delay, _ := retryDelay("GET", resp, nil, 0); delay != retryMaxRetryAfter {
+		t.Errorf("Expected Retry-After to be capped, got %v", delay)
+	}
+
+	for _, status := range []int{http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented} {
+		resp = &http.Response{StatusCode: status, Header: http.Header{}}
+		if _, retry := retryDelay("GET", resp, nil, 0); retry {
+			t.Errorf("Did not expect status %d to be retried", status)
+		}
+	}
+
+	for attempt := 0; attempt < 20; attempt++ {
+		delay := backoff(attempt)
+		if delay <= 0 || delay > retryMaxDelay {
+			t.Errorf("Backoff for attempt %d out of range: %v", attempt, delay)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0, 10) != nil {
+		t.Error("Expected a zero QPS to disable the limiter")
+	}
+
+	bucket := newTokenBucket(10, 2)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := bucket.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two requests come out of the burst, the other two wait 100ms each
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Rate limiter let requests through too quickly: %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newTokenBucket(0.001, 1).Wait(ctx); err != context.Canceled {
+		t.Errorf("Expected the cancelled context to stop the wait, got %v", err)
+	}
+}
+
+func TestWithDebugSharesLimitAndStats(t *testing.T) {
+	server, _ := newFlakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClientWithOptions(server.URL, false, ClientOptions{QPS: 10, Burst: 1, MaxRetries: 3})
+	debugClient := client.WithDebug(true)
+	if debugClient.rateLimiter != client.rateLimiter {
+		t.Error("Expected the clients to share one rate limiter")
+	}
+
+	throttled := "0"
+	if v := clientStats.Get("throttled"); v != nil {
+		throttled = v.String()
+	}
+	if _, err := debugClient.Node.PatchNode("node-1", MergePatchType, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.Stats(); stats.Requests != 2 || stats.Throttled != 1 {
+		t.Errorf("Expected the requests of the debug client to be counted, got %+v", stats)
+	}
+	if v := clientStats.Get("throttled"); v == nil || v.String() == throttled {
+		t.Errorf("Expected the throttled request to be published, got %v", clientStats.Get("throttled"))
+	}
+}
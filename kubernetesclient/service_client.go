@@ -1,19 +1,33 @@
 package kubernetesclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/rancher/kubernetes-model/model"
 )
 
+const ServiceAllNamespacesPath string = "/api/v1/services"
+
+var ServiceResource = GroupVersionResource{Version: "v1", Resource: "services"}
+
 const ServicePath string = "/api/v1/namespaces/%s/services"
 const ServiceByNamePath string = "/api/v1/namespaces/%s/services/%s"
 
 type ServiceOperations interface {
 	ByName(namespace string, name string) (*model.Service, error)
+	ByNameContext(ctx context.Context, namespace string, name string) (*model.Service, error)
+	List(namespace string, opts ListOptions) (*model.ServiceList, error)
+	ListContext(ctx context.Context, namespace string, opts ListOptions) (*model.ServiceList, error)
 	CreateService(namespace string, resource *model.Service) (*model.Service, error)
+	CreateServiceContext(ctx context.Context, namespace string, resource *model.Service) (*model.Service, error)
 	ReplaceService(namespace string, resource *model.Service) (*model.Service, error)
+	ReplaceServiceContext(ctx context.Context, namespace string, resource *model.Service) (*model.Service, error)
+	PatchService(namespace string, name string, patchType PatchType, patch []byte) (*model.Service, error)
+	PatchServiceContext(ctx context.Context, namespace string, name string, patchType PatchType, patch []byte) (*model.Service, error)
 	DeleteService(namespace string, name string) (*model.Status, error)
+	DeleteServiceContext(ctx context.Context, namespace string, name string) (*model.Status, error)
 }
 
 func newServiceClient(client *Client) *ServiceClient {
@@ -27,29 +41,77 @@ type ServiceClient struct {
 }
 
 func (c *ServiceClient) ByName(namespace string, name string) (*model.Service, error) {
+	return c.ByNameContext(context.Background(), namespace, name)
+}
+
+func (c *ServiceClient) ByNameContext(ctx context.Context, namespace string, name string) (*model.Service, error) {
 	resp := &model.Service{}
 	path := fmt.Sprintf(ServiceByNamePath, namespace, name)
-	err := c.client.doGet(path, resp)
+	err := c.client.doGet(ctx, path, resp)
 	return resp, err
 }
 
+// List returns the services in namespace, or in all namespaces when namespace
+// is empty.
+func (c *ServiceClient) List(namespace string, opts ListOptions) (*model.ServiceList, error) {
+	return c.ListContext(context.Background(), namespace, opts)
+}
+
+func (c *ServiceClient) ListContext(ctx context.Context, namespace string, opts ListOptions) (*model.ServiceList, error) {
+	list := &model.ServiceList{}
+	path := namespacedPath(ServiceAllNamespacesPath, ServicePath, namespace)
+	err := c.client.doList(ctx, path, opts, func(page []byte) error {
+		pageList := &model.ServiceList{}
+		if err := json.Unmarshal(page, pageList); err != nil {
+			return err
+		}
+		pageList.Items = append(list.Items, pageList.Items...)
+		*list = *pageList
+		return nil
+	})
+	return list, err
+}
+
 func (c *ServiceClient) CreateService(namespace string, resource *model.Service) (*model.Service, error) {
+	return c.CreateServiceContext(context.Background(), namespace, resource)
+}
+
+func (c *ServiceClient) CreateServiceContext(ctx context.Context, namespace string, resource *model.Service) (*model.Service, error) {
 	resp := &model.Service{}
 	path := fmt.Sprintf(ServicePath, namespace)
-	err := c.client.doPost(path, resource, resp)
+	err := c.client.doPost(ctx, path, resource, resp)
 	return resp, err
 }
 
 func (c *ServiceClient) ReplaceService(namespace string, resource *model.Service) (*model.Service, error) {
+	return c.ReplaceServiceContext(context.Background(), namespace, resource)
+}
+
+func (c *ServiceClient) ReplaceServiceContext(ctx context.Context, namespace string, resource *model.Service) (*model.Service, error) {
 	resp := &model.Service{}
 	path := fmt.Sprintf(ServiceByNamePath, namespace, resource.Metadata.Name)
-	err := c.client.doPut(path, resource, resp)
+	err := c.client.doPut(ctx, path, resource, resp)
+	return resp, err
+}
+
+func (c *ServiceClient) PatchService(namespace string, name string, patchType PatchType, patch []byte) (*model.Service, error) {
+	return c.PatchServiceContext(context.Background(), namespace, name, patchType, patch)
+}
+
+func (c *ServiceClient) PatchServiceContext(ctx context.Context, namespace string, name string, patchType PatchType, patch []byte) (*model.Service, error) {
+	resp := &model.Service{}
+	path := fmt.Sprintf(ServiceByNamePath, namespace, name)
+	err := c.client.doPatch(ctx, path, patchType, patch, resp)
 	return resp, err
 }
 
 func (c *ServiceClient) DeleteService(namespace string, name string) (*model.Status, error) {
+	return c.DeleteServiceContext(context.Background(), namespace, name)
+}
+
+func (c *ServiceClient) DeleteServiceContext(ctx context.Context, namespace string, name string) (*model.Status, error) {
 	status := &model.Status{}
 	path := fmt.Sprintf(ServiceByNamePath, namespace, name)
-	err := c.client.doDelete(path, status)
+	err := c.client.doDelete(ctx, path, status)
 	return status, err
 }
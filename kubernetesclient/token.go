@@ -0,0 +1,76 @@
+package kubernetesclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// fileCheckInterval bounds how often credential files are stat'ed for changes
+	fileCheckInterval = 10 * time.Second
+)
+
+// fileToken is a bearer token backed by a file that may be rewritten at any
+// time, such as a projected service account token.
+type fileToken struct {
+	sync.Mutex
+	path    string
+	token   string
+	modTime time.Time
+	checked time.Time
+}
+
+func newFileToken(path string) (*fileToken, error) {
+	f := &fileToken{
+		path: path,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileToken) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read token file %s: %v", f.path, err)
+	}
+	f.checked = time.Now()
+	if info.ModTime().Equal(f.modTime) && f.token != "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read token file %s: %v", f.path, err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return fmt.Errorf("Token file %s is empty", f.path)
+	}
+	if f.token != "" && f.token != token {
+		log.Infof("Reloaded rotated token from %s", f.path)
+	}
+	f.token = token
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// Token returns the current token, picking up a rotated file when needed. The
+// last good token is kept if the file can't be read mid-rotation.
+func (f *fileToken) Token() string {
+	f.Lock()
+	defer f.Unlock()
+	if time.Since(f.checked) >= fileCheckInterval {
+		if err := f.reload(); err != nil {
+			log.Warnf("Keeping previous token: %v", err)
+		}
+	}
+	return f.token
+}
@@ -0,0 +1,102 @@
+package kubernetesclient
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TransportOptions controls the timeouts of the connections made to the
+// kubernetes API.
+type TransportOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+var DefaultTransportOptions = TransportOptions{
+	DialTimeout:           30 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+}
+
+const (
+	keepAlive           = 30 * time.Second
+	idleConnTimeout     = 90 * time.Second
+	maxIdleConnsPerHost = 25
+)
+
+var (
+	transportLock    sync.Mutex
+	transportOptions = DefaultTransportOptions
+	transport        *http.Transport
+)
+
+// ConfigureTransport sets the timeouts used for all connections to the
+// kubernetes API. Connections made with the previous settings are closed once
+// they become idle.
+func ConfigureTransport(opts TransportOptions) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transportOptions = opts
+	resetTransport()
+}
+
+// resetTransport drops the shared transport so the next request builds one
+// with the current options and credentials. Callers must hold transportLock.
+func resetTransport() {
+	if transport != nil {
+		transport.CloseIdleConnections()
+		transport = nil
+	}
+}
+
+// sharedTransport returns the pooled transport shared by every client.
+func sharedTransport() *http.Transport {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport == nil {
+		dialer := newDialer(transportOptions)
+		transport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       GetTLSClientConfig(),
+			TLSHandshakeTimeout:   transportOptions.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: transportOptions.ResponseHeaderTimeout,
+			IdleConnTimeout:       idleConnTimeout,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		}
+	}
+	return transport
+}
+
+func newDialer(opts TransportOptions) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: keepAlive,
+	}
+}
+
+// NewHTTPClient returns a client backed by the shared transport.
+func NewHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: sharedTransport(),
+	}
+}
+
+// NewWebsocketDialer returns a dialer for watch streams that uses the
+// configured credentials and timeouts.
+func NewWebsocketDialer() *websocket.Dialer {
+	transportLock.Lock()
+	opts := transportOptions
+	transportLock.Unlock()
+
+	return &websocket.Dialer{
+		NetDial:          newDialer(opts).Dial,
+		TLSClientConfig:  GetTLSClientConfig(),
+		HandshakeTimeout: opts.TLSHandshakeTimeout + opts.ResponseHeaderTimeout,
+	}
+}
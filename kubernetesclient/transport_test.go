@@ -0,0 +1,62 @@
+package kubernetesclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedTransportReusesConnections(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"metadata": {"name": "test"}}`)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+	for i := 0; i < 5; i++ {
+		if _, err := client.Node.ByName("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("Expected a single pooled connection, got %d", n)
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Node.ByNameContext(ctx, "test"); err == nil {
+		t.Error("Expected the request to be cancelled by its context")
+	}
+
+	opts := DefaultTransportOptions
+	opts.ResponseHeaderTimeout = 50 * time.Millisecond
+	ConfigureTransport(opts)
+	defer ConfigureTransport(DefaultTransportOptions)
+	if _, err := client.Node.ByName("test"); err == nil {
+		t.Error("Expected the request to hit the response timeout")
+	}
+}
@@ -0,0 +1,238 @@
+package kubernetesclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Unstructured is a kubernetes object kept as generic JSON. Unlike the typed
+// kubernetes-model structs it keeps every field, including ones newer than
+// the model, so read-modify-write cycles don't drop anything. Numbers are
+// kept as json.Number so they are written back exactly as they were read.
+type Unstructured struct {
+	Object map[string]interface{}
+}
+
+func (u *Unstructured) UnmarshalJSON(b []byte) error {
+	obj := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil {
+		return err
+	}
+	u.Object = obj
+	return nil
+}
+
+func (u *Unstructured) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.Object)
+}
+
+// DeepCopy returns a copy that shares no maps or slices with u.
+func (u *Unstructured) DeepCopy() *Unstructured {
+	if u == nil {
+		return nil
+	}
+	return &Unstructured{Object: deepCopyJSON(u.Object).(map[string]interface{})}
+}
+
+func deepCopyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			c[key] = deepCopyJSON(val)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, val := range v {
+			c[i] = deepCopyJSON(val)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+func (u *Unstructured) GetAPIVersion() string {
+	return NestedString(u.Object, "apiVersion")
+}
+
+func (u *Unstructured) GetKind() string {
+	return NestedString(u.Object, "kind")
+}
+
+func (u *Unstructured) GetName() string {
+	return NestedString(u.Object, "metadata", "name")
+}
+
+func (u *Unstructured) SetName(name string) {
+	u.setMetadata("name", name)
+}
+
+func (u *Unstructured) GetNamespace() string {
+	return NestedString(u.Object, "metadata", "namespace")
+}
+
+func (u *Unstructured) SetNamespace(namespace string) {
+	u.setMetadata("namespace", namespace)
+}
+
+func (u *Unstructured) GetUID() string {
+	return NestedString(u.Object, "metadata", "uid")
+}
+
+func (u *Unstructured) GetResourceVersion() string {
+	return NestedString(u.Object, "metadata", "resourceVersion")
+}
+
+func (u *Unstructured) SetResourceVersion(version string) {
+	u.setMetadata("resourceVersion", version)
+}
+
+func (u *Unstructured) GetLabels() map[string]string {
+	return NestedStringMap(u.Object, "metadata", "labels")
+}
+
+func (u *Unstructured) SetLabels(labels map[string]string) {
+	u.setMetadata("labels", stringMapToJSON(labels))
+}
+
+func (u *Unstructured) GetAnnotations() map[string]string {
+	return NestedStringMap(u.Object, "metadata", "annotations")
+}
+
+func (u *Unstructured) SetAnnotations(annotations map[string]string) {
+	u.setMetadata("annotations", stringMapToJSON(annotations))
+}
+
+func (u *Unstructured) setMetadata(field string, value interface{}) {
+	if u.Object == nil {
+		u.Object = map[string]interface{}{}
+	}
+	if err := SetNestedField(u.Object, value, "metadata", field); err != nil {
+		// metadata is something other than an object, replace it
+		u.Object["metadata"] = map[string]interface{}{field: value}
+	}
+}
+
+func stringMapToJSON(m map[string]string) interface{} {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+// NestedField returns the value found by following fields through nested
+// objects.
+func NestedField(obj map[string]interface{}, fields ...string) (interface{}, bool) {
+	var value interface{} = obj
+	for _, field := range fields {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = m[field]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// NestedString returns the string found at fields, or "" if there is none.
+func NestedString(obj map[string]interface{}, fields ...string) string {
+	value, _ := NestedField(obj, fields...)
+	s, _ := value.(string)
+	return s
+}
+
+// NestedStringMap returns the string values of the object found at fields.
+func NestedStringMap(obj map[string]interface{}, fields ...string) map[string]string {
+	value, _ := NestedField(obj, fields...)
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			result[k] = s
+		}
+	}
+	return result
+}
+
+// SetNestedField sets value at fields, creating intermediate objects as
+// needed. A nil value removes the field.
+func SetNestedField(obj map[string]interface{}, value interface{}, fields ...string) error {
+	m := obj
+	for i, field := range fields[:len(fields)-1] {
+		next, ok := m[field]
+		if !ok || next == nil {
+			created := map[string]interface{}{}
+			m[field] = created
+			m = created
+			continue
+		}
+		nextMap, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Field %v is not an object", fields[:i+1])
+		}
+		m = nextMap
+	}
+	last := fields[len(fields)-1]
+	if value == nil {
+		delete(m, last)
+	} else {
+		m[last] = value
+	}
+	return nil
+}
+
+// UnstructuredList is a list of objects of any kind. Object holds the
+// fields of the list besides its items, such as its metadata.
+type UnstructuredList struct {
+	Object map[string]interface{}
+	Items  []Unstructured
+}
+
+func (l *UnstructuredList) UnmarshalJSON(b []byte) error {
+	var list struct {
+		Items []Unstructured `json:"items"`
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	u := &Unstructured{}
+	if err := u.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	delete(u.Object, "items")
+	l.Object = u.Object
+	l.Items = list.Items
+	return nil
+}
+
+func (l *UnstructuredList) MarshalJSON() ([]byte, error) {
+	obj := make(map[string]interface{}, len(l.Object)+1)
+	for k, v := range l.Object {
+		obj[k] = v
+	}
+	items := make([]interface{}, len(l.Items))
+	for i := range l.Items {
+		items[i] = l.Items[i].Object
+	}
+	obj["items"] = items
+	return json.Marshal(obj)
+}
+
+func (l *UnstructuredList) GetResourceVersion() string {
+	return NestedString(l.Object, "metadata", "resourceVersion")
+}
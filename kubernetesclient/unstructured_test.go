@@ -0,0 +1,132 @@
+package kubernetesclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// A node with fields that kubernetes-model doesn't know about
+const nodeWithUnknownFields = `{
+  "apiVersion": "v1",
+  "kind": "Node",
+  "metadata": {
+    "name": "node-1",
+    "uid": "8f4c6a8e",
+    "resourceVersion": "1234",
+    "labels": {"kubernetes.io/hostname": "node-1"},
+    "managedFields": [{"manager": "kubelet", "operation": "Update"}]
+  },
+  "spec": {
+    "podCIDR": "10.42.0.0/24",
+    "podCIDRs": ["10.42.0.0/24"],
+    "taints": [{"key": "node-role.kubernetes.io/master", "effect": "NoSchedule"}],
+    "configSource": {"configMap": {"name": "kubelet-config", "namespace": "kube-system"}}
+  },
+  "status": {
+    "capacity": {"cpu": "4", "memory": "16331512Ki"},
+    "daemonEndpoints": {"kubeletEndpoint": {"Port": 10250}},
+    "nodeInfo": {"bootID": "x"},
+    "allocatedBytes": 9007199254740993,
+    "ratio": 0.1
+  }
+}`
+
+func decodeForComparison(t *testing.T, data []byte) map[string]interface{} {
+	result := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestUnstructuredRoundTrip(t *testing.T) {
+	u := &Unstructured{}
+	if err := json.Unmarshal([]byte(nodeWithUnknownFields), u); err != nil {
+		t.Fatal(err)
+	}
+	if u.GetName() != "node-1" || u.GetUID() != "8f4c6a8e" || u.GetResourceVersion() != "1234" {
+		t.Errorf("Unexpected metadata %v", u.Object["metadata"])
+	}
+
+	out, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeForComparison(t, []byte(nodeWithUnknownFields))
+	if actual := decodeForComparison(t, out); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Round trip changed the object:\n%s", out)
+	}
+	if !bytes.Contains(out, []byte("9007199254740993")) {
+		t.Errorf("Large integer lost precision:\n%s", out)
+	}
+}
+
+func TestUnstructuredAccessors(t *testing.T) {
+	u := &Unstructured{}
+	if err := json.Unmarshal([]byte(nodeWithUnknownFields), u); err != nil {
+		t.Fatal(err)
+	}
+	original := u.DeepCopy()
+
+	labels := u.GetLabels()
+	labels["io.rancher.host"] = "true"
+	u.SetLabels(labels)
+	u.SetAnnotations(map[string]string{"io.rancher.labels.io.rancher.host": ""})
+
+	if u.GetLabels()["io.rancher.host"] != "true" {
+		t.Error("Label was not set")
+	}
+	if _, ok := original.GetLabels()["io.rancher.host"]; ok {
+		t.Error("DeepCopy shares state with the original")
+	}
+
+	u.SetAnnotations(nil)
+	if _, ok := NestedField(u.Object, "metadata", "annotations"); ok {
+		t.Error("Expected nil annotations to remove the field")
+	}
+
+	if err := SetNestedField(u.Object, "x", "metadata", "name", "nested"); err == nil {
+		t.Error("Expected an error when descending into a non object field")
+	}
+}
+
+func TestReplaceNodeUnstructuredKeepsUnknownFields(t *testing.T) {
+	var written []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(nodeWithUnknownFields))
+		case http.MethodPut:
+			written, _ = ioutil.ReadAll(r.Body)
+			w.Write(written)
+		}
+	}))
+	defer server.Close()
+
+	setCredentials(&credentials{})
+	client := NewClient(server.URL, false)
+
+	node, err := client.Node.ByNameUnstructured("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := node.GetLabels()
+	labels["io.rancher.host"] = "true"
+	node.SetLabels(labels)
+	if _, err := client.Node.ReplaceNodeUnstructured(node); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := decodeForComparison(t, []byte(nodeWithUnknownFields))
+	SetNestedField(expected, "true", "metadata", "labels", "io.rancher.host")
+	if actual := decodeForComparison(t, written); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Unexpected object written back:\n%s", written)
+	}
+}
@@ -0,0 +1,149 @@
+package kubernetesclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Watch event types sent by the API server
+const (
+	EventAdded    = "ADDED"
+	EventModified = "MODIFIED"
+	EventDeleted  = "DELETED"
+	EventError    = "ERROR"
+)
+
+// WatchEvent is a change to a resource. For ERROR events Object holds the
+// Status the API server sent.
+type WatchEvent struct {
+	Type   string        `json:"type"`
+	Object *Unstructured `json:"object"`
+}
+
+// Watcher streams the changes to a collection over a websocket until it is
+// stopped or the connection fails.
+type Watcher struct {
+	conn     *websocket.Conn
+	result   chan WatchEvent
+	done     chan struct{}
+	stopOnce sync.Once
+
+	sync.Mutex
+	err error
+}
+
+// watch opens a watch on the collection at path.
+func (c *baseClient) watch(ctx context.Context, path string, opts ListOptions) (*Watcher, error) {
+	u, err := url.Parse(c.BaseURL + path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	q := opts.query()
+	q.Set("watch", "true")
+	u.RawQuery = q.Encode()
+
+	if err := c.rateLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	headers.Add("Origin", "http://kubernetes-agent")
+	SetAuthorizationHeader(headers)
+
+	if c.debug {
+		fmt.Println("Watch => " + u.String())
+	}
+	conn, resp, err := NewWebsocketDialer().Dial(u.String(), headers)
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 300 {
+			var body []byte
+			if resp.Body != nil {
+				body, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			return nil, newApiError(resp, u.String(), body)
+		}
+		return nil, err
+	}
+
+	w := &Watcher{
+		conn:   conn,
+		result: make(chan WatchEvent),
+		done:   make(chan struct{}),
+	}
+	go w.receive()
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Stop()
+		case <-w.done:
+		}
+	}()
+	return w, nil
+}
+
+// ResultChan returns the events. It is closed when the watch ends, after
+// which Err tells why.
+func (w *Watcher) ResultChan() <-chan WatchEvent {
+	return w.result
+}
+
+// Stop ends the watch. It is safe to call more than once.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.conn.Close()
+	})
+}
+
+// Err returns the error that ended the watch, or nil if it was stopped.
+func (w *Watcher) Err() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.err
+}
+
+func (w *Watcher) receive() {
+	defer close(w.result)
+	defer w.Stop()
+	for {
+		_, msg, err := w.conn.ReadMessage()
+		if err != nil {
+			w.setErr(err)
+			return
+		}
+
+		var event WatchEvent
+		if err := json.Unmarshal(msg, &event); err != nil {
+			w.setErr(err)
+			return
+		}
+
+		select {
+		case w.result <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Watcher) setErr(err error) {
+	select {
+	case <-w.done:
+		// Reading fails once the connection is closed by Stop
+		return
+	default:
+	}
+	w.Lock()
+	w.err = err
+	w.Unlock()
+}
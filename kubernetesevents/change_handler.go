@@ -1,23 +1,40 @@
 package kubernetesevents
 
 import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
 	"github.com/rancher/kubernetes-model/model"
 )
 
-func NewChangeHandler(rancherClient *client.RancherClient, kubernetesClient *kubernetesclient.Client, kindHandled string) *ChangeHandler {
+// NewChangeHandler publishes changes to a kind with its objects shaped by
+// rules, or by DefaultProjection when rules is nil. Objects in namespaces
+// that opted out of syncing, looked up in informers, aren't published.
+func NewChangeHandler(rancherClient *client.RancherClient, kubernetesClient *kubernetesclient.Client, informers *SharedInformerFactory, kindHandled string, rules *PayloadRules) *ChangeHandler {
+	if rules == nil {
+		rules = &PayloadRules{Default: DefaultProjection}
+	}
 	return &ChangeHandler{
 		rancherClient: rancherClient,
 		kClient:       kubernetesClient,
+		informers:     informers,
 		kindHandled:   kindHandled,
+		rules:         rules,
+		optOuts:       newOptOutTracker(),
+		published:     newPublishedCache(),
 	}
 }
 
 type ChangeHandler struct {
 	rancherClient *client.RancherClient
 	kClient       *kubernetesclient.Client
+	informers     *SharedInformerFactory
 	kindHandled   string
+	rules         *PayloadRules
+	optOuts       *optOutTracker
+	published     *publishedCache
 }
 
 func (h *ChangeHandler) GetKindHandled() string {
@@ -25,13 +42,71 @@ func (h *ChangeHandler) GetKindHandled() string {
 }
 
 func (h *ChangeHandler) Handle(event model.WatchEvent) error {
+	var uid, hash string
+	var object interface{} = event.Object
+	var truncated []string
+	if i, ok := event.Object.(map[string]interface{}); ok {
+		var obj struct {
+			Metadata *model.ObjectMeta
+		}
+		if err := mapstructure.Decode(i, &obj); err != nil {
+			log.Infof("Couldn't decode metadata of %+v: %v", i, err)
+		} else if obj.Metadata != nil {
+			uid = obj.Metadata.Uid
+			optOut := optedOut(obj.Metadata)
+			if event.Type != "DELETED" {
+				var err error
+				if optOut, err = objectOptedOut(h.informers, obj.Metadata); err != nil {
+					return err
+				}
+			}
+			event.Type = h.optOuts.eventType(uid, optOut, event.Type)
+			if event.Type == "" {
+				return nil
+			}
+		}
+
+		projected := h.rules.Projection(h.kindHandled).apply(i)
+		if uid != "" && event.Type != "DELETED" {
+			var err error
+			if hash, err = payloadHash(changeFields(projected)); err != nil {
+				return err
+			}
+			if h.published.unchanged(uid, hash) {
+				return nil
+			}
+		}
+
+		if h.rules.MaxSize > 0 {
+			var err error
+			if projected, truncated, err = truncate(projected, h.rules.MaxSize); err != nil {
+				return err
+			}
+			if len(truncated) > 0 {
+				log.Infof("Truncated %v of %s %s to fit in %d bytes", truncated, h.kindHandled, uid, h.rules.MaxSize)
+			}
+		}
+		object = projected
+	}
+
+	data := map[string]interface{}{
+		"type":   event.Type,
+		"object": object,
+	}
+	if len(truncated) > 0 {
+		data["truncated"] = truncated
+	}
 	_, err := h.rancherClient.Publish.Create(&client.Publish{
 		Name: "service.kubernetes.change",
-		Data: map[string]interface{}{
-			"type":   event.Type,
-			"object": event.Object,
-		},
+		Data: data,
 	})
-
-	return err
+	if err != nil || uid == "" {
+		return err
+	}
+	if event.Type == "DELETED" {
+		h.published.forget(uid)
+	} else {
+		h.published.set(uid, hash)
+	}
+	return nil
 }
@@ -0,0 +1,397 @@
+package kubernetesevents
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+const (
+	// checkpointMinRecords is the fewest records the file is allowed before
+	// it is compacted
+	checkpointMinRecords = 1000
+)
+
+// Checkpoints remember, in a file, the resourceVersion up to which each
+// watch's events were handled and the resourceVersion of each object, by
+// UID, the watch knew of at that version. A restarted agent resumes its
+// watches instead of listing everything again and missing what changed while
+// it was down, and a watch that has to list again still finds the objects
+// deleted in the meantime. Object bodies are never written, so Secrets and
+// the like don't end up on disk. The file is a journal of the changes to the
+// checkpoints, one JSON record per line, which is compacted as it grows. A
+// nil *Checkpoints remembers nothing.
+type Checkpoints struct {
+	sync.Mutex
+	path        string
+	checkpoints map[string]*checkpoint
+	// records counts the records in the file, objects the objects in all
+	// checkpoints, to tell when the file is worth compacting
+	records int
+	objects int
+}
+
+type checkpoint struct {
+	version string
+	// objects holds the resourceVersion of the objects known at version, by
+	// UID
+	objects map[string]string
+}
+
+// checkpointRecord is a line of the file. Objects holds the resourceVersion
+// of the objects added or changed since the previous record of the
+// checkpoint, by UID, and "" for the ones deleted.
+type checkpointRecord struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Objects map[string]string `json:"objects,omitempty"`
+}
+
+// LoadCheckpoints reads the checkpoints in path, which needn't exist yet.
+// Records that can't be parsed, like one cut short by a crash, are skipped
+// and the file is rewritten without them.
+func LoadCheckpoints(path string) (*Checkpoints, error) {
+	c := &Checkpoints{
+		path:        path,
+		checkpoints: map[string]*checkpoint{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	skipped := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		record := checkpointRecord{}
+		if err := json.Unmarshal(line, &record); err != nil || record.Name == "" || record.Version == "" {
+			skipped++
+			continue
+		}
+		c.apply(record)
+		c.records++
+	}
+	if skipped > 0 {
+		log.Warnf("Ignoring %d unreadable checkpoint records in %s", skipped, path)
+		if err := c.write(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get returns the checkpoint of a watch, empty if there is none.
+func (c *Checkpoints) Get(name string) string {
+	if c == nil {
+		return ""
+	}
+	c.Lock()
+	defer c.Unlock()
+	if checkpoint, ok := c.checkpoints[name]; ok {
+		return checkpoint.version
+	}
+	return ""
+}
+
+// Set records the checkpoint of a watch, without changing the objects it
+// knew of.
+func (c *Checkpoints) Set(name string, version string) {
+	c.advance(name, version, nil)
+}
+
+// advance records the checkpoint of a watch and the resourceVersions of the
+// objects that changed up to it, "" meaning deleted. The record is appended
+// to the file in a single write, so a crash leaves the checkpoint either
+// before or after it.
+func (c *Checkpoints) advance(name string, version string, objects map[string]string) {
+	if c == nil || version == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if checkpoint, ok := c.checkpoints[name]; ok && checkpoint.version == version && len(objects) == 0 {
+		return
+	}
+	record := checkpointRecord{Name: name, Version: version, Objects: objects}
+	c.apply(record)
+	if err := c.append(record); err != nil {
+		log.Warnf("Error writing checkpoint of %s: %v", name, err)
+	}
+}
+
+// known returns the resourceVersions of the objects a watch knew of at its
+// checkpoint, by UID.
+func (c *Checkpoints) known(name string) map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	known := map[string]string{}
+	if checkpoint, ok := c.checkpoints[name]; ok {
+		for uid, version := range checkpoint.objects {
+			known[uid] = version
+		}
+	}
+	return known
+}
+
+// apply updates the checkpoints with a record. The caller must hold the lock.
+func (c *Checkpoints) apply(record checkpointRecord) {
+	entry, ok := c.checkpoints[record.Name]
+	if !ok {
+		entry = &checkpoint{objects: map[string]string{}}
+		c.checkpoints[record.Name] = entry
+	}
+	entry.version = record.Version
+	for uid, version := range record.Objects {
+		_, had := entry.objects[uid]
+		switch {
+		case version == "" && had:
+			delete(entry.objects, uid)
+			c.objects--
+		case version != "":
+			entry.objects[uid] = version
+			if !had {
+				c.objects++
+			}
+		}
+	}
+}
+
+// append adds a record to the file, or rewrites the file once it holds
+// more than twice the records needed to describe the checkpoints. The caller
+// must hold the lock.
+func (c *Checkpoints) append(record checkpointRecord) error {
+	if c.records >= checkpointMinRecords && c.records >= 2*(len(c.checkpoints)+c.objects) {
+		return c.write()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	c.records++
+	return file.Close()
+}
+
+// write replaces the file with a record per checkpoint through a rename, so
+// a crash leaves either the old or the new checkpoints. The caller must hold
+// the lock.
+func (c *Checkpoints) write() error {
+	names := make([]string, 0, len(c.checkpoints))
+	for name := range c.checkpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var data []byte
+	for _, name := range names {
+		line, err := json.Marshal(checkpointRecord{
+			Name:    name,
+			Version: c.checkpoints[name].version,
+			Objects: c.checkpoints[name].objects,
+		})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".checkpoints")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.records = len(names)
+	return nil
+}
+
+// checkpointName names the watch of resource by an informer with handlers.
+// The handlers are part of the name, so a handler added since the checkpoint
+// was written starts with a list instead of missing what came before.
+func checkpointName(resource kubernetesclient.ResourceOperations, handlers []string) string {
+	names := append([]string{}, handlers...)
+	sort.Strings(names)
+	name := strings.Join(names, "+") + "/" + resource.GroupVersionResource().String()
+	if namespace := resource.GetNamespace(); namespace != "" {
+		name += "/" + namespace
+	}
+	return name
+}
+
+// resume starts the reflector's watch from its checkpoint, if it has one,
+// knowing of the objects it knew of then. It only lists to fill the store
+// before that, and only reports what the list found if the
+// apiserver no longer has that version, and then reports the objects deleted
+// since as DELETED. Those only carry the UID and resourceVersion they had,
+// since no more of them was kept.
+func (c *Checkpoints) resume(reflector *Reflector, name string) bool {
+	version := c.Get(name)
+	if version == "" {
+		return false
+	}
+	log.Infof("Resuming watch of %s from checkpoint %s", reflector.name, version)
+	reflector.resourceVersion = version
+	reflector.resumed = true
+	for uid, objectVersion := range c.known(name) {
+		reflector.known[uid] = checkpointedObject(uid, objectVersion)
+	}
+	return true
+}
+
+// checkpointedObject stands in for an object known from a checkpoint, of
+// which only the UID and resourceVersion are left.
+func checkpointedObject(uid string, version string) *kubernetesclient.Unstructured {
+	return &kubernetesclient.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"uid":             uid,
+			"resourceVersion": version,
+		},
+	}}
+}
+
+// versionTracker finds the resourceVersion up to which the events of a
+// reflector were all handled, as handlers finish them out of order, and the
+// objects that changed up to it.
+type versionTracker struct {
+	sync.Mutex
+	pending []*trackedVersion
+	// objects are the resourceVersions of the objects changed by events
+	// handled but not yet part of a checkpoint, "" meaning deleted
+	objects map[string]string
+}
+
+type trackedVersion struct {
+	version string
+	// objects are the resourceVersions of the objects the event changed,
+	// "" meaning deleted, along with those of the handled events merged
+	// into it
+	objects map[string]string
+	// waiting counts the handlers that haven't handled the event yet
+	waiting int
+	// listed events come in no particular order, so only the version of
+	// their list is a checkpoint
+	listed bool
+}
+
+// add records an event the reflector delivered to handlers handlers.
+func (t *versionTracker) add(event kubernetesclient.WatchEvent, listed bool, handlers int) *trackedVersion {
+	t.Lock()
+	defer t.Unlock()
+	tracked := &trackedVersion{
+		version: event.Object.GetResourceVersion(),
+		waiting: handlers,
+		listed:  listed,
+	}
+	if uid := event.Object.GetUID(); uid != "" {
+		tracked.objects = map[string]string{uid: ""}
+		if event.Type != kubernetesclient.EventDeleted {
+			tracked.objects[uid] = tracked.version
+		}
+	}
+	t.pending = append(t.pending, tracked)
+	return tracked
+}
+
+// mark records a version every event before it leads up to, like the
+// version of a list. It returns the new checkpoint and the objects changed
+// up to it, if it moved.
+func (t *versionTracker) mark(version string) (string, map[string]string) {
+	t.Lock()
+	defer t.Unlock()
+	t.pending = append(t.pending, &trackedVersion{version: version})
+	return t.advance()
+}
+
+// complete records that one of the handlers of an event handled it. It
+// returns the new checkpoint and the objects changed up to it, if it moved.
+func (t *versionTracker) complete(tracked *trackedVersion) (string, map[string]string) {
+	t.Lock()
+	defer t.Unlock()
+	tracked.waiting--
+	checkpoint, objects := t.advance()
+	t.compact()
+	return checkpoint, objects
+}
+
+// advance drops the handled events at the front. The caller must hold the
+// lock.
+func (t *versionTracker) advance() (string, map[string]string) {
+	checkpoint := ""
+	i := 0
+	for ; i < len(t.pending) && t.pending[i].waiting <= 0; i++ {
+		for uid, version := range t.pending[i].objects {
+			if t.objects == nil {
+				t.objects = map[string]string{}
+			}
+			t.objects[uid] = version
+		}
+		if !t.pending[i].listed {
+			checkpoint = t.pending[i].version
+		}
+	}
+	t.pending = t.pending[i:]
+	if checkpoint == "" {
+		return "", nil
+	}
+	objects := t.objects
+	t.objects = nil
+	return checkpoint, objects
+}
+
+// compact merges the runs of handled events behind one that isn't, which
+// may never be, so they take up no more room than the objects they changed.
+// The caller must hold the lock.
+func (t *versionTracker) compact() {
+	compacted := t.pending[:0]
+	for _, tracked := range t.pending {
+		last := len(compacted) - 1
+		if last < 0 || tracked.waiting > 0 || compacted[last].waiting > 0 {
+			compacted = append(compacted, tracked)
+			continue
+		}
+		merged := compacted[last]
+		if merged.objects == nil {
+			merged.objects = map[string]string{}
+		}
+		for uid, version := range tracked.objects {
+			merged.objects[uid] = version
+		}
+		if !tracked.listed {
+			merged.version = tracked.version
+			merged.listed = false
+		}
+	}
+	for i := len(compacted); i < len(t.pending); i++ {
+		t.pending[i] = nil
+	}
+	t.pending = compacted
+}
@@ -0,0 +1,413 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+func trackedEvent(t *testing.T, eventType string, uid string, version string) kubernetesclient.WatchEvent {
+	obj := &kubernetesclient.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(testService(uid, version))); err != nil {
+		t.Fatal(err)
+	}
+	return kubernetesclient.WatchEvent{Type: eventType, Object: obj}
+}
+
+// objectVersions describes the objects of a checkpoint as uid@version, and
+// uid@- for deleted ones.
+func objectVersions(objects map[string]string) []string {
+	var versions []string
+	for uid, version := range objects {
+		if version == "" {
+			versions = append(versions, uid+"@-")
+		} else {
+			versions = append(versions, uid+"@"+version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func TestVersionTracker(t *testing.T) {
+	tracker := &versionTracker{}
+	a1 := tracker.add(trackedEvent(t, "ADDED", "a", "1"), true, 1)
+	b2 := tracker.add(trackedEvent(t, "ADDED", "b", "2"), true, 1)
+	if checkpoint, _ := tracker.mark("10"); checkpoint != "" {
+		t.Errorf("Expected no checkpoint before the listed events are handled, got %s", checkpoint)
+	}
+	if checkpoint, _ := tracker.complete(b2); checkpoint != "" {
+		t.Errorf("Expected listed versions not to be checkpoints, got %s", checkpoint)
+	}
+	checkpoint, objects := tracker.complete(a1)
+	if checkpoint != "10" || fmt.Sprint(objectVersions(objects)) != "[a@1 b@2]" {
+		t.Errorf("Expected the list version and its objects once its events are handled, got %q %v", checkpoint, objectVersions(objects))
+	}
+
+	// Two handlers see every change
+	a11 := tracker.add(trackedEvent(t, "MODIFIED", "a", "11"), false, 2)
+	b12 := tracker.add(trackedEvent(t, "DELETED", "b", "12"), false, 2)
+	a13 := tracker.add(trackedEvent(t, "MODIFIED", "a", "13"), false, 2)
+	for _, tracked := range []*trackedVersion{a11, a13, b12} {
+		if checkpoint, _ := tracker.complete(tracked); checkpoint != "" {
+			t.Errorf("Expected no checkpoint while the other handler is busy, got %q", checkpoint)
+		}
+	}
+	if checkpoint, objects := tracker.complete(a11); checkpoint != "11" || fmt.Sprint(objectVersions(objects)) != "[a@11]" {
+		t.Errorf("Expected to stop before b@12, got %q %v", checkpoint, objectVersions(objects))
+	}
+	tracker.complete(a13)
+	if checkpoint, objects := tracker.complete(b12); checkpoint != "13" || fmt.Sprint(objectVersions(objects)) != "[a@13 b@-]" {
+		t.Errorf("Expected every event to be handled, got %q %v", checkpoint, objectVersions(objects))
+	}
+	tracker.add(trackedEvent(t, "ADDED", "c", "14"), false, 0)
+	if checkpoint, _ := tracker.mark("15"); checkpoint != "15" {
+		t.Errorf("Expected events without handlers not to hold up the checkpoint, got %q", checkpoint)
+	}
+	if len(tracker.pending) != 0 || len(tracker.objects) != 0 {
+		t.Errorf("Expected handled events to be forgotten, got %+v %v", tracker.pending, tracker.objects)
+	}
+
+	// An event that isn't handled holds the checkpoint back, and the ones
+	// handled behind it are merged
+	stuck := tracker.add(trackedEvent(t, "MODIFIED", "a", "16"), false, 1)
+	for i := 17; i < 27; i++ {
+		uid := "b"
+		if i%2 == 0 {
+			uid = "c"
+		}
+		tracker.complete(tracker.add(trackedEvent(t, "MODIFIED", uid, fmt.Sprint(i)), false, 1))
+	}
+	if len(tracker.pending) != 2 {
+		t.Errorf("Expected the handled events to be merged, got %d pending", len(tracker.pending))
+	}
+	if checkpoint, objects := tracker.complete(stuck); checkpoint != "26" || fmt.Sprint(objectVersions(objects)) != "[a@16 b@25 c@26]" {
+		t.Errorf("Expected the merged events to be checkpointed, got %q %v", checkpoint, objectVersions(objects))
+	}
+}
+
+func tempCheckpoints(t *testing.T) (*Checkpoints, func()) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := LoadCheckpoints(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkpoints, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckpointsPersist(t *testing.T) {
+	checkpoints, cleanup := tempCheckpoints(t)
+	defer cleanup()
+
+	checkpoints.Set("sync/v1/services", "10")
+	checkpoints.Set("change/v1/pods/team-a", "12")
+
+	loaded, err := LoadCheckpoints(checkpoints.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := loaded.Get("sync/v1/services"); version != "10" {
+		t.Errorf("Expected the services checkpoint to be 10, got %q", version)
+	}
+	if version := loaded.Get("change/v1/pods/team-a"); version != "12" {
+		t.Errorf("Expected the pods checkpoint to be 12, got %q", version)
+	}
+
+	var missing *Checkpoints
+	missing.Set("sync/v1/services", "10")
+	missing.advance("sync/v1/services", "11", map[string]string{"a": ""})
+	if version := missing.Get("sync/v1/services"); version != "" {
+		t.Errorf("Expected no checkpoints to remember nothing, got %q", version)
+	}
+}
+
+func TestCheckpointsJournal(t *testing.T) {
+	checkpoints, cleanup := tempCheckpoints(t)
+	defer cleanup()
+
+	checkpoints.advance("sync/v1/services", "10", map[string]string{"a": "1", "b": "2"})
+	checkpoints.advance("sync/v1/services", "11", map[string]string{"a": "11", "b": ""})
+	// A crash cut the last record short
+	file, err := os.OpenFile(checkpoints.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"name": "sync/v1/services", "version": "12", "obj`)
+	file.Close()
+
+	loaded, err := LoadCheckpoints(checkpoints.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := loaded.Get("sync/v1/services"); version != "11" {
+		t.Errorf("Expected the services checkpoint to be 11, got %q", version)
+	}
+	if known := objectVersions(loaded.known("sync/v1/services")); fmt.Sprint(known) != "[a@11]" {
+		t.Errorf("Expected only a to be known at 11, got %v", known)
+	}
+	if data, _ := ioutil.ReadFile(checkpoints.path); strings.Count(string(data), "\n") != 1 || !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("Expected the file to be rewritten without the cut record, got %s", data)
+	}
+
+	// The file is compacted as it grows
+	for i := 0; i < 2*checkpointMinRecords; i++ {
+		loaded.Set("sync/v1/services", fmt.Sprint(100+i))
+	}
+	data, err := ioutil.ReadFile(loaded.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > checkpointMinRecords {
+		t.Errorf("Expected the file to be compacted, it has %d records", lines)
+	}
+	compacted, err := LoadCheckpoints(loaded.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := compacted.Get("sync/v1/services"); version != fmt.Sprint(100+2*checkpointMinRecords-1) {
+		t.Errorf("Expected the last checkpoint after compacting, got %q", version)
+	}
+	if known := objectVersions(compacted.known("sync/v1/services")); fmt.Sprint(known) != "[a@11]" {
+		t.Errorf("Expected the objects to survive compacting, got %v", known)
+	}
+}
+
+// resumeServer lists a and b, and sends a change to a on every watch. Other
+// reads, like the namespace lookups of opt out checks, aren't counted.
+type resumeServer struct {
+	sync.Mutex
+	lists         int
+	watchVersions []string
+}
+
+func (f *resumeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	if r.URL.Query().Get("watch") != "true" {
+		if r.URL.Path == "/api/v1/services" {
+			f.lists++
+		}
+		f.Unlock()
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "20"}, "items": [%s, %s]}`, testService("a", "11"), testService("b", "2"))
+		return
+	}
+	f.watchVersions = append(f.watchVersions, r.URL.Query().Get("resourceVersion"))
+	f.Unlock()
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "MODIFIED", "object": `+testService("a", "11")+`}`))
+	conn.ReadMessage()
+}
+
+func TestDeltaFIFOResumesFromCheckpoint(t *testing.T) {
+	fake := &resumeServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	checkpoints, cleanup := tempCheckpoints(t)
+	defer cleanup()
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	name := checkpointName(kClient.Resource(kubernetesclient.ServiceResource), []string{"sync"})
+	checkpoints.advance(name, "10", map[string]string{"a": "1", "b": "2"})
+
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	handler.kClient = kClient
+	informers := NewSharedInformerFactory(kClient, nil, checkpoints)
+	informer := informers.ForResource(kubernetesclient.ServiceResource, true)
+	fifo := NewDeltaFIFO(handler, informer, 0, 1)
+	go fifo.Process()
+	defer fifo.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx)
+
+	if event := nextEvent(t, events); event.EventType != "service.create" || event.ExternalId != "a" {
+		t.Fatalf("Expected the change to a to be sent, got %s %s", event.EventType, event.ExternalId)
+	}
+	for deadline := time.Now().Add(5 * time.Second); checkpoints.Get(name) != "11"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the checkpoint to move to 11, got %s", checkpoints.Get(name))
+		}
+	}
+
+	fake.Lock()
+	if fake.lists != 1 || fmt.Sprint(fake.watchVersions) != "[10]" {
+		t.Errorf("Expected a list to fill the store and a watch from 10, got %d lists and watches from %v", fake.lists, fake.watchVersions)
+	}
+	fake.Unlock()
+	if !informer.HasSynced() {
+		t.Error("Expected the informer to be synced once its store is filled")
+	}
+	if names := storeNames(informer.Store().List()); fmt.Sprint(names) != "[svc-a svc-b]" {
+		t.Errorf("Expected the store to hold a and b, got %v", names)
+	}
+
+	// The queue only knows what it sent since the restart, so a resync
+	// sends b, which the watch didn't report, once more
+	fifo.resync()
+	if event := nextEvent(t, events); event.EventType != "service.create" || event.ExternalId != "b" {
+		t.Errorf("Expected the resync to send b, got %s %s", event.EventType, event.ExternalId)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestResumedInformerKeepsFilledStore(t *testing.T) {
+	// a changed twice while the agent was down
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "20"}, "items": [%s]}`, testService("a", "12"))
+			return
+		}
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "MODIFIED", "object": `+testService("a", "11")+`}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "MODIFIED", "object": `+testService("a", "12")+`}`))
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	checkpoints, cleanup := tempCheckpoints(t)
+	defer cleanup()
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	name := checkpointName(kClient.Resource(kubernetesclient.ServiceResource), []string{"test"})
+	checkpoints.advance(name, "10", map[string]string{"a": "1"})
+
+	factory := NewSharedInformerFactory(kClient, nil, checkpoints)
+	informer := factory.ForResource(kubernetesclient.ServiceResource, true)
+	events := make(chan string, 10)
+	informer.AddEventHandler("test", func(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+		defer handled()
+		stored, _ := informer.Store().Get("default", "svc-a")
+		events <- event.Object.GetResourceVersion() + " " + stored.GetResourceVersion()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory.Start(ctx)
+
+	for _, expected := range []string{"11 12", "12 12"} {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Errorf("Expected the store to hold the listed version of a, got event and store versions %s", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the watch")
+		}
+	}
+	waitForCheckpoint(t, checkpoints, name, "12")
+}
+
+// restartServer serves a cluster in which b was deleted and c added while the
+// agent was down, and in which the checkpoint the agent resumes from has
+// expired.
+func restartServer(t *testing.T, expired string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "20"}, "items": [%s, %s]}`, testService("a", "11"), testService("c", "15"))
+			return
+		}
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if r.URL.Query().Get("resourceVersion") == expired {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "ERROR", "object": {"kind": "Status", "status": "Failure", "code": 410, "reason": "Expired"}}`))
+			return
+		}
+		conn.ReadMessage()
+	}))
+}
+
+func TestResumedInformerRelistsDeletions(t *testing.T) {
+	// Before the restart the agent knew of a and b
+	before, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(before)
+	path := filepath.Join(before, "checkpoints.json")
+	checkpoints, err := LoadCheckpoints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := restartServer(t, "11")
+	defer server.Close()
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	name := checkpointName(kClient.Resource(kubernetesclient.ServiceResource), []string{"test"})
+	checkpoints.advance(name, "11", map[string]string{"a": "11", "b": "2"})
+
+	restarted, err := LoadCheckpoints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := NewSharedInformerFactory(kClient, nil, restarted)
+	informer := factory.ForResource(kubernetesclient.ServiceResource, true)
+	events := make(chan string, 10)
+	informer.AddEventHandler("test", func(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+		defer handled()
+		events <- event.Type + " " + event.Object.GetUID()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory.Start(ctx)
+
+	var received []string
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the relist, got %v", received)
+		}
+	}
+	sort.Strings(received)
+	if fmt.Sprint(received) != "[ADDED c DELETED b]" {
+		t.Errorf("Expected the relist to report c added and b deleted, got %v", received)
+	}
+	waitForCheckpoint(t, restarted, name, "20")
+	if known := objectVersions(restarted.known(name)); fmt.Sprint(known) != "[a@11 c@15]" {
+		t.Errorf("Expected a and c to be known at 20, got %v", known)
+	}
+	if names := storeNames(informer.Store().List()); fmt.Sprint(names) != "[svc-a svc-c]" {
+		t.Errorf("Expected the store to hold a and c, got %v", names)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Contains(string(data), "clusterIP") {
+		t.Errorf("Expected no object bodies in the checkpoints, got %s", data)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %v", event)
+	default:
+	}
+}
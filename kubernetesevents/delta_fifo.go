@@ -1,200 +1,564 @@
 package kubernetesevents
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
+	"context"
+	"expvar"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/gorilla/websocket"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
 	"github.com/rancher/kubernetes-model/model"
 )
 
+// DeletedFinalStateUnknown is handed to SyncHandler.Delete in place of the
+// object when a resync finds that an object Rancher was told about is gone
+// and the DELETED event for it was missed. Obj is the last state sent to
+// Rancher, which may be stale, or nil when the queue sent nothing, like for
+// objects deleted while the agent was down.
+type DeletedFinalStateUnknown struct {
+	Key string
+	Obj interface{}
+}
+
+// DeltaType says how a change reached a SyncHandler. Added, Updated and
+// Deleted changes come from the watch.
+type DeltaType string
+
+const (
+	Added   DeltaType = "ADDED"
+	Updated DeltaType = "MODIFIED"
+	Deleted DeltaType = "DELETED"
+	// Sync is an object found by a list or a resync, which Rancher may or
+	// may not have heard of already
+	Sync DeltaType = "SYNC"
+)
+
+const (
+	maxSyncRetries    = 10
+	syncRetryMaxDelay = 5 * time.Minute
+	resyncListTimeout = 5 * time.Minute
+)
+
+var syncRetryBaseDelay = time.Second
+
+// fifoStats publishes the retry and drop counts of all queues on
+// /debug/vars of the health check port.
+var fifoStats = expvar.NewMap("deltaFIFO")
+
+// DeltaFIFOStats counts the events that failed to sync to Rancher.
+type DeltaFIFOStats struct {
+	// Retries is the number of times a failed event was queued again
+	Retries int64
+	// Dropped is the number of events given up on after maxSyncRetries
+	Dropped int64
+}
+
+// delta is a queued change. handled, when set, tells the informer the change
+// needs no more handling.
+type delta struct {
+	event   model.WatchEvent
+	handled func()
+}
+
+// syncedObject is the last state of an object sent to Rancher, with its
+// resourceVersion.
+type syncedObject struct {
+	obj     interface{}
+	version string
+}
+
 type DeltaFIFO struct {
 	l sync.RWMutex
 	c sync.Cond
 
-	items map[string]model.WatchEvent
+	items map[string]delta
 	queue []string
+	// synced holds the last object successfully sent to Rancher, by key
+	synced map[string]syncedObject
+	// failures counts the consecutive failures of a key, retries holds the
+	// failed events waiting for their backoff to pass
+	failures map[string]int
+	retries  map[string]*delta
+	// dropped holds the handled callbacks of the changes given up on, by
+	// key, until a later change of the object syncs. They hold the
+	// informer's checkpoint back, so a restarted agent sees them again.
+	dropped map[string][]func()
+	stats   DeltaFIFOStats
+	// processing holds the keys a worker is handling, with the handled
+	// callback of their change. They aren't popped again until the worker is
+	// done, so changes to one object are handled one at a time and in order.
+	processing map[string]func()
+	closed     bool
 
-	handler  SyncHandler
-	doneChan chan error
+	handler        SyncHandler
+	informer       *SharedInformer
+	resyncInterval time.Duration
+	workerCount    int
+	workers        sync.WaitGroup
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
-func NewDeltaFIFO(handler SyncHandler, doneChan chan error) *DeltaFIFO {
+// NewDeltaFIFO returns a queue of the changes informer sees, for handler to
+// handle with workerCount workers. The queue is registered with the informer
+// right away, so the informer should be started after. A nil informer
+// queues only what is added. A positive resyncInterval periodically compares
+// the informer's objects with what Rancher was told, to repair changes that
+// were given up on.
+func NewDeltaFIFO(handler SyncHandler, informer *SharedInformer, resyncInterval time.Duration, workerCount int) *DeltaFIFO {
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	dF := &DeltaFIFO{
-		handler:  handler,
-		doneChan: doneChan,
-		items:    map[string]model.WatchEvent{},
-		queue:    []string{},
+		handler:        handler,
+		informer:       informer,
+		resyncInterval: resyncInterval,
+		workerCount:    workerCount,
+		ctx:            ctx,
+		cancel:         cancel,
+		processing:     map[string]func(){},
+		items:          map[string]delta{},
+		queue:          []string{},
+		synced:         map[string]syncedObject{},
+		failures:       map[string]int{},
+		retries:        map[string]*delta{},
+		dropped:        map[string][]func(){},
 	}
 
 	dF.c.L = &dF.l
+	if informer != nil {
+		informer.AddEventHandler("sync", dF.onEvent)
+	}
 	return dF
 }
 
+// onEvent queues a change seen by the informer. The changes of a list are
+// queued as Sync.
+func (d *DeltaFIFO) onEvent(watchEvent kubernetesclient.WatchEvent, listed bool, handled func()) {
+	event, err := toModelEvent(watchEvent)
+	if err != nil {
+		log.Errorf("Error unmarshalling event %v", err)
+		handled()
+		return
+	}
+	if listed && DeltaType(event.Type) != Deleted {
+		event.Type = string(Sync)
+	}
+	if err := d.add(event, handled); err != nil {
+		log.Errorf("Error queueing event %v", err)
+		handled()
+	}
+}
+
+func (d *DeltaFIFO) startWorkers() {
+	for i := 0; i < d.workerCount; i++ {
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			d.startProcessing()
+		}()
+	}
+}
+
+// startProcessing handles events until the queue is shut down.
 func (d *DeltaFIFO) startProcessing() {
 	for {
-		event := d.Pop()
-		resource, err := d.handler.Decode(event)
-		if err != nil {
-			continue
+		key, event, ok := d.Pop()
+		if !ok {
+			return
 		}
-		switch event.Type {
-		case "MODIFIED":
-			fallthrough
-		case "ADDED":
-			err := d.handler.Add(resource)
-			if err != nil {
-				log.Errorf("Error Processing event %v", err)
-				// Push this event back to the end of the queue?
-				continue
-			}
-		case "DELETED":
-			err := d.handler.Delete(resource)
-			if err != nil {
-				log.Errorf("Error Processing event %v", err)
-				// Push this event back to the end of the queue?
-				continue
+		d.process(key, event)
+		d.done(key)
+	}
+}
+
+func (d *DeltaFIFO) process(key string, event model.WatchEvent) {
+	resource, err := d.handler.Decode(event)
+	if err != nil {
+		d.handled(key)
+		return
+	}
+	switch deltaType := DeltaType(event.Type); deltaType {
+	case Added, Updated, Sync:
+		var optedOut bool
+		if optedOut, err = d.handler.OptedOut(resource); err == nil {
+			if optedOut {
+				err = d.removeSynced(key)
+				resource = nil
+			} else {
+				err = d.handler.Add(resource, deltaType)
 			}
 		}
+	case Deleted:
+		err = d.handler.Delete(resource)
+		resource = nil
+	default:
+		d.handled(key)
+		return
 	}
+	if err != nil {
+		log.Errorf("Error Processing event %v", err)
+		d.requeue(key, event)
+		return
+	}
+	d.setSynced(key, resource, eventResourceVersion(event))
+	d.handled(key)
 }
 
-//thread safe add
-func (d *DeltaFIFO) Add(event model.WatchEvent) error {
+// handled tells the informer that the change a worker is processing for key
+// needs no more handling.
+func (d *DeltaFIFO) handled(key string) {
+	d.l.Lock()
+	handled := d.takeHandled(key)
+	d.l.Unlock()
+	call(handled)
+}
+
+// takeHandled returns the handled callback of the change being processed
+// for key, so that it is only called once. The caller must hold the lock.
+func (d *DeltaFIFO) takeHandled(key string) func() {
+	handled, ok := d.processing[key]
+	if ok {
+		d.processing[key] = nil
+	}
+	return handled
+}
+
+// removeSynced removes an object that opted out of syncing from Rancher, if
+// Rancher was told about it.
+func (d *DeltaFIFO) removeSynced(key string) error {
+	d.l.RLock()
+	synced, ok := d.synced[key]
+	d.l.RUnlock()
+	if !ok {
+		return nil
+	}
+	log.Infof("Object %s opted out of syncing, removing it from Rancher", key)
+	return d.handler.Delete(synced.obj)
+}
+
+// setSynced records what Rancher now knows about the object, nil meaning
+// nothing, and forgets its failures. The changes of it that were dropped are
+// made up for, so the informer is told they need no more handling.
+func (d *DeltaFIFO) setSynced(key string, resource interface{}, version string) {
+	d.l.Lock()
+	delete(d.failures, key)
+	dropped := d.dropped[key]
+	delete(d.dropped, key)
+	if resource == nil {
+		delete(d.synced, key)
+	} else {
+		d.synced[key] = syncedObject{obj: resource, version: version}
+	}
+	d.l.Unlock()
+	for _, handled := range dropped {
+		call(handled)
+	}
+}
+
+// eventResourceVersion returns the resourceVersion of the object of an
+// event, if it has one.
+func eventResourceVersion(event model.WatchEvent) string {
+	obj, _ := event.Object.(map[string]interface{})
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	version, _ := metadata["resourceVersion"].(string)
+	return version
+}
+
+// requeue queues a failed event again once its key's backoff has passed. A
+// newer event for the key, queued before or during the backoff, supersedes
+// the retry. Keys that keep failing are dropped after maxSyncRetries, but
+// the informer isn't told the change was handled until a later change of the
+// object syncs.
+func (d *DeltaFIFO) requeue(key string, event model.WatchEvent) {
+	d.l.Lock()
+	handled := d.takeHandled(key)
+	if _, queued := d.items[key]; queued {
+		d.l.Unlock()
+		call(handled)
+		return
+	}
+
+	d.failures[key]++
+	failures := d.failures[key]
+	if failures > maxSyncRetries {
+		log.Errorf("Dropping %s event for %s after %d failed attempts, it is handled again after a restart unless a later change syncs first", event.Type, key, failures)
+		delete(d.failures, key)
+		if handled != nil {
+			d.dropped[key] = append(d.dropped[key], handled)
+		}
+		d.stats.Dropped++
+		fifoStats.Add("dropped", 1)
+		d.l.Unlock()
+		return
+	}
+	d.stats.Retries++
+	fifoStats.Add("retries", 1)
+
+	delay := syncRetryDelay(failures)
+	log.Infof("Retrying %s event for %s in %v", event.Type, key, delay)
+	retry := &delta{event: event, handled: handled}
+	d.retries[key] = retry
+	d.l.Unlock()
+	time.AfterFunc(delay, func() {
+		d.l.Lock()
+		defer d.l.Unlock()
+		if d.retries[key] != retry {
+			return
+		}
+		delete(d.retries, key)
+		d.enqueue(key, *retry)
+	})
+}
+
+// call calls handled, if set.
+func call(handled func()) {
+	if handled != nil {
+		handled()
+	}
+}
+
+// syncRetryDelay doubles with every failure, up to syncRetryMaxDelay.
+func syncRetryDelay(failures int) time.Duration {
+	delay := syncRetryBaseDelay << uint(failures-1)
+	if delay > syncRetryMaxDelay || delay <= 0 {
+		delay = syncRetryMaxDelay
+	}
+	return delay
+}
+
+// Stats returns the retry and drop counts of this queue.
+func (d *DeltaFIFO) Stats() DeltaFIFOStats {
 	d.l.Lock()
 	defer d.l.Unlock()
+	return d.stats
+}
+
+// pending reports whether a change for key is queued, being processed or
+// waiting to be retried. The caller must hold the lock.
+func (d *DeltaFIFO) pending(key string) bool {
+	_, queued := d.items[key]
+	_, processing := d.processing[key]
+	_, retrying := d.retries[key]
+	return queued || processing || retrying
+}
+
+//thread safe add
+func (d *DeltaFIFO) Add(event model.WatchEvent) error {
+	return d.add(event, nil)
+}
+
+// add queues event, which supersedes the changes queued or waiting to be
+// retried for its key. Their handled callbacks are called, since the newer
+// change is handled in their place.
+func (d *DeltaFIFO) add(event model.WatchEvent, handled func()) error {
 	key, err := d.handler.GetKey(event)
 	if err != nil {
 		return err
 	}
+	d.l.Lock()
+	var superseded []func()
+	if retry, ok := d.retries[key]; ok {
+		superseded = append(superseded, retry.handled)
+		delete(d.retries, key)
+	}
+	if queued, ok := d.items[key]; ok {
+		superseded = append(superseded, queued.handled)
+	}
+	d.enqueue(key, delta{event: event, handled: handled})
+	d.l.Unlock()
+	for _, handled := range superseded {
+		call(handled)
+	}
+	return nil
+}
+
+// enqueue must be called with the lock held.
+func (d *DeltaFIFO) enqueue(key string, item delta) {
 	if _, ok := d.items[key]; !ok {
 		d.queue = append(d.queue, key)
 	}
-	d.items[key] = event
+	d.items[key] = item
 	d.c.Broadcast()
-	return nil
 }
 
-//blocks until a value is available
-func (d *DeltaFIFO) Pop() model.WatchEvent {
+// Pop blocks until an event for a key that no other worker is handling is
+// available, and marks the key as being processed until done is called. ok
+// is false once the queue is shut down.
+func (d *DeltaFIFO) Pop() (key string, event model.WatchEvent, ok bool) {
 	d.l.Lock()
 	defer d.l.Unlock()
-	if len(d.queue) == 0 {
+	for {
+		if d.closed {
+			return "", model.WatchEvent{}, false
+		}
+		for i, key := range d.queue {
+			if _, busy := d.processing[key]; busy {
+				continue
+			}
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			item := d.items[key]
+			delete(d.items, key)
+			d.processing[key] = item.handled
+			return key, item.event, true
+		}
 		d.c.Wait()
 	}
-	key := d.queue[0]
-	d.queue = d.queue[1:]
-	val, ok := d.items[key]
-	delete(d.items, key)
-	if !ok {
-		return model.WatchEvent{}
-	}
-	return val
 }
 
-func (d *DeltaFIFO) Process() {
-	listURL := d.handler.GetListURL()
-	watchURL := d.handler.GetWatchURL()
+// done releases a key popped by Pop, letting its next event through.
+func (d *DeltaFIFO) done(key string) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	delete(d.processing, key)
+	d.c.Broadcast()
+}
 
-	go d.startProcessing()
+// Shutdown stops the resyncs and waits for the workers to finish the events
+// they are handling. Events still queued are dropped.
+func (d *DeltaFIFO) Shutdown() {
+	d.l.Lock()
+	d.closed = true
+	d.c.Broadcast()
+	d.l.Unlock()
 
-	go func(done chan error) {
-		wait := 1
-		dialer := &websocket.Dialer{
-			TLSClientConfig: kubernetesclient.GetTLSClientConfig(),
-		}
-		headers := http.Header{}
-		headers.Add("Origin", "http://kubernetes-agent")
-		headers.Add("Authorization", kubernetesclient.GetAuthorizationHeader())
-
-		var err error
-		var ws *websocket.Conn
-
-		for {
-			ws, _, err = dialer.Dial(watchURL, headers)
-			if err != nil {
-				if wait > 16 {
-					d.doneChan <- fmt.Errorf("Error connecting to %s. Giving up. Err: %v", watchURL, err)
-					return
-				}
-				wait = wait * 2
-				time.Sleep(time.Second * time.Duration(wait))
-				continue
-			}
-			break
-		}
-		for {
-			_, msg, err := ws.ReadMessage()
-			if err != nil {
-				d.doneChan <- fmt.Errorf("Error reading ws message %v", err)
-				return
-			}
-			var event model.WatchEvent
-			err = json.Unmarshal(msg, &event)
-			if err != nil {
-				d.doneChan <- fmt.Errorf("Error unmarshalling event %v", err)
-				return
-			}
-			d.Add(event)
-		}
-	}(d.doneChan)
+	d.cancel()
+	d.workers.Wait()
+}
 
-	listClient := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: kubernetesclient.GetTLSClientConfig(),
-		},
-	}
-	req, err := http.NewRequest("GET", listURL, nil)
-	if err != nil {
-		log.Errorf("Error creating list request %v", err)
-		d.doneChan <- err
-		return
+// Process handles the queued changes, and resyncs them every resyncInterval,
+// until Shutdown.
+func (d *DeltaFIFO) Process() {
+	d.startWorkers()
+	if d.resyncInterval > 0 {
+		go d.resyncLoop()
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", kubernetesclient.GetAuthorizationHeader())
+	<-d.ctx.Done()
+}
 
-	resp, err := listClient.Do(req)
-	if err != nil {
-		log.Errorf("Error requesting for list of objects %v", err)
-		d.doneChan <- err
-		return
+func (d *DeltaFIFO) resyncLoop() {
+	ticker := time.NewTicker(d.resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		d.resync()
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode >= 300 {
-		log.Errorf("Couldn't retrieve list of objects, status code: %d", resp.StatusCode)
-		d.doneChan <- fmt.Errorf("Couldn't retrieve list of objects, status code: %d", resp.StatusCode)
+// resync lists the informer's objects again and compares them with what
+// Rancher has, which differ when a change was given up on after
+// maxSyncRetries or an object was deleted while the agent was down. Listed
+// objects Rancher never heard of or has an older version of are queued as
+// Sync. Objects Rancher has, as the handler tells from Rancher itself, that
+// are neither listed nor in the store are queued as DELETED with a
+// DeletedFinalStateUnknown tombstone. When the scope leaves out some objects,
+// only the objects this queue synced are tombstoned, since Rancher's others
+// may be out of scope. Keys with a change queued, being processed or waiting
+// to be retried are left to that change, and so are objects the watch
+// changed since the list. Objects that opted out of syncing are queued too,
+// and processing them removes them from Rancher if needed.
+//
+// No change is delivered while the list is compared, so a change can't land
+// between reading the store and queueing what's missing.
+func (d *DeltaFIFO) resync() {
+	if d.informer == nil {
 		return
 	}
-	byteContent, err := ioutil.ReadAll(resp.Body)
+	ctx, cancel := context.WithTimeout(d.ctx, resyncListTimeout)
+	defer cancel()
+	objs, err := d.informer.List(ctx)
 	if err != nil {
-		log.Errorf("Error decoding response %v", err)
-		d.doneChan <- fmt.Errorf("Error decoding response %v", err)
+		log.Errorf("Error listing %s to resync, skipping it: %v", d.informer.resource.GroupVersionResource(), err)
 		return
 	}
-
-	eventObj := map[string]interface{}{}
-	err = json.Unmarshal(byteContent, &eventObj)
+	published, err := d.handler.Published()
 	if err != nil {
-		log.Errorf("Error unmarshalling json %v", err)
-		d.doneChan <- fmt.Errorf("Error unmarshalling json %v", err)
+		log.Errorf("Error reading what Rancher has to resync, skipping it: %v", err)
 		return
 	}
 
-	items, ok := eventObj["items"].([]interface{})
-	if ok {
-		for _, obj := range items {
-			var event model.WatchEvent
-			event.Object = obj.(map[string]interface{})
-			event.Type = "ADDED"
-			d.Add(event)
+	d.informer.paused(func() {
+		store := d.informer.Store()
+		listed := map[string]bool{}
+		current := map[string]model.WatchEvent{}
+		versions := map[string]string{}
+		for _, obj := range objs {
+			key, event, ok := d.resyncEvent(obj)
+			if !ok {
+				continue
+			}
+			listed[key] = true
+			if stored, ok := store.Get(obj.GetNamespace(), obj.GetName()); !ok || stored.GetResourceVersion() != obj.GetResourceVersion() {
+				// The watch's change is handled instead
+				continue
+			}
+			current[key] = event
+			versions[key] = obj.GetResourceVersion()
 		}
-	}
+		stored := map[string]bool{}
+		for _, obj := range store.List() {
+			if key, _, ok := d.resyncEvent(obj); ok {
+				stored[key] = true
+			}
+		}
+
+		d.l.Lock()
+		rancher := map[string]bool{}
+		for key := range d.synced {
+			rancher[key] = true
+		}
+		if !d.informer.scope.narrows(d.informer.resource.GroupVersionResource()) {
+			for _, key := range published {
+				rancher[key] = true
+			}
+		}
+		var missing []model.WatchEvent
+		for key := range rancher {
+			if listed[key] || stored[key] || d.pending(key) {
+				continue
+			}
+			log.Infof("Object %s was deleted but Rancher wasn't told, removing it", key)
+			var obj interface{}
+			if synced, ok := d.synced[key]; ok {
+				obj = synced.obj
+			}
+			missing = append(missing, model.WatchEvent{
+				Type:   string(Deleted),
+				Object: DeletedFinalStateUnknown{Key: key, Obj: obj},
+			})
+		}
+		for key, event := range current {
+			if synced, ok := d.synced[key]; (ok && synced.version == versions[key]) || d.pending(key) {
+				continue
+			}
+			missing = append(missing, event)
+		}
+		d.l.Unlock()
 
+		for _, event := range missing {
+			if err := d.Add(event); err != nil {
+				log.Errorf("Error queueing resync event %v", err)
+			}
+		}
+	})
+}
+
+// resyncEvent returns the Sync event of obj and its key.
+func (d *DeltaFIFO) resyncEvent(obj *kubernetesclient.Unstructured) (string, model.WatchEvent, bool) {
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: string(Sync), Object: obj})
+	if err != nil {
+		log.Errorf("Error unmarshalling resync event %v", err)
+		return "", event, false
+	}
+	key, err := d.handler.GetKey(event)
+	if err != nil {
+		return "", event, false
+	}
+	return key, event, true
 }
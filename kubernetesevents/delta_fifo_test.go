@@ -0,0 +1,775 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/v2"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+func newTestServiceHandler(listed ...string) (*serviceHandler, chan client.ExternalServiceEvent, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := ""
+		for i, uid := range listed {
+			if i > 0 {
+				items += ","
+			}
+			items += testService(uid, "1")
+		}
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, items)
+	}))
+	events := make(chan client.ExternalServiceEvent, 10)
+	rClient := &client.RancherClient{
+		Service:              &MockServiceOperations{},
+		ExternalServiceEvent: &MockServiceEventOperations{events: events},
+	}
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	handler := &serviceHandler{
+		rClient:   rClient,
+		kClient:   kClient,
+		informers: cachedNamespaces(kClient, "default"),
+		published: newPublishedCache(),
+	}
+	return handler, events, server.Close
+}
+
+// cachedNamespaces returns informers whose namespace store holds names, as
+// if the namespace informer had listed them.
+func cachedNamespaces(kClient *kubernetesclient.Client, names ...string) *SharedInformerFactory {
+	informers := NewSharedInformerFactory(kClient, nil, nil)
+	store := informers.ForResource(kubernetesclient.NamespaceResource, false).Store()
+	for _, name := range names {
+		store.Add(&kubernetesclient.Unstructured{Object: map[string]interface{}{
+			"kind":     "Namespace",
+			"metadata": map[string]interface{}{"name": name, "uid": "ns-" + name},
+		}})
+	}
+	return informers
+}
+
+func serviceEvent(t *testing.T, eventType string, uid string) model.WatchEvent {
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: eventType, Object: unstructuredService(t, uid)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func unstructuredService(t *testing.T, uid string) *kubernetesclient.Unstructured {
+	obj := &kubernetesclient.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(testService(uid, "1"))); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func nextEvent(t *testing.T, events chan client.ExternalServiceEvent) client.ExternalServiceEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event to be sent to Rancher")
+	}
+	return client.ExternalServiceEvent{}
+}
+
+// waitForSynced waits until Rancher is known to have exactly keys.
+func waitForSynced(t *testing.T, fifo *DeltaFIFO, keys ...string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		fifo.l.Lock()
+		synced := len(fifo.synced) == len(keys)
+		for _, key := range keys {
+			if _, ok := fifo.synced[key]; !ok {
+				synced = false
+			}
+		}
+		fifo.l.Unlock()
+		if synced {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %v to be synced", keys)
+}
+
+// newTestInformer returns an informer of services that is never run, whose
+// changes are delivered by the test.
+func newTestInformer(handler *serviceHandler) *SharedInformer {
+	return NewSharedInformer(handler.kClient.Resource(kubernetesclient.ServiceResource), true, nil, nil)
+}
+
+// listServer lists the services it holds, by UID.
+type listServer struct {
+	sync.Mutex
+	services map[string]string
+}
+
+func (l *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+	var items []string
+	for _, service := range l.services {
+		items = append(items, service)
+	}
+	fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, strings.Join(items, ","))
+}
+
+func (l *listServer) set(uid string, service string) {
+	l.Lock()
+	defer l.Unlock()
+	if service == "" {
+		delete(l.services, uid)
+	} else {
+		l.services[uid] = service
+	}
+}
+
+func TestResyncFindsMissedChanges(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	cluster := &listServer{services: map[string]string{}}
+	server := httptest.NewServer(cluster)
+	defer server.Close()
+	handler.kClient = kubernetesclient.NewClient(server.URL, false)
+	// Rancher has d, which was deleted while the agent was down
+	handler.rClient.Service = &MockServiceOperations{services: []client.Service{
+		{Kind: kubernetesServiceKind, ExternalId: "d"},
+	}}
+
+	informer := newTestInformer(handler)
+	fifo := NewDeltaFIFO(handler, informer, 0, 1)
+	go fifo.startProcessing()
+
+	for _, uid := range []string{"a", "b"} {
+		cluster.set(uid, testService(uid, "1"))
+		informer.deliver(kubernetesclient.WatchEvent{Type: "ADDED", Object: unstructuredService(t, uid)}, false, false, "", nil)
+	}
+	sent := map[string]string{}
+	for i := 0; i < 2; i++ {
+		event := nextEvent(t, events)
+		sent[event.ExternalId] = event.EventType
+	}
+	if sent["a"] != "service.create" || sent["b"] != "service.create" {
+		t.Fatalf("Unexpected events %v", sent)
+	}
+	waitForSynced(t, fifo, "a", "b")
+
+	// The changes to a, b and c were given up on
+	modified := unstructuredService(t, "a")
+	modified.SetResourceVersion("2")
+	modified.Object["spec"].(map[string]interface{})["clusterIP"] = "10.43.0.2"
+	data, err := modified.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.set("a", string(data))
+	cluster.set("b", "")
+	cluster.set("c", testService("c", "1"))
+	informer.Store().Add(modified)
+	informer.Store().Delete(unstructuredService(t, "b"))
+	informer.Store().Add(unstructuredService(t, "c"))
+	fifo.resync()
+	sent = map[string]string{}
+	for i := 0; i < 4; i++ {
+		event := nextEvent(t, events)
+		sent[event.ExternalId] = event.EventType
+	}
+	if sent["a"] != "service.update" || sent["b"] != "service.remove" || sent["c"] != "service.create" || sent["d"] != "service.remove" {
+		t.Errorf("Unexpected events after resync %v", sent)
+	}
+	waitForSynced(t, fifo, "a", "c")
+
+	// Nothing changed since, so another resync sends nothing
+	fifo.resync()
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResyncLeavesWatchedChanges(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	cluster := &listServer{services: map[string]string{"a": testService("a", "1")}}
+	server := httptest.NewServer(cluster)
+	defer server.Close()
+	handler.kClient = kubernetesclient.NewClient(server.URL, false)
+	informer := newTestInformer(handler)
+	fifo := NewDeltaFIFO(handler, informer, 0, 1)
+
+	// The watch already delivered a newer a, and b is gone from the list
+	// but not yet from the store
+	newer := unstructuredService(t, "a")
+	newer.SetResourceVersion("2")
+	informer.Store().Add(newer)
+	informer.Store().Add(unstructuredService(t, "b"))
+	fifo.synced["b"] = syncedObject{version: "1"}
+	fifo.resync()
+	fifo.l.Lock()
+	queued := len(fifo.queue)
+	fifo.l.Unlock()
+	if queued != 0 {
+		t.Errorf("Expected the resync to leave the watch's changes alone, got %d queued", queued)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	default:
+	}
+}
+
+// racingHandler delivers a change the first time a resync asks for the key of
+// an object, after the resync read the store and before it compares it.
+type racingHandler struct {
+	*serviceHandler
+	once sync.Once
+	race func()
+}
+
+func (h *racingHandler) GetKey(event model.WatchEvent) (string, error) {
+	if DeltaType(event.Type) == Sync {
+		h.once.Do(func() {
+			go h.race()
+			time.Sleep(100 * time.Millisecond)
+		})
+	}
+	return h.serviceHandler.GetKey(event)
+}
+
+func TestResyncLeavesChangesInFlight(t *testing.T) {
+	// The resync lists c alone
+	handler, _, stop := newTestServiceHandler("c")
+	defer stop()
+	// Rancher takes its time with every event
+	events := make(chan client.ExternalServiceEvent)
+	handler.rClient = &client.RancherClient{
+		Service:              &MockServiceOperations{},
+		ExternalServiceEvent: &MockServiceEventOperations{events: events},
+	}
+
+	informer := newTestInformer(handler)
+	racing := &racingHandler{serviceHandler: handler}
+	fifo := NewDeltaFIFO(racing, informer, 0, 1)
+	go fifo.startProcessing()
+
+	for _, uid := range []string{"a", "c"} {
+		informer.deliver(kubernetesclient.WatchEvent{Type: "ADDED", Object: unstructuredService(t, uid)}, false, false, "", nil)
+		if event := nextEvent(t, events); event.EventType != "service.create" || event.ExternalId != uid {
+			t.Fatalf("Unexpected event %s %s", event.EventType, event.ExternalId)
+		}
+	}
+	waitForSynced(t, fifo, "a", "c")
+
+	// a is deleted and Rancher is still being told when the resync runs
+	informer.deliver(kubernetesclient.WatchEvent{Type: "DELETED", Object: unstructuredService(t, "a")}, false, false, "", nil)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		fifo.l.Lock()
+		_, processing := fifo.processing["a"]
+		fifo.l.Unlock()
+		if processing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the deletion of a to be processed")
+		}
+	}
+	// b is added while the resync compares the store
+	racing.race = func() {
+		informer.deliver(kubernetesclient.WatchEvent{Type: "ADDED", Object: unstructuredService(t, "b")}, false, false, "", nil)
+	}
+	resynced := make(chan struct{})
+	go func() {
+		fifo.resync()
+		close(resynced)
+	}()
+
+	sent := []string{}
+	for {
+		select {
+		case event := <-events:
+			sent = append(sent, event.EventType+" "+event.ExternalId)
+			continue
+		case <-time.After(300 * time.Millisecond):
+		}
+		break
+	}
+	<-resynced
+	if fmt.Sprint(sent) != "[service.remove a service.create b]" {
+		t.Errorf("Expected a to be removed and b created once, got %v", sent)
+	}
+}
+
+func TestTombstoneKey(t *testing.T) {
+	handler, _, stop := newTestServiceHandler()
+	defer stop()
+
+	tombstone := DeletedFinalStateUnknown{Key: "b", Obj: nil}
+	key, err := handler.GetKey(model.WatchEvent{Type: "DELETED", Object: tombstone})
+	if err != nil || key != "b" {
+		t.Errorf("Expected the tombstone key, got %s %v", key, err)
+	}
+}
+
+// flakyServiceEventOperations fails the first failures events sent to it.
+type flakyServiceEventOperations struct {
+	client.ExternalServiceEventClient
+	sync.Mutex
+	failures int
+	attempts int
+	events   chan<- client.ExternalServiceEvent
+}
+
+func (m *flakyServiceEventOperations) Create(event *client.ExternalServiceEvent) (*client.ExternalServiceEvent, error) {
+	m.Lock()
+	m.attempts++
+	fail := m.attempts <= m.failures
+	m.Unlock()
+	if fail {
+		return nil, fmt.Errorf("Cattle is unavailable")
+	}
+	m.events <- *event
+	return nil, nil
+}
+
+func withFastRetries() func() {
+	old := syncRetryBaseDelay
+	syncRetryBaseDelay = time.Millisecond
+	return func() {
+		syncRetryBaseDelay = old
+	}
+}
+
+func TestFailedEventsAreRetried(t *testing.T) {
+	defer withFastRetries()()
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	handler.rClient.ExternalServiceEvent = &flakyServiceEventOperations{failures: 3, events: events}
+
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+	go fifo.startProcessing()
+
+	fifo.Add(serviceEvent(t, "ADDED", "a"))
+	if event := nextEvent(t, events); event.ExternalId != "a" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	waitForSynced(t, fifo, "a")
+	if stats := fifo.Stats(); stats.Retries != 3 || stats.Dropped != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestFailingEventsAreDropped(t *testing.T) {
+	defer withFastRetries()()
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	flaky := &flakyServiceEventOperations{failures: 1000, events: events}
+	handler.rClient.ExternalServiceEvent = flaky
+
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+	go fifo.startProcessing()
+
+	handled := make(chan string, 2)
+	fifo.add(serviceEvent(t, "ADDED", "a"), func() { handled <- "ADDED" })
+	for deadline := time.Now().Add(5 * time.Second); fifo.Stats().Dropped == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the event to be dropped")
+		}
+	}
+	flaky.Lock()
+	if flaky.attempts != maxSyncRetries+1 {
+		t.Errorf("Expected %d attempts, got %d", maxSyncRetries+1, flaky.attempts)
+	}
+	flaky.failures = 0
+	flaky.Unlock()
+	if stats := fifo.Stats(); stats.Retries != maxSyncRetries {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// The dropped change holds the checkpoint back until a later one syncs
+	select {
+	case change := <-handled:
+		t.Fatalf("Expected the dropped %s to stay unhandled", change)
+	default:
+	}
+	fifo.add(serviceEvent(t, "MODIFIED", "a"), func() { handled <- "MODIFIED" })
+	nextEvent(t, events)
+	var changes []string
+	for len(changes) < 2 {
+		select {
+		case change := <-handled:
+			changes = append(changes, change)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the changes to be handled, got %v", changes)
+		}
+	}
+	sort.Strings(changes)
+	if fmt.Sprint(changes) != "[ADDED MODIFIED]" {
+		t.Errorf("Expected both changes to be handled, got %v", changes)
+	}
+}
+
+func TestNewerEventSupersedesRetry(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	handler.rClient.ExternalServiceEvent = &flakyServiceEventOperations{failures: 1, events: events}
+
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+	go fifo.startProcessing()
+
+	// The first attempt fails and is retried after a second, but the
+	// deletion that arrives meanwhile replaces it
+	fifo.Add(serviceEvent(t, "ADDED", "a"))
+	for deadline := time.Now().Add(5 * time.Second); fifo.Stats().Retries == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the retry")
+		}
+	}
+	fifo.Add(serviceEvent(t, "DELETED", "a"))
+	if event := nextEvent(t, events); event.EventType != "service.remove" {
+		t.Errorf("Expected the deletion, got %+v", event)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("The superseded retry was sent %+v", event)
+	case <-time.After(syncRetryBaseDelay + 200*time.Millisecond):
+	}
+}
+
+// blockingSyncHandler records the order events are handled in and holds
+// each one until it is released.
+type blockingSyncHandler struct {
+	sync.Mutex
+	active  map[string]int
+	handled []string
+	started chan string
+	release chan struct{}
+	overlap bool
+}
+
+func (h *blockingSyncHandler) handle(obj interface{}) error {
+	event := obj.(map[string]interface{})
+	key := event["key"].(string)
+	h.Lock()
+	h.active[key]++
+	if h.active[key] > 1 {
+		h.overlap = true
+	}
+	h.Unlock()
+
+	h.started <- key
+	<-h.release
+
+	h.Lock()
+	h.active[key]--
+	h.handled = append(h.handled, fmt.Sprintf("%s%v", key, event["n"]))
+	h.Unlock()
+	return nil
+}
+
+func (h *blockingSyncHandler) Add(obj interface{}, deltaType DeltaType) error { return h.handle(obj) }
+func (h *blockingSyncHandler) Delete(obj interface{}) error                   { return h.handle(obj) }
+func (h *blockingSyncHandler) Decode(event model.WatchEvent) (interface{}, error) {
+	return event.Object, nil
+}
+func (h *blockingSyncHandler) OptedOut(obj interface{}) (bool, error)        { return false, nil }
+func (h *blockingSyncHandler) Resource() kubernetesclient.ResourceOperations { return nil }
+func (h *blockingSyncHandler) Published() ([]string, error)                  { return nil, nil }
+func (h *blockingSyncHandler) GetKey(event model.WatchEvent) (string, error) {
+	return event.Object.(map[string]interface{})["key"].(string), nil
+}
+
+func keyEvent(key string, n int) model.WatchEvent {
+	return model.WatchEvent{Type: "MODIFIED", Object: map[string]interface{}{"key": key, "n": n}}
+}
+
+func TestWorkersKeepPerKeyOrder(t *testing.T) {
+	handler := &blockingSyncHandler{
+		active:  map[string]int{},
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+	fifo := NewDeltaFIFO(handler, nil, 0, 3)
+	fifo.startWorkers()
+
+	fifo.Add(keyEvent("a", 1))
+	if key := <-handler.started; key != "a" {
+		t.Fatalf("Expected a to start, got %s", key)
+	}
+	// a is busy, so its next change waits while b goes to another worker
+	fifo.Add(keyEvent("a", 2))
+	fifo.Add(keyEvent("b", 1))
+	select {
+	case key := <-handler.started:
+		if key != "b" {
+			t.Fatalf("Expected b to start while a is busy, got %s", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b was held up by a")
+	}
+	select {
+	case key := <-handler.started:
+		t.Fatalf("%s started while a was still being handled", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for i := 0; i < 3; i++ {
+		handler.release <- struct{}{}
+		if i < 1 {
+			<-handler.started
+		}
+	}
+
+	fifo.Shutdown()
+	handler.Lock()
+	defer handler.Unlock()
+	if handler.overlap {
+		t.Error("Events for one key were handled concurrently")
+	}
+	positions := map[string]int{}
+	for i, handled := range handler.handled {
+		positions[handled] = i
+	}
+	if len(handler.handled) != 3 || positions["a1"] > positions["a2"] {
+		t.Errorf("Unexpected order %v", handler.handled)
+	}
+}
+
+func TestShutdownStopsWaitingWorkers(t *testing.T) {
+	handler := &blockingSyncHandler{active: map[string]int{}}
+	fifo := NewDeltaFIFO(handler, nil, 0, 4)
+	fifo.startWorkers()
+
+	done := make(chan struct{})
+	go func() {
+		fifo.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't stop the idle workers")
+	}
+	if _, _, ok := fifo.Pop(); ok {
+		t.Error("Expected Pop to fail after Shutdown")
+	}
+}
+
+func portEvent(t *testing.T, deltaType DeltaType, uid string, port int) model.WatchEvent {
+	obj := unstructuredService(t, uid)
+	obj.Object["spec"].(map[string]interface{})["ports"] = []interface{}{map[string]interface{}{"port": port}}
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: string(deltaType), Object: obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestServiceEventTypes(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+
+	steps := []serviceEventStep{
+		// The initial list
+		{Sync, "a", 80, "service.create"},
+		{Sync, "b", 80, "service.create"},
+		{Updated, "a", 8080, "service.update"},
+		{Updated, "a", 8080, ""},
+		// A relist after the watch expired reports known services again
+		{Sync, "a", 9090, "service.update"},
+		{Sync, "b", 80, ""},
+		{Deleted, "b", 80, "service.remove"},
+		{Added, "c", 80, "service.create"},
+		// Rancher never heard of d, so it can't be updated
+		{Updated, "d", 80, "service.create"},
+		// Nor of a once it's removed
+		{Deleted, "a", 9090, "service.remove"},
+		{Sync, "a", 9090, "service.create"},
+	}
+	expectSteps(t, fifo, events, steps)
+
+	// After a restart, Rancher's services are updated and the others created
+	restarted := &serviceHandler{
+		rClient: &client.RancherClient{
+			Service: &MockServiceOperations{services: []client.Service{
+				{Kind: kubernetesServiceKind, ExternalId: "c"},
+				{Kind: kubernetesServiceKind, ExternalId: "d"},
+				{Kind: kubernetesServiceKind, ExternalId: "b", Removed: "2017-01-01T00:00:00Z"},
+			}},
+			ExternalServiceEvent: &MockServiceEventOperations{events: events},
+		},
+		kClient:   handler.kClient,
+		informers: handler.informers,
+		published: newPublishedCache(),
+	}
+	expectSteps(t, NewDeltaFIFO(restarted, nil, 0, 1), events, []serviceEventStep{
+		{Sync, "c", 80, "service.update"},
+		{Updated, "d", 8080, "service.update"},
+		{Sync, "b", 80, "service.create"},
+		{Sync, "e", 80, "service.create"},
+		{Sync, "c", 80, ""},
+		{Deleted, "d", 8080, "service.remove"},
+		{Sync, "d", 8080, "service.create"},
+	})
+}
+
+func TestInvalidSelectorIsLeftOut(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+
+	obj := unstructuredService(t, "a")
+	obj.Object["spec"].(map[string]interface{})["selector"] = map[string]interface{}{"app": "web", "replicas": 3}
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: string(Added), Object: obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fifo.process("a", event)
+
+	sent := nextEvent(t, events)
+	if sent.EventType != "service.create" {
+		t.Fatalf("Expected the service to be created, got %s", sent.EventType)
+	}
+	if service := sent.Service.(client.Service); service.SelectorContainer != "" || service.Name != "svc-a" {
+		t.Errorf("Expected the service without its selector, got %+v", service)
+	}
+	waitForSynced(t, fifo, "a")
+}
+
+func TestCheckpointedDeletionIsSent(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: string(Deleted), Object: checkpointedObject("a", "1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := handler.GetKey(event)
+	if err != nil {
+		t.Fatalf("Expected a service known only by UID to have a key, got %v", err)
+	}
+	fifo.process(key, event)
+	if sent := nextEvent(t, events); sent.EventType != "service.remove" || sent.ExternalId != "a" {
+		t.Errorf("Expected a to be removed, got %s of %s", sent.EventType, sent.ExternalId)
+	}
+}
+
+type serviceEventStep struct {
+	deltaType DeltaType
+	uid       string
+	port      int
+	expected  string
+}
+
+// expectSteps processes the changes of steps in order and checks the event
+// each sends Rancher, if any.
+func expectSteps(t *testing.T, fifo *DeltaFIFO, events chan client.ExternalServiceEvent, steps []serviceEventStep) {
+	for i, step := range steps {
+		fifo.process(step.uid, portEvent(t, step.deltaType, step.uid, step.port))
+
+		sent := ""
+		select {
+		case event := <-events:
+			if event.ExternalId != step.uid {
+				t.Errorf("Step %d: expected an event for %s, got %s", i, step.uid, event.ExternalId)
+			}
+			sent = event.EventType
+		default:
+		}
+		if sent != step.expected {
+			t.Errorf("Step %d: expected %s of %s to send %q, got %q", i, step.deltaType, step.uid, step.expected, sent)
+		}
+	}
+}
+
+// deltaRecordingHandler records the deltas handed to a service handler.
+type deltaRecordingHandler struct {
+	*serviceHandler
+	deltas chan string
+}
+
+func (h *deltaRecordingHandler) Add(obj interface{}, deltaType DeltaType) error {
+	h.deltas <- string(deltaType) + " " + obj.(model.Service).Metadata.Uid
+	return h.serviceHandler.Add(obj, deltaType)
+}
+
+func (h *deltaRecordingHandler) Delete(obj interface{}) error {
+	h.deltas <- string(Deleted) + " " + obj.(model.Service).Metadata.Uid
+	return h.serviceHandler.Delete(obj)
+}
+
+func TestDeltaTypesAcrossRelist(t *testing.T) {
+	// Lists a and b, sees a change, and finds c added and b deleted when it
+	// has to list again. The change waits for the list to be handled, so it
+	// doesn't supersede a's listed state in the queue.
+	fake := &fakeWatchServer{listHandled: make(chan struct{})}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	service, events, stop := newTestServiceHandler()
+	defer stop()
+	service.kClient = kubernetesclient.NewClient(server.URL, false)
+	handler := &deltaRecordingHandler{serviceHandler: service, deltas: make(chan string, 10)}
+	informers := NewSharedInformerFactory(service.kClient, nil, nil)
+	fifo := NewDeltaFIFO(handler, informers.ForResource(kubernetesclient.ServiceResource, true), 0, 1)
+	go fifo.Process()
+	defer fifo.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx)
+
+	var deltas, sent []string
+	for len(deltas) < 5 || len(sent) < 4 {
+		select {
+		case delta := <-handler.deltas:
+			deltas = append(deltas, delta)
+			if len(deltas) == 2 {
+				close(fake.listHandled)
+			}
+		case event := <-events:
+			sent = append(sent, event.EventType+" "+event.ExternalId)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out, got deltas %v and events %v", deltas, sent)
+		}
+	}
+
+	// The order of listed objects is random
+	expectedDeltas := [][]string{
+		{"SYNC a", "SYNC b"},
+		{"MODIFIED a"},
+		{"DELETED b", "SYNC c"},
+	}
+	// a's change is to its resourceVersion only, so Rancher isn't told
+	expectedSent := [][]string{
+		{"service.create a", "service.create b"},
+		{"service.create c", "service.remove b"},
+	}
+	check := func(name string, got []string, expected [][]string) {
+		for _, group := range expected {
+			if len(got) < len(group) {
+				t.Errorf("Expected %s %v, got %v", name, expected, got)
+				return
+			}
+			sorted := append([]string{}, got[:len(group)]...)
+			sort.Strings(sorted)
+			if fmt.Sprint(sorted) != fmt.Sprint(group) {
+				t.Errorf("Expected %s %v, got %v", name, expected, got)
+				return
+			}
+			got = got[len(group):]
+		}
+	}
+	check("deltas", deltas, expectedDeltas)
+	check("events", sent, expectedSent)
+}
@@ -1,7 +1,6 @@
 package kubernetesevents
 
 import (
-	"bytes"
 	"fmt"
 	"strings"
 
@@ -10,6 +9,7 @@ import (
 
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-agent/selector"
 	"github.com/rancher/kubernetes-model/model"
 )
 
@@ -19,11 +19,14 @@ const eventTypePrefix string = "service."
 const NamespaceKind string = "namespaces"
 const namespaceEventTypePrefix string = "stack."
 
-func NewHandler(rancherClient *client.RancherClient, kubernetesClient *kubernetesclient.Client, kindHandled string) *GenericHandler {
+func NewHandler(rancherClient *client.RancherClient, kubernetesClient *kubernetesclient.Client, informers *SharedInformerFactory, kindHandled string) *GenericHandler {
 	return &GenericHandler{
 		rancherClient: rancherClient,
 		kClient:       kubernetesClient,
+		informers:     informers,
 		kindHandled:   kindHandled,
+		optOuts:       newOptOutTracker(),
+		published:     newPublishedCache(),
 	}
 }
 
@@ -31,7 +34,10 @@ func NewHandler(rancherClient *client.RancherClient, kubernetesClient *kubernete
 type GenericHandler struct {
 	rancherClient *client.RancherClient
 	kClient       *kubernetesclient.Client
+	informers     *SharedInformerFactory
 	kindHandled   string
+	optOuts       *optOutTracker
+	published     *publishedCache
 }
 
 func (h *GenericHandler) GetKindHandled() string {
@@ -51,25 +57,26 @@ func (h *GenericHandler) Handle(event model.WatchEvent) error {
 		if h.kindHandled == ServiceKind {
 			var svc model.Service
 			mapstructure.Decode(i, &svc)
-			if svc == (model.Service{}) || svc.Spec == nil {
+			// Objects deleted while the agent was down are only known by
+			// UID
+			if svc.Metadata == nil || (svc.Spec == nil && event.Type != "DELETED") {
 				log.Infof("Couldn't decode %+v to service.", i)
 				return nil
 			}
 			kind = svc.Kind
-			selector = svc.Spec.Selector
 			metadata = svc.Metadata
 			eventPrefix = eventTypePrefix
-			if selector != nil {
-				selector["io.kubernetes.pod.namespace"] = metadata.Namespace
+			if svc.Spec != nil {
+				selector = svc.Spec.Selector
+				if selector != nil {
+					selector["io.kubernetes.pod.namespace"] = metadata.Namespace
+				}
+				clusterIp = svc.Spec.ClusterIP
 			}
-			clusterIp = svc.Spec.ClusterIP
 		} else if h.kindHandled == NamespaceKind {
-			if event.Type != "DELETED" {
-				return nil
-			}
 			var ns model.Namespace
 			mapstructure.Decode(i, &ns)
-			if ns == (model.Namespace{}) || ns.Spec == nil {
+			if ns.Metadata == nil || (ns.Spec == nil && event.Type != "DELETED") {
 				log.Infof("Couldn't decode %+v to namespace.", i)
 				return nil
 			}
@@ -86,9 +93,24 @@ func (h *GenericHandler) Handle(event model.WatchEvent) error {
 			return fmt.Errorf("Unrecognized handled kind [%s].", h.kindHandled)
 		}
 
+		optOut := optedOut(metadata)
+		if h.kindHandled == ServiceKind && event.Type != "DELETED" {
+			var err error
+			if optOut, err = objectOptedOut(h.informers, metadata); err != nil {
+				return err
+			}
+		}
+		event.Type = h.optOuts.eventType(metadata.Uid, optOut, event.Type)
+		if h.kindHandled == NamespaceKind && event.Type != "DELETED" {
+			// Stacks are created along with the services in them, which
+			// come back with the next resync when a namespace opts back in
+			return nil
+		}
+
 		serviceEvent.ExternalId = prefix + metadata.Uid
 		serviceEvent.EventType = constructEventType(eventPrefix, event)
 
+		var hash string
 		switch event.Type {
 		case "MODIFIED":
 			fallthrough
@@ -98,6 +120,12 @@ func (h *GenericHandler) Handle(event model.WatchEvent) error {
 			if err != nil {
 				return err
 			}
+			if hash, err = publishedHash(serviceEvent, i); err != nil {
+				return err
+			}
+			if h.published.unchanged(metadata.Uid, hash) {
+				return nil
+			}
 
 		case "DELETED":
 			service := client.Service{
@@ -108,25 +136,21 @@ func (h *GenericHandler) Handle(event model.WatchEvent) error {
 			return nil
 		}
 
-		_, err := h.rancherClient.ExternalServiceEvent.Create(serviceEvent)
-		return err
-
+		if _, err := h.rancherClient.ExternalServiceEvent.Create(serviceEvent); err != nil {
+			return err
+		}
+		if event.Type == "DELETED" {
+			h.published.forget(metadata.Uid)
+		} else {
+			h.published.set(metadata.Uid, hash)
+		}
+		return nil
 	}
 	return fmt.Errorf("Couldn't decode event [%#v]", event)
 }
 
 func (h *GenericHandler) add(selectorMap map[string]interface{}, metadata *model.ObjectMeta, clusterIp string, event model.WatchEvent, serviceEvent *client.ExternalServiceEvent, kind string) error {
-	var buffer bytes.Buffer
-	for key, v := range selectorMap {
-		if val, ok := v.(string); ok {
-			buffer.WriteString(key)
-			buffer.WriteString("=")
-			buffer.WriteString(val)
-			buffer.WriteString(",")
-		}
-	}
-	selector := buffer.String()
-	selector = strings.TrimSuffix(selector, ",")
+	selector := encodeSelector(selectorMap, metadata)
 
 	fields := map[string]interface{}{"template": event.Object}
 	data := map[string]interface{}{"fields": fields}
@@ -153,7 +177,7 @@ func (h *GenericHandler) add(selectorMap map[string]interface{}, metadata *model
 		env["name"] = metadata.Namespace
 		env["externalId"] = "kubernetes://" + metadata.Namespace
 	} else {
-		namespace, err := h.kClient.Namespace.ByName(metadata.Namespace)
+		namespace, err := getNamespace(h.informers, metadata.Namespace)
 		if err != nil {
 			return err
 		}
@@ -167,6 +191,32 @@ func (h *GenericHandler) add(selectorMap map[string]interface{}, metadata *model
 	return nil
 }
 
+// encodeSelector encodes a service's spec.selector for Rancher's
+// SelectorContainer. A selector Rancher couldn't parse back is logged and
+// left out, since it won't get any better by retrying, and the rest of the
+// service is still sent.
+func encodeSelector(selectorMap map[string]interface{}, metadata *model.ObjectMeta) string {
+	s, err := selector.FromMap(selectorMap)
+	if err != nil {
+		log.Warnf("Sending service %s/%s without its selector, which can't be encoded: %v", metadata.Namespace, metadata.Name, err)
+		return ""
+	}
+	return s.String()
+}
+
+// publishedHash hashes what Rancher reads from a service event: the service
+// fields and environment set by add and the spec of the template, but not
+// the status or metadata the template carries along.
+func publishedHash(serviceEvent *client.ExternalServiceEvent, obj map[string]interface{}) (string, error) {
+	service, _ := serviceEvent.Service.(client.Service)
+	service.Data = nil
+	return payloadHash(map[string]interface{}{
+		"service":     service,
+		"environment": serviceEvent.Environment,
+		"spec":        obj["spec"],
+	})
+}
+
 func constructEventType(eventPrefix string, event model.WatchEvent) string {
 	switch strings.ToLower(event.Type) {
 	case "added":
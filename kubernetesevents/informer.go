@@ -0,0 +1,479 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+// Names of the indexes every Store keeps
+const (
+	NamespaceIndex = "namespace"
+	LabelIndex     = "label"
+	UIDIndex       = "uid"
+)
+
+// IndexFunc returns the values an object is indexed under.
+type IndexFunc func(obj *kubernetesclient.Unstructured) []string
+
+var DefaultIndexers = map[string]IndexFunc{
+	NamespaceIndex: func(obj *kubernetesclient.Unstructured) []string {
+		return []string{obj.GetNamespace()}
+	},
+	LabelIndex: func(obj *kubernetesclient.Unstructured) []string {
+		var values []string
+		for key, value := range obj.GetLabels() {
+			values = append(values, LabelIndexValue(key, value))
+		}
+		return values
+	},
+	UIDIndex: func(obj *kubernetesclient.Unstructured) []string {
+		return []string{obj.GetUID()}
+	},
+}
+
+// LabelIndexValue is the value to look up objects with a label by in
+// LabelIndex.
+func LabelIndexValue(key, value string) string {
+	return key + "=" + value
+}
+
+// StoreKey is the key of an object in a Store. Cluster scoped objects are
+// keyed by name alone.
+func StoreKey(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// Store is a thread safe local copy of a resource's objects. The objects it
+// returns are shared and must be copied with DeepCopy before modifying them.
+type Store struct {
+	sync.RWMutex
+	indexers map[string]IndexFunc
+	items    map[string]*kubernetesclient.Unstructured
+	// indices maps index name to indexed value to the keys of the objects
+	indices map[string]map[string]map[string]bool
+}
+
+func NewStore(indexers map[string]IndexFunc) *Store {
+	s := &Store{
+		indexers: indexers,
+		items:    map[string]*kubernetesclient.Unstructured{},
+		indices:  map[string]map[string]map[string]bool{},
+	}
+	for name := range indexers {
+		s.indices[name] = map[string]map[string]bool{}
+	}
+	return s
+}
+
+// Add adds obj or replaces the object with the same namespace and name.
+func (s *Store) Add(obj *kubernetesclient.Unstructured) {
+	s.Lock()
+	defer s.Unlock()
+	key := StoreKey(obj.GetNamespace(), obj.GetName())
+	if old, ok := s.items[key]; ok {
+		s.unindex(key, old)
+	}
+	s.items[key] = obj
+	s.index(key, obj)
+}
+
+// Delete removes the object with obj's namespace and name, or with its UID
+// when it has no name, like the objects known only from a checkpoint.
+func (s *Store) Delete(obj *kubernetesclient.Unstructured) {
+	s.Lock()
+	defer s.Unlock()
+	keys := map[string]bool{StoreKey(obj.GetNamespace(), obj.GetName()): true}
+	if obj.GetName() == "" {
+		keys = s.indices[UIDIndex][obj.GetUID()]
+	}
+	for key := range keys {
+		if old, ok := s.items[key]; ok {
+			s.unindex(key, old)
+			delete(s.items, key)
+		}
+	}
+}
+
+func (s *Store) Get(namespace, name string) (*kubernetesclient.Unstructured, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	obj, ok := s.items[StoreKey(namespace, name)]
+	return obj, ok
+}
+
+func (s *Store) List() []*kubernetesclient.Unstructured {
+	s.RLock()
+	defer s.RUnlock()
+	objs := make([]*kubernetesclient.Unstructured, 0, len(s.items))
+	for _, obj := range s.items {
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+// ByIndex returns the objects indexed under value by the named index.
+func (s *Store) ByIndex(indexName, value string) []*kubernetesclient.Unstructured {
+	s.RLock()
+	defer s.RUnlock()
+	keys := s.indices[indexName][value]
+	objs := make([]*kubernetesclient.Unstructured, 0, len(keys))
+	for key := range keys {
+		objs = append(objs, s.items[key])
+	}
+	return objs
+}
+
+func (s *Store) index(key string, obj *kubernetesclient.Unstructured) {
+	for name, indexFunc := range s.indexers {
+		for _, value := range indexFunc(obj) {
+			keys, ok := s.indices[name][value]
+			if !ok {
+				keys = map[string]bool{}
+				s.indices[name][value] = keys
+			}
+			keys[key] = true
+		}
+	}
+}
+
+func (s *Store) unindex(key string, obj *kubernetesclient.Unstructured) {
+	for name, indexFunc := range s.indexers {
+		for _, value := range indexFunc(obj) {
+			keys := s.indices[name][value]
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(s.indices[name], value)
+			}
+		}
+	}
+}
+
+// EventHandler is handed every change to an informer's objects. listed is
+// set for the changes found by a list, which come in no particular order.
+// handled must be called once the change needs no more handling, so the
+// informer's checkpoint can move past it. Handlers are called one change at
+// a time and must not block.
+type EventHandler func(event kubernetesclient.WatchEvent, listed bool, handled func())
+
+type namedHandler struct {
+	name    string
+	handler EventHandler
+}
+
+// SharedInformer keeps a Store of a resource current with a single list and
+// watch per watched namespace, and passes every change on to the handlers
+// registered with it. Once it has handlers its watches resume from and
+// advance a checkpoint, which only moves past a change after every handler
+// handled it.
+type SharedInformer struct {
+	resource    kubernetesclient.ResourceOperations
+	namespaced  bool
+	scope       *Scope
+	checkpoints *Checkpoints
+	store       *Store
+
+	// deliverLock is held while a change is applied to the store and handed
+	// to the handlers
+	deliverLock sync.Mutex
+
+	lock     sync.Mutex
+	handlers []namedHandler
+	running  bool
+	synced   chan struct{}
+	unsynced int
+}
+
+// NewSharedInformer returns an informer of the objects of resource in scope.
+// Namespaced resources are watched namespace by namespace when the scope
+// allows it.
+func NewSharedInformer(resource kubernetesclient.ResourceOperations, namespaced bool, scope *Scope, checkpoints *Checkpoints) *SharedInformer {
+	if scope == nil {
+		scope = &Scope{}
+	}
+	return &SharedInformer{
+		resource:    resource,
+		namespaced:  namespaced,
+		scope:       scope,
+		checkpoints: checkpoints,
+		store:       NewStore(DefaultIndexers),
+		synced:      make(chan struct{}),
+	}
+}
+
+func (i *SharedInformer) Store() *Store {
+	return i.store
+}
+
+// AddEventHandler registers handler for the changes received from now on
+// under name, which tells apart the checkpoints of informers with different
+// handlers. Handlers have to be registered before Run to see every object.
+// The store already reflects a change when the handler is called, or holds a
+// newer version of the object while a resumed informer's watch catches up
+// with the list that filled it.
+func (i *SharedInformer) AddEventHandler(name string, handler EventHandler) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.running {
+		log.Warnf("Handler %s of %s registered after the informer started, it only sees changes from now on", name, i.resource.GroupVersionResource())
+	}
+	i.handlers = append(i.handlers, namedHandler{name: name, handler: handler})
+}
+
+// Run fills the store and keeps it current until ctx is done.
+func (i *SharedInformer) Run(ctx context.Context) error {
+	resources := i.scope.resources(i.resource, i.namespaced)
+	i.lock.Lock()
+	i.running = true
+	i.unsynced = len(resources)
+	names := make([]string, 0, len(i.handlers))
+	for _, handler := range i.handlers {
+		names = append(names, handler.name)
+	}
+	i.lock.Unlock()
+
+	errs := make(chan error, len(resources))
+	for _, resource := range resources {
+		reflector := i.newReflector(resource, names)
+		go func() {
+			errs <- reflector.Run(ctx)
+		}()
+	}
+	var err error
+	for range resources {
+		err = <-errs
+	}
+	return err
+}
+
+// List lists the objects in scope from the API server, bypassing the store.
+func (i *SharedInformer) List(ctx context.Context) ([]*kubernetesclient.Unstructured, error) {
+	var objs []*kubernetesclient.Unstructured
+	for _, resource := range i.scope.resources(i.resource, i.namespaced) {
+		gvr := resource.GroupVersionResource()
+		list, err := resource.ListContext(ctx, kubernetesclient.ListOptions{
+			LabelSelector: i.scope.LabelSelector(gvr),
+			Limit:         reflectorListPageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for j := range list.Items {
+			if obj := &list.Items[j]; i.scope.Includes(gvr, obj) {
+				objs = append(objs, obj)
+			}
+		}
+	}
+	return objs, nil
+}
+
+// newReflector returns a reflector of resource feeding the store and the
+// handlers. With handlers and checkpoints it resumes from its checkpoint and
+// advances it as the handlers finish the changes.
+func (i *SharedInformer) newReflector(resource kubernetesclient.ResourceOperations, handlers []string) *Reflector {
+	var name string
+	var tracker *versionTracker
+	if i.checkpoints != nil && len(handlers) > 0 {
+		name = checkpointName(resource, handlers)
+		tracker = &versionTracker{}
+	}
+
+	var reflector *Reflector
+	reflector = i.scope.newReflector(resource, func(event kubernetesclient.WatchEvent) {
+		i.deliver(event, reflector.listing, reflector.replaying, name, tracker)
+	})
+	var syncOnce sync.Once
+	gvr := resource.GroupVersionResource()
+	reflector.onFill = func(objs []*kubernetesclient.Unstructured) {
+		i.paused(func() {
+			for _, obj := range objs {
+				if i.scope.Includes(gvr, obj) {
+					i.store.Add(obj)
+				}
+			}
+		})
+		syncOnce.Do(i.listed)
+	}
+	reflector.onSync = func() {
+		// The events of a list are all tracked before the list's version,
+		// so the checkpoint reaches it once they're handled
+		if tracker != nil {
+			version, objects := tracker.mark(reflector.resourceVersion)
+			i.checkpoints.advance(name, version, objects)
+		}
+		syncOnce.Do(i.listed)
+	}
+	if tracker != nil {
+		i.checkpoints.resume(reflector, name)
+	}
+	return reflector
+}
+
+// deliver applies event to the store, unless the store already holds a newer
+// version of the object, and hands it to the handlers.
+func (i *SharedInformer) deliver(event kubernetesclient.WatchEvent, listed bool, stale bool, name string, tracker *versionTracker) {
+	i.deliverLock.Lock()
+	defer i.deliverLock.Unlock()
+	switch {
+	case stale:
+	case event.Type == kubernetesclient.EventDeleted:
+		i.store.Delete(event.Object)
+	default:
+		i.store.Add(event.Object)
+	}
+
+	i.lock.Lock()
+	handlers := i.handlers
+	i.lock.Unlock()
+	var tracked *trackedVersion
+	if tracker != nil {
+		tracked = tracker.add(event, listed, len(handlers))
+	}
+	for _, handler := range handlers {
+		var once sync.Once
+		handler.handler(event, listed, func() {
+			once.Do(func() {
+				if tracked != nil {
+					version, objects := tracker.complete(tracked)
+					i.checkpoints.advance(name, version, objects)
+				}
+			})
+		})
+	}
+}
+
+// paused calls f while no change is delivered, so the store f reads holds
+// exactly the changes the handlers were handed.
+func (i *SharedInformer) paused(f func()) {
+	i.deliverLock.Lock()
+	defer i.deliverLock.Unlock()
+	f()
+}
+
+// listed counts down the watches that completed their first list.
+func (i *SharedInformer) listed() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.unsynced--
+	if i.unsynced == 0 {
+		close(i.synced)
+	}
+}
+
+// HasSynced reports whether the store holds a complete list. An informer
+// that resumed from its checkpoint lists once to fill the store before it
+// watches from the checkpoint.
+func (i *SharedInformer) HasSynced() bool {
+	select {
+	case <-i.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForSync blocks until the store holds a complete list or ctx is done.
+func (i *SharedInformer) WaitForSync(ctx context.Context) error {
+	select {
+	case <-i.synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SharedInformerFactory hands out one SharedInformer per resource, so every
+// part of the agent reads the same cache and the API server sees a single
+// watch per resource and namespace.
+type SharedInformerFactory struct {
+	client      *kubernetesclient.Client
+	scope       *Scope
+	checkpoints *Checkpoints
+
+	lock      sync.Mutex
+	informers map[kubernetesclient.GroupVersionResource]*SharedInformer
+	ctx       context.Context
+}
+
+// NewSharedInformerFactory returns a factory of informers of the objects in
+// scope, a nil scope meaning everything, whose watches resume from
+// checkpoints, if any.
+func NewSharedInformerFactory(client *kubernetesclient.Client, scope *Scope, checkpoints *Checkpoints) *SharedInformerFactory {
+	return &SharedInformerFactory{
+		client:      client,
+		scope:       scope,
+		checkpoints: checkpoints,
+		informers:   map[kubernetesclient.GroupVersionResource]*SharedInformer{},
+	}
+}
+
+// ForResource returns the informer of a resource. namespaced says whether
+// the resource's objects live in namespaces, and is only looked at by the
+// first call for a resource. Informers asked for after Start are started
+// right away.
+func (f *SharedInformerFactory) ForResource(gvr kubernetesclient.GroupVersionResource, namespaced bool) *SharedInformer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	informer, ok := f.informers[gvr]
+	if !ok {
+		informer = NewSharedInformer(f.client.Resource(gvr), namespaced, f.scope, f.checkpoints)
+		f.informers[gvr] = informer
+		if f.ctx != nil {
+			go informer.Run(f.ctx)
+		}
+	}
+	return informer
+}
+
+// Start runs every informer until ctx is done.
+func (f *SharedInformerFactory) Start(ctx context.Context) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.ctx != nil {
+		return
+	}
+	f.ctx = ctx
+	for _, informer := range f.informers {
+		go informer.Run(ctx)
+	}
+}
+
+// WaitForSync blocks until every informer holds a complete list or ctx is
+// done.
+func (f *SharedInformerFactory) WaitForSync(ctx context.Context) error {
+	f.lock.Lock()
+	informers := make([]*SharedInformer, 0, len(f.informers))
+	for _, informer := range f.informers {
+		informers = append(informers, informer)
+	}
+	f.lock.Unlock()
+	for _, informer := range informers {
+		if err := informer.WaitForSync(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNamespace reads a namespace from the shared namespace informer. A
+// namespace it hasn't seen, like the new namespace of a service whose event
+// overtook the namespace's, is an error, so the change is retried.
+func getNamespace(informers *SharedInformerFactory, name string) (*model.Namespace, error) {
+	if informers != nil {
+		store := informers.ForResource(kubernetesclient.NamespaceResource, false).Store()
+		if obj, ok := store.Get("", name); ok {
+			namespace := &model.Namespace{}
+			err := convert(obj, namespace)
+			return namespace, err
+		}
+	}
+	return nil, fmt.Errorf("Namespace %s isn't in the cache", name)
+}
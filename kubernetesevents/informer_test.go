@@ -0,0 +1,265 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+func unstructuredObject(t *testing.T, data string) *kubernetesclient.Unstructured {
+	obj := &kubernetesclient.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func storeNames(objs []*kubernetesclient.Unstructured) []string {
+	var names []string
+	for _, obj := range objs {
+		names = append(names, obj.GetName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStoreIndexes(t *testing.T) {
+	store := NewStore(DefaultIndexers)
+	store.Add(unstructuredObject(t, `{"metadata": {"name": "a", "namespace": "ns1", "uid": "1", "labels": {"app": "web"}}}`))
+	store.Add(unstructuredObject(t, `{"metadata": {"name": "b", "namespace": "ns1", "uid": "2", "labels": {"app": "db"}}}`))
+	store.Add(unstructuredObject(t, `{"metadata": {"name": "c", "namespace": "ns2", "uid": "3", "labels": {"app": "web"}}}`))
+
+	if names := storeNames(store.ByIndex(NamespaceIndex, "ns1")); fmt.Sprint(names) != "[a b]" {
+		t.Errorf("Unexpected objects in ns1 %v", names)
+	}
+	if names := storeNames(store.ByIndex(LabelIndex, LabelIndexValue("app", "web"))); fmt.Sprint(names) != "[a c]" {
+		t.Errorf("Unexpected objects labelled app=web %v", names)
+	}
+	if names := storeNames(store.ByIndex(UIDIndex, "3")); fmt.Sprint(names) != "[c]" {
+		t.Errorf("Unexpected objects with uid 3 %v", names)
+	}
+
+	// Relabelling moves the object between index values
+	store.Add(unstructuredObject(t, `{"metadata": {"name": "a", "namespace": "ns1", "uid": "1", "labels": {"app": "db"}}}`))
+	if names := storeNames(store.ByIndex(LabelIndex, LabelIndexValue("app", "web"))); fmt.Sprint(names) != "[c]" {
+		t.Errorf("Unexpected objects labelled app=web after update %v", names)
+	}
+	if names := storeNames(store.ByIndex(LabelIndex, LabelIndexValue("app", "db"))); fmt.Sprint(names) != "[a b]" {
+		t.Errorf("Unexpected objects labelled app=db after update %v", names)
+	}
+
+	store.Delete(unstructuredObject(t, `{"metadata": {"name": "b", "namespace": "ns1"}}`))
+	if _, ok := store.Get("ns1", "b"); ok {
+		t.Error("Deleted object is still in the store")
+	}
+	if names := storeNames(store.ByIndex(UIDIndex, "2")); len(names) != 0 {
+		t.Errorf("Deleted object is still indexed %v", names)
+	}
+	if names := storeNames(store.List()); fmt.Sprint(names) != "[a c]" {
+		t.Errorf("Unexpected objects listed %v", names)
+	}
+
+	// Objects known from a checkpoint only have a UID
+	store.Delete(checkpointedObject("3", "5"))
+	if names := storeNames(store.List()); fmt.Sprint(names) != "[a]" {
+		t.Errorf("Unexpected objects listed after deleting by UID %v", names)
+	}
+}
+
+func TestSharedInformerFillsStore(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, testService("a", "1"))
+			return
+		}
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "ADDED", "object": `+testService("b", "11")+`}`))
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	factory := NewSharedInformerFactory(kubernetesclient.NewClient(server.URL, false), nil, nil)
+	informer := factory.ForResource(kubernetesclient.ServiceResource, true)
+	if factory.ForResource(kubernetesclient.ServiceResource, true) != informer {
+		t.Fatal("Expected one informer per resource")
+	}
+	events := make(chan string, 10)
+	informer.AddEventHandler("test", func(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+		defer handled()
+		if _, ok := informer.Store().Get(event.Object.GetNamespace(), event.Object.GetName()); !ok {
+			t.Errorf("Handler called before the store was updated with %s", event.Object.GetName())
+		}
+		events <- event.Type + " " + event.Object.GetUID()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory.Start(ctx)
+	syncCtx, syncCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer syncCancel()
+	if err := factory.WaitForSync(syncCtx); err != nil {
+		t.Fatalf("Informer didn't sync: %v", err)
+	}
+	if !informer.HasSynced() {
+		t.Error("Expected the informer to report it has synced")
+	}
+
+	for _, expected := range []string{"ADDED a", "ADDED b"} {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Errorf("Expected %s, got %s", expected, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", expected)
+		}
+	}
+	if names := storeNames(informer.Store().ByIndex(NamespaceIndex, "default")); fmt.Sprint(names) != "[svc-a svc-b]" {
+		t.Errorf("Unexpected services in the store %v", names)
+	}
+}
+
+func TestCheckpointedStartFillsStores(t *testing.T) {
+	var gets []string
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if r.URL.Path == "/api/v1/services" {
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "MODIFIED", "object": `+testService("a", "11")+`}`))
+			}
+			conn.ReadMessage()
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "20"}, "items": [{"kind": "Namespace", "metadata": {"name": "default", "uid": "ns-1", "resourceVersion": "3"}, "spec": {}}]}`)
+		case "/api/v1/services":
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "20"}, "items": [%s]}`, testService("a", "11"))
+		default:
+			lock.Lock()
+			gets = append(gets, r.URL.Path)
+			lock.Unlock()
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// Both informers resume from checkpoints taken before the restart
+	checkpoints, cleanup := tempCheckpoints(t)
+	defer cleanup()
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	checkpoints.advance(checkpointName(kClient.Resource(kubernetesclient.NamespaceResource), []string{"test"}), "10", map[string]string{"ns-1": "3"})
+	checkpoints.advance(checkpointName(kClient.Resource(kubernetesclient.ServiceResource), []string{"sync"}), "10", map[string]string{"a": "1"})
+
+	informers := NewSharedInformerFactory(kClient, nil, checkpoints)
+	informers.ForResource(kubernetesclient.NamespaceResource, false).AddEventHandler("test", func(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+		handled()
+	})
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+	handler.kClient = kClient
+	handler.informers = informers
+	fifo := NewDeltaFIFO(handler, informers.ForResource(kubernetesclient.ServiceResource, true), 0, 1)
+	go fifo.Process()
+	defer fifo.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx)
+	syncCtx, syncCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer syncCancel()
+	if err := informers.WaitForSync(syncCtx); err != nil {
+		t.Fatalf("Informers didn't sync: %v", err)
+	}
+
+	// The namespace didn't change since the checkpoint, yet the service's
+	// change finds it in the store
+	event := nextEvent(t, events)
+	if env, _ := event.Environment.(map[string]string); event.ExternalId != "a" || env["externalId"] != "kubernetes://ns-1" {
+		t.Errorf("Expected a to be sent in namespace ns-1, got %+v", event)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(gets) != 0 {
+		t.Errorf("Expected nothing to be read outside the informers, got %v", gets)
+	}
+}
+
+// waitForCheckpoint waits until the checkpoint called name is version.
+func waitForCheckpoint(t *testing.T, checkpoints *Checkpoints, name string, version string) {
+	for deadline := time.Now().Add(5 * time.Second); checkpoints.Get(name) != version; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the checkpoint to move to %s, got %q", version, checkpoints.Get(name))
+		}
+	}
+}
+
+func TestInformerCheckpointWaitsForEveryHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, testService("a", "1"))
+			return
+		}
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "MODIFIED", "object": `+testService("a", "11")+`}`))
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	checkpoints, cleanup := tempCheckpoints(t)
+	defer cleanup()
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	factory := NewSharedInformerFactory(kClient, nil, checkpoints)
+	informer := factory.ForResource(kubernetesclient.ServiceResource, true)
+	informer.AddEventHandler("fast", func(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+		handled()
+	})
+	slow := make(chan func(), 10)
+	informer.AddEventHandler("slow", func(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+		slow <- handled
+	})
+	name := checkpointName(kClient.Resource(kubernetesclient.ServiceResource), []string{"slow", "fast"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory.Start(ctx)
+
+	for _, version := range []string{"10", "11"} {
+		var handled func()
+		select {
+		case handled = <-slow:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the change up to %s", version)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if checkpoint := checkpoints.Get(name); checkpoint == version {
+			t.Fatalf("The checkpoint moved to %s before every handler was done", version)
+		}
+		handled()
+		waitForCheckpoint(t, checkpoints, name, version)
+	}
+}
@@ -1,125 +1,179 @@
 package kubernetesevents
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"net/url"
-	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/gorilla/websocket"
 
 	"github.com/rancher/kubernetes-agent/config"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
 	"github.com/rancher/kubernetes-model/model"
 )
 
-var (
-	pathTemplates = []string{
-		"/api/v1/%s",
-		"/apis/extensions/v1beta1/%s",
-		"/apis/batch/v1/%s",
-		"/apis/autoscaling/v1/%s",
-	}
-	waits = []int{0, 1, 2, 4, 8, 16, 0}
-)
+const discoveryTimeout = time.Minute
 
 type Handler interface {
 	Handle(event model.WatchEvent) error
 	GetKindHandled() string
 }
 
-func SyncAndWatchEventStream(handlers []SyncHandler) error {
-	doneChan := make(chan error)
+// SyncAndWatchEventStream syncs the changes to each handler's resource, as
+// seen by its shared informer, to Rancher. The handlers are registered
+// before it returns, so the informers should be started after.
+func SyncAndWatchEventStream(handlers []SyncHandler, informers *SharedInformerFactory, conf config.Config) {
 	for _, handler := range handlers {
-		fifo := NewDeltaFIFO(handler, doneChan)
+		// Sync handlers work on namespaced resources
+		informer := informers.ForResource(handler.Resource().GroupVersionResource(), true)
+		fifo := NewDeltaFIFO(handler, informer, conf.ResyncInterval, conf.WorkerCount)
 		go fifo.Process()
 	}
-	return <-doneChan
 }
 
-func ConnectToEventStream(handlers []Handler, conf config.Config) error {
+// ConnectToEventStream resolves the kind of each handler and hands it every
+// change its shared informer sees. The handlers are registered before it
+// returns, so the informers should be started after. It waits out discovery
+// failures until ctx is done, and only fails sooner for kinds that are
+// unknown or can't be watched.
+func ConnectToEventStream(ctx context.Context, handlers []Handler, informers *SharedInformerFactory, conf config.Config) error {
 	log.Infof("Starting kubernetes event listener configuration: %+v", conf)
-	baseUrl := conf.KubernetesURL
-	baseUrl = strings.Replace(baseUrl, "http", "ws", 1)
 
-	doneChan := make(chan error)
+	// Resolve every kind before connecting so a typo in --watch-kind stops
+	// the agent right away instead of after retrying every API group
+	kClient := config.GetKubernetesClient(conf, false)
+	resources := make([]kubernetesclient.GroupVersionResource, len(handlers))
+	namespaced := make([]bool, len(handlers))
+	for i, handler := range handlers {
+		gvr, resource, err := resolveKind(ctx, kClient.Discovery, handler.GetKindHandled())
+		if err != nil {
+			return err
+		}
+		if !resource.HasVerb("watch") {
+			return fmt.Errorf("Resource [%s] can't be watched", gvr)
+		}
+		log.Infof("Resolved kind [%s] to [%s]", handler.GetKindHandled(), gvr)
+		resources[i] = gvr
+		namespaced[i] = resource.Namespaced
+	}
 
-	for _, handler := range handlers {
-		dialer := &websocket.Dialer{
-			TLSClientConfig: kubernetesclient.GetTLSClientConfig(),
+	for i, handler := range handlers {
+		log.WithFields(log.Fields{"resource": resources[i]}).Info("Connecting to event stream.")
+		queue := newHandlerQueue(handler)
+		informers.ForResource(resources[i], namespaced[i]).AddEventHandler(handlerName(handler), queue.add)
+		go queue.run()
+	}
+	return nil
+}
+
+// resolveKind resolves a --watch-kind through discovery. Only a kind the API
+// server doesn't serve is an error. Discovery failing, like while the API
+// server starts or while a group version is unavailable, is retried with
+// backoff until ctx is done.
+func resolveKind(ctx context.Context, discovery *kubernetesclient.DiscoveryClient, kind string) (kubernetesclient.GroupVersionResource, kubernetesclient.APIResource, error) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+		gvr, resource, err := discovery.ResolveResource(attemptCtx, kind)
+		cancel()
+		if err == nil || kubernetesclient.IsUnknownResource(err) {
+			return gvr, resource, err
 		}
-		headers := http.Header{}
-		headers.Add("Origin", "http://kubernetes-agent")
-		headers.Add("Authorization", kubernetesclient.GetAuthorizationHeader())
-
-	outer:
-		for idx, wait := range waits {
-			for _, template := range pathTemplates {
-				url := buildURL(baseUrl, handler.GetKindHandled(), template)
-				log.WithFields(log.Fields{"url": url}).Info("Connecting to event stream.")
-
-				ws, _, err := dialer.Dial(url, headers)
-				if err != nil {
-					if idx < len(waits)-1 {
-						if idx > 0 {
-							log.Warnf("Error connecting to %s. Try %v of %v. Will wait %v seconds and try again. Error: %#v", url, idx, len(waits), wait, err)
-						}
-						time.Sleep(time.Second * time.Duration(wait))
-						continue
-					} else {
-						log.Error("Failed to connet to %s. Giving up. Error: %#v", url, err)
-						return err
-					}
-				} else {
-					go readMessages(ws, url, doneChan, handler)
-					break outer
-				}
-			}
+		log.Warnf("Error resolving kind [%s], retrying: %v", kind, err)
+		if err := kubernetesclient.Backoff(ctx, attempt); err != nil {
+			return gvr, resource, err
 		}
 	}
+}
 
-	err := <-doneChan
-	return err
+// handlerName tells apart the handlers of one informer, like the namespace
+// handler and the namespaces change handler.
+func handlerName(handler Handler) string {
+	if _, ok := handler.(*ChangeHandler); ok {
+		return "change"
+	}
+	return "events"
 }
 
-func readMessages(ws *websocket.Conn, url string, rc chan<- error, handler Handler) (e error) {
-	defer func() {
-		rc <- e
-	}()
+// maxHandleAttempts bounds the attempts at a change a handlerQueue makes
+// before it moves on.
+const maxHandleAttempts = 3
+
+// handlerQueue hands the changes an informer sees to a Handler one at a time
+// and in order, without holding up the informer's other handlers.
+type handlerQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	handler Handler
+	events  []queuedEvent
+	// failed holds the handled callbacks of the changes given up on, by UID,
+	// until a later change of the object is handled. They hold the
+	// informer's checkpoint back, so a restarted agent sees them again.
+	failed map[string][]func()
+}
 
+type queuedEvent struct {
+	event   kubernetesclient.WatchEvent
+	handled func()
+}
+
+func newHandlerQueue(handler Handler) *handlerQueue {
+	q := &handlerQueue{handler: handler, failed: map[string][]func(){}}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+func (q *handlerQueue) add(event kubernetesclient.WatchEvent, listed bool, handled func()) {
+	q.Lock()
+	defer q.Unlock()
+	q.events = append(q.events, queuedEvent{event: event, handled: handled})
+	q.cond.Signal()
+}
+
+// run handles the queued changes for as long as the agent runs. Changes that
+// fail are retried with backoff up to maxHandleAttempts times, and then left
+// unhandled until a later change of the object is handled.
+func (q *handlerQueue) run() {
 	for {
-		_, msg, err := ws.ReadMessage()
-		if err != nil {
-			return fmt.Errorf("Error reading from websocket for [%v]: %s", url, err)
+		q.Lock()
+		for len(q.events) == 0 {
+			q.cond.Wait()
 		}
-
-		var event model.WatchEvent
-		err = json.Unmarshal(msg, &event)
-		if err != nil {
-			return fmt.Errorf("Error parsing event: %s", err)
+		queued := q.events[0]
+		q.events = q.events[1:]
+		q.Unlock()
+
+		err := q.handle(queued.event)
+		for attempt := 1; err != nil && attempt < maxHandleAttempts; attempt++ {
+			time.Sleep(syncRetryDelay(attempt))
+			err = q.handle(queued.event)
 		}
-		log.Infof("Received event: [%s]", msg)
-
-		err = handler.Handle(event)
+		uid := queued.event.Object.GetUID()
 		if err != nil {
-			log.Errorf("Error handling event: %#v", err)
+			log.Errorf("Giving up on %s event for %s after %d attempts, it is handled again after a restart unless a later change is handled first", queued.event.Type, uid, maxHandleAttempts)
+			q.failed[uid] = append(q.failed[uid], queued.handled)
+			continue
+		}
+		for _, handled := range q.failed[uid] {
+			handled()
 		}
+		delete(q.failed, uid)
+		queued.handled()
 	}
 }
 
-func buildURL(baseUrl, resource, template string) string {
-	u, err := url.Parse(baseUrl)
+// handle hands a change to the handler. Changes that can't be parsed are
+// logged and skipped, since they never will be.
+func (q *handlerQueue) handle(watchEvent kubernetesclient.WatchEvent) error {
+	log.Infof("Received %s event for [%s/%s]", watchEvent.Type, watchEvent.Object.GetNamespace(), watchEvent.Object.GetName())
+	event, err := toModelEvent(watchEvent)
 	if err != nil {
-		// Fatal logging. Will cause program exit
-		log.WithFields(log.Fields{"error": err, "baseUrl": baseUrl}).Fatal("Couldn't parse URL.")
+		log.Errorf("Error parsing event: %v", err)
+		return nil
+	}
+	if err := q.handler.Handle(event); err != nil {
+		log.Errorf("Error handling event: %#v", err)
+		return err
 	}
-	path := fmt.Sprintf(template, resource)
-	u.Path = path
-	q := u.Query()
-	q.Set("watch", "true")
-	u.RawQuery = q.Encode()
-	return u.String()
+	return nil
 }
@@ -1,7 +1,12 @@
 package kubernetesevents
 
 import (
+	"context"
+	"fmt"
 	"gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -42,9 +47,15 @@ func (s *GenerichandlerTestSuite) SetUpSuite(c *check.C) {
 		ExternalServiceEvent: mock,
 	}
 
-	svcHandler := NewHandler(mockRancherClient, s.kClient, ServiceKind)
+	svcHandler := NewHandler(mockRancherClient, s.kClient, nil, ServiceKind)
 	handlers := []Handler{svcHandler}
-	go ConnectToEventStream(handlers, conf)
+	informers := NewSharedInformerFactory(s.kClient, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ConnectToEventStream(ctx, handlers, informers, conf); err != nil {
+		c.Log(err)
+	}
+	informers.Start(context.Background())
 	time.Sleep(time.Second)
 }
 
@@ -101,7 +112,7 @@ func (s *GenerichandlerTestSuite) TestService(c *check.C) {
 					c.Assert(service.Kind, check.Equals, "kubernetesService")
 					c.Assert(service.Name, check.Equals, svcName)
 					c.Assert(service.ExternalId, check.Equals, respSvc.Metadata.Uid)
-					c.Assert(service.SelectorContainer, check.Matches, "foo=bar,env=dev,io.kubernetes.pod.namespace=default|env=dev,foo=bar,io.kubernetes.pod.namespace=default|io.kubernetes.pod.namespace=default,foo=bar,env=dev|io.kubernetes.pod.namespace=default,env=dev,foo=bar|foo=bar,io.kubernetes.pod.namespace=default,env=dev|env=dev,io.kubernetes.pod.namespace=default,foo=bar")
+					c.Assert(service.SelectorContainer, check.Equals, "env=dev,foo=bar,io.kubernetes.pod.namespace=default")
 
 					env := event.Environment.(map[string]string)
 					c.Assert(env["name"], check.Equals, "default")
@@ -115,7 +126,7 @@ func (s *GenerichandlerTestSuite) TestService(c *check.C) {
 					c.Assert(service.Kind, check.Equals, "kubernetesService")
 					c.Assert(service.Name, check.Equals, svcName)
 					c.Assert(service.ExternalId, check.Equals, respSvc.Metadata.Uid)
-					c.Assert(service.SelectorContainer, check.Matches, "env=prod,io.kubernetes.pod.namespace=default|io.kubernetes.pod.namespace=default,env=prod")
+					c.Assert(service.SelectorContainer, check.Equals, "env=prod,io.kubernetes.pod.namespace=default")
 					gotMod = true
 				} else if event.EventType == "service.remove" {
 					gotDelete = true
@@ -147,7 +158,7 @@ func cleanup(client *kubernetesclient.Client, resourceType string, namespace str
 		c.Fatalf("Unknown type for cleanup: %s", resourceType)
 	}
 	if err != nil {
-		if apiError, ok := err.(*kubernetesclient.ApiError); ok && apiError.StatusCode == 404 {
+		if kubernetesclient.IsNotFound(err) {
 			return nil
 		} else {
 			return err
@@ -155,3 +166,99 @@ func cleanup(client *kubernetesclient.Client, resourceType string, namespace str
 	}
 	return nil
 }
+
+func TestResolveKindRetriesDiscoveryErrors(t *testing.T) {
+	var failures int32 = 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.AddInt32(&failures, -1) >= 0:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/api":
+			w.Write([]byte(`{"kind": "APIVersions", "versions": ["v1"]}`))
+		case r.URL.Path == "/apis":
+			w.Write([]byte(`{"kind": "APIGroupList", "groups": []}`))
+		case r.URL.Path == "/api/v1":
+			w.Write([]byte(`{"groupVersion": "v1", "resources": [
+				{"name": "services", "namespaced": true, "kind": "Service", "verbs": ["list", "watch"]}
+			]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	kClient := kubernetesclient.NewClientWithOptions(server.URL, false, kubernetesclient.ClientOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gvr, _, err := resolveKind(ctx, kClient.Discovery, "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvr != kubernetesclient.ServiceResource {
+		t.Errorf("Unexpected resource %+v", gvr)
+	}
+
+	// An unknown kind fails right away
+	_, _, err = resolveKind(ctx, kClient.Discovery, "widgets")
+	if !kubernetesclient.IsUnknownResource(err) {
+		t.Errorf("Expected widgets to be unknown, got %v", err)
+	}
+}
+
+// failingHandler fails the events of the objects in failing.
+type failingHandler struct {
+	failing map[string]bool
+	handled chan string
+}
+
+func (h *failingHandler) Handle(event model.WatchEvent) error {
+	metadata := event.Object.(map[string]interface{})["metadata"].(map[string]interface{})
+	uid := metadata["uid"].(string)
+	if h.failing[uid] {
+		return fmt.Errorf("Cattle is unavailable")
+	}
+	h.handled <- event.Type + " " + uid
+	return nil
+}
+
+func (h *failingHandler) GetKindHandled() string {
+	return ServiceKind
+}
+
+func TestHandlerQueueHoldsFailedChanges(t *testing.T) {
+	defer withFastRetries()()
+	handler := &failingHandler{failing: map[string]bool{"a": true}, handled: make(chan string, 10)}
+	queue := newHandlerQueue(handler)
+	go queue.run()
+
+	acknowledged := make(chan string, 10)
+	add := func(eventType, uid string) {
+		obj := unstructuredService(t, uid)
+		queue.add(kubernetesclient.WatchEvent{Type: eventType, Object: obj}, false, func() {
+			acknowledged <- eventType + " " + uid
+		})
+	}
+	add("ADDED", "a")
+	add("ADDED", "b")
+	if ack := <-acknowledged; ack != "ADDED b" {
+		t.Fatalf("Expected only b to be acknowledged, got %s", ack)
+	}
+
+	// The failed change is acknowledged once a later change of a is handled
+	queue.Lock()
+	handler.failing["a"] = false
+	queue.Unlock()
+	add("MODIFIED", "a")
+	var acks []string
+	for len(acks) < 2 {
+		select {
+		case ack := <-acknowledged:
+			acks = append(acks, ack)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a to be acknowledged, got %v", acks)
+		}
+	}
+	if fmt.Sprint(acks) != "[ADDED a MODIFIED a]" {
+		t.Errorf("Expected both changes of a to be acknowledged, got %v", acks)
+	}
+}
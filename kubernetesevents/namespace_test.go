@@ -1,6 +1,7 @@
 package kubernetesevents
 
 import (
+	"context"
 	"gopkg.in/check.v1"
 	"time"
 
@@ -27,9 +28,15 @@ func (s *NamespacehandlerTestSuite) SetUpSuite(c *check.C) {
 		ExternalServiceEvent: mock,
 	}
 
-	nsHandler := NewHandler(mockRancherClient, s.kClient, NamespaceKind)
+	nsHandler := NewHandler(mockRancherClient, s.kClient, nil, NamespaceKind)
 	handlers := []Handler{nsHandler}
-	go ConnectToEventStream(handlers, conf)
+	informers := NewSharedInformerFactory(s.kClient, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ConnectToEventStream(ctx, handlers, informers, conf); err != nil {
+		c.Log(err)
+	}
+	informers.Start(context.Background())
 	time.Sleep(time.Second)
 }
 
@@ -78,7 +85,7 @@ func cleanup_ns(client *kubernetesclient.Client, resourceType string, namespace
 		c.Fatalf("Unknown type for cleanup: %s", resourceType)
 	}
 	if err != nil {
-		if apiError, ok := err.(*kubernetesclient.ApiError); ok && apiError.StatusCode == 404 {
+		if kubernetesclient.IsNotFound(err) {
 			return nil
 		} else {
 			return err
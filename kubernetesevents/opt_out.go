@@ -0,0 +1,89 @@
+package kubernetesevents
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+// SyncAnnotation set to "false" keeps an object out of Rancher. On a
+// namespace it also keeps out the services in it.
+const SyncAnnotation = "io.rancher.sync"
+
+func optedOut(metadata *model.ObjectMeta) bool {
+	if metadata == nil {
+		return false
+	}
+	value, _ := metadata.Annotations[SyncAnnotation].(string)
+	return value == "false"
+}
+
+// unstructuredOptedOut is optedOut for objects that weren't decoded.
+func unstructuredOptedOut(obj *kubernetesclient.Unstructured) bool {
+	return obj.GetAnnotations()[SyncAnnotation] == "false"
+}
+
+// objectOptedOut reports whether an object or its namespace opted out of
+// syncing. kube-system is never looked up, like when its services are added.
+func objectOptedOut(informers *SharedInformerFactory, metadata *model.ObjectMeta) (bool, error) {
+	if optedOut(metadata) {
+		return true, nil
+	}
+	if metadata == nil || metadata.Namespace == "" || metadata.Namespace == "kube-system" {
+		return false, nil
+	}
+	namespace, err := getNamespace(informers, metadata.Namespace)
+	if err != nil {
+		return false, err
+	}
+	return optedOut(namespace.Metadata), nil
+}
+
+// optOutTracker remembers the objects that opted out of syncing, so that
+// handlers without a record of what Rancher has can turn the annotation
+// coming and going into remove and add events. It lives in memory only, so
+// objects that opted out while the agent was down are left to the
+// Reconciler.
+type optOutTracker struct {
+	sync.Mutex
+	uids map[string]bool
+}
+
+func newOptOutTracker() *optOutTracker {
+	return &optOutTracker{
+		uids: map[string]bool{},
+	}
+}
+
+// eventType returns the type of the event to send Rancher for a change to an
+// object, or "" to send nothing. An object seen opted out for the first time
+// in a MODIFIED event was synced before, so Rancher is told it was removed.
+// An object that opts back in is added again.
+func (t *optOutTracker) eventType(uid string, optedOut bool, eventType string) string {
+	t.Lock()
+	defer t.Unlock()
+	wasOptedOut := t.uids[uid]
+	switch {
+	case eventType == "DELETED":
+		delete(t.uids, uid)
+		if wasOptedOut {
+			return ""
+		}
+		return eventType
+	case optedOut:
+		t.uids[uid] = true
+		if !wasOptedOut && eventType == "MODIFIED" {
+			log.Infof("Object %s opted out of syncing, removing it from Rancher", uid)
+			return "DELETED"
+		}
+		return ""
+	case wasOptedOut:
+		delete(t.uids, uid)
+		log.Infof("Object %s opted back in to syncing, adding it to Rancher", uid)
+		return "ADDED"
+	}
+	return eventType
+}
@@ -0,0 +1,149 @@
+package kubernetesevents
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher/v2"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+func TestOptOutTracker(t *testing.T) {
+	tracker := newOptOutTracker()
+	steps := []struct {
+		eventType string
+		optedOut  bool
+		expected  string
+	}{
+		{"ADDED", false, "ADDED"},
+		{"MODIFIED", false, "MODIFIED"},
+		// Gaining the annotation removes the object from Rancher once
+		{"MODIFIED", true, "DELETED"},
+		{"MODIFIED", true, ""},
+		// Losing it adds the object again
+		{"MODIFIED", false, "ADDED"},
+		{"MODIFIED", true, "DELETED"},
+		// Rancher already forgot an opted out object
+		{"DELETED", true, ""},
+		// Objects that start out opted out are never sent
+		{"ADDED", true, ""},
+		{"MODIFIED", false, "ADDED"},
+		{"DELETED", false, "DELETED"},
+	}
+	for i, step := range steps {
+		if eventType := tracker.eventType("a", step.optedOut, step.eventType); eventType != step.expected {
+			t.Errorf("Step %d: expected %s opted out %v to send %q, got %q", i, step.eventType, step.optedOut, step.expected, eventType)
+		}
+	}
+	if len(tracker.uids) != 0 {
+		t.Errorf("Expected deleted objects to be forgotten, got %v", tracker.uids)
+	}
+}
+
+func optedOutServiceEvent(t *testing.T, eventType string, uid string) model.WatchEvent {
+	obj := unstructuredService(t, uid)
+	obj.SetAnnotations(map[string]string{SyncAnnotation: "false"})
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: eventType, Object: obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestDeltaFIFOOptOut(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+
+	fifo := NewDeltaFIFO(handler, nil, 0, 1)
+	go fifo.startProcessing()
+	defer fifo.Shutdown()
+
+	fifo.Add(serviceEvent(t, "ADDED", "a"))
+	if event := nextEvent(t, events); event.EventType != "service.create" {
+		t.Fatalf("Expected a to be created, got %s", event.EventType)
+	}
+	waitForSynced(t, fifo, "a")
+
+	fifo.Add(optedOutServiceEvent(t, "MODIFIED", "a"))
+	if event := nextEvent(t, events); event.EventType != "service.remove" || event.ExternalId != "a" {
+		t.Fatalf("Expected a to be removed once it opted out, got %s %s", event.EventType, event.ExternalId)
+	}
+	waitForSynced(t, fifo)
+
+	// Opted out objects Rancher doesn't have aren't sent at all
+	fifo.Add(optedOutServiceEvent(t, "ADDED", "b"))
+	fifo.Add(optedOutServiceEvent(t, "MODIFIED", "a"))
+
+	fifo.Add(serviceEvent(t, "MODIFIED", "a"))
+	if event := nextEvent(t, events); event.EventType != "service.create" || event.ExternalId != "a" {
+		t.Fatalf("Expected a to be added again once it opted back in, got %s %s", event.EventType, event.ExternalId)
+	}
+	waitForSynced(t, fifo, "a")
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestServiceInOptedOutNamespace(t *testing.T) {
+	informers := NewSharedInformerFactory(kubernetesclient.NewClient("http://127.0.0.1:1", false), nil, nil)
+	namespaces := informers.ForResource(kubernetesclient.NamespaceResource, false).Store()
+	namespaces.Add(&kubernetesclient.Unstructured{Object: map[string]interface{}{
+		"kind": "Namespace",
+		"metadata": map[string]interface{}{
+			"name":        "canary",
+			"annotations": map[string]interface{}{SyncAnnotation: "false"},
+		},
+	}})
+	namespaces.Add(&kubernetesclient.Unstructured{Object: map[string]interface{}{
+		"kind":     "Namespace",
+		"metadata": map[string]interface{}{"name": "default"},
+	}})
+
+	for namespace, expected := range map[string]bool{"canary": true, "default": false} {
+		optedOut, err := objectOptedOut(informers, &model.ObjectMeta{Name: "web", Namespace: namespace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if optedOut != expected {
+			t.Errorf("Expected a service in %s opted out to be %v", namespace, expected)
+		}
+	}
+}
+
+func TestChangeHandlerHonorsNamespaceOptOut(t *testing.T) {
+	kClient := kubernetesclient.NewClient("http://127.0.0.1:1", false)
+	informers := cachedNamespaces(kClient, "default")
+	namespaces := informers.ForResource(kubernetesclient.NamespaceResource, false).Store()
+	namespaces.Add(&kubernetesclient.Unstructured{Object: map[string]interface{}{
+		"kind": "Namespace",
+		"metadata": map[string]interface{}{
+			"name":        "canary",
+			"annotations": map[string]interface{}{SyncAnnotation: "false"},
+		},
+	}})
+	publish := &MockPublishOperations{}
+	handler := NewChangeHandler(&client.RancherClient{Publish: publish}, kClient, informers, "pods", nil)
+
+	pod := func(namespace string) model.WatchEvent {
+		obj := jsonObject(t, testPod)
+		metadata := obj["metadata"].(map[string]interface{})
+		metadata["namespace"] = namespace
+		metadata["uid"] = "pod-" + namespace
+		return model.WatchEvent{Type: "ADDED", Object: obj}
+	}
+	for namespace, expected := range map[string]bool{"canary": false, "default": true} {
+		before := len(publish.published)
+		if err := handler.Handle(pod(namespace)); err != nil {
+			t.Fatal(err)
+		}
+		if published := len(publish.published) > before; published != expected {
+			t.Errorf("Expected a pod in %s published to be %v", namespace, expected)
+		}
+	}
+	if err := handler.Handle(pod("missing")); err == nil {
+		t.Error("Expected a pod in a namespace that isn't cached yet to be retried")
+	}
+}
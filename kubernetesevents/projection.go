@@ -0,0 +1,351 @@
+package kubernetesevents
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/rancher/kubernetes-agent/config"
+)
+
+// Projection picks the parts of an object published in a
+// service.kubernetes.change event. Paths are JSON pointers, like
+// /metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration.
+// When Include is set only those paths are kept, then Exclude paths are
+// removed. The kind, apiVersion, name, namespace and uid are always kept so
+// Rancher can tell what changed.
+type Projection struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+var DefaultProjection = Projection{
+	Exclude: []string{
+		"/status",
+		"/metadata/managedFields",
+		"/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration",
+	},
+}
+
+// identityPaths are kept by every projection and never truncated.
+var identityPaths = []string{
+	"/kind",
+	"/apiVersion",
+	"/metadata/name",
+	"/metadata/namespace",
+	"/metadata/uid",
+}
+
+// PayloadRules shape the objects published in service.kubernetes.change
+// events. They are read from a YAML file like
+//
+//	default:
+//	  exclude: [/status, /metadata/managedFields]
+//	kinds:
+//	  configmaps:
+//	    exclude: [/status, /data]
+//	  pods:
+//	    include: [/metadata/labels, /spec/nodeName, /status/podIP]
+//
+// where kinds are named as in --watch-kind and replace the default.
+type PayloadRules struct {
+	Default Projection            `yaml:"default"`
+	Kinds   map[string]Projection `yaml:"kinds"`
+	// MaxSize is the largest payload in bytes, 0 for no limit. Larger ones
+	// have their biggest values replaced with truncation markers.
+	MaxSize int `yaml:"-"`
+}
+
+// LoadPayloadRules reads the rules in the agent's projection file, if any,
+// and its payload size limit.
+func LoadPayloadRules(conf config.Config) (*PayloadRules, error) {
+	rules := &PayloadRules{
+		Default: DefaultProjection,
+		MaxSize: conf.ChangeMaxPayloadSize,
+	}
+	if conf.ChangeProjectionFile != "" {
+		data, err := ioutil.ReadFile(conf.ChangeProjectionFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, rules); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", conf.ChangeProjectionFile, err)
+		}
+	}
+
+	projections := []Projection{rules.Default}
+	for _, projection := range rules.Kinds {
+		projections = append(projections, projection)
+	}
+	for _, projection := range projections {
+		for _, pointer := range append(append([]string{}, projection.Include...), projection.Exclude...) {
+			if _, err := parsePointer(pointer); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Projection returns the projection of a kind.
+func (r *PayloadRules) Projection(kind string) Projection {
+	if projection, ok := r.Kinds[kind]; ok {
+		return projection
+	}
+	return r.Default
+}
+
+// apply returns the parts of obj the projection keeps. obj isn't modified.
+func (p Projection) apply(obj map[string]interface{}) map[string]interface{} {
+	projected := obj
+	if len(p.Include) > 0 {
+		projected = map[string]interface{}{}
+		for _, pointer := range append(append([]string{}, identityPaths...), p.Include...) {
+			path, _ := parsePointer(pointer)
+			path = objectPath(obj, path)
+			if value, ok := getPath(obj, path); ok {
+				projected = setPath(projected, path, value, true).(map[string]interface{})
+			}
+		}
+	}
+	for _, pointer := range p.Exclude {
+		path, _ := parsePointer(pointer)
+		if isIdentityPath(path) {
+			continue
+		}
+		if _, ok := getPath(projected, path); ok {
+			projected = removePath(projected, path).(map[string]interface{})
+		}
+	}
+	return projected
+}
+
+// truncate replaces values of obj with markers until it encodes to at most
+// maxSize bytes, picking the smallest value that brings it under the limit
+// or else the biggest one.
+func truncate(obj map[string]interface{}, maxSize int) (map[string]interface{}, []string, error) {
+	var truncated []string
+	for {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		excess := len(data) - maxSize
+		if excess <= 0 {
+			return obj, truncated, nil
+		}
+
+		path, size := pickTruncation(obj, excess)
+		if path == nil || truncationSavings(size) <= 0 {
+			// Nothing left that shrinks by being replaced
+			return obj, truncated, nil
+		}
+		obj = setPath(obj, path, truncationMarker(size), false).(map[string]interface{})
+		truncated = append(truncated, formatPointer(path))
+	}
+}
+
+func truncationMarker(size int) string {
+	return fmt.Sprintf("[truncated %d bytes]", size)
+}
+
+// truncationSavings is how many bytes replacing a value of size encoded bytes
+// with a marker saves.
+func truncationSavings(size int) int {
+	marker, _ := json.Marshal(truncationMarker(size))
+	return size - len(marker)
+}
+
+// pickTruncation returns the path and encoded size of the value to replace:
+// the biggest top level value, or the deepest of the biggest values below it
+// that saves excess bytes on its own. Values holding identity fields are
+// never replaced, the biggest value in them is.
+func pickTruncation(obj map[string]interface{}, excess int) ([]string, int) {
+	key, node, size := biggestChild(obj, nil)
+	if key == "" {
+		return nil, 0
+	}
+	path := []string{key}
+	for {
+		childKey, child, childSize := biggestChild(node, path)
+		if childKey == "" && holdsIdentity(path) {
+			return nil, 0
+		}
+		if childKey == "" || (truncationSavings(childSize) < excess && !holdsIdentity(path)) {
+			return path, size
+		}
+		path = append(path, childKey)
+		node = child
+		size = childSize
+	}
+}
+
+// biggestChild returns the key, value and encoded size of the biggest value
+// in a map or list, skipping the identity fields.
+func biggestChild(node interface{}, path []string) (string, interface{}, int) {
+	bestKey, bestSize := "", 0
+	var best interface{}
+	consider := func(key string, value interface{}) {
+		if isIdentityPath(append(append([]string{}, path...), key)) {
+			return
+		}
+		data, _ := json.Marshal(value)
+		if len(data) > bestSize || (len(data) == bestSize && key < bestKey) {
+			bestKey, best, bestSize = key, value, len(data)
+		}
+	}
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		for key, value := range typed {
+			consider(key, value)
+		}
+	case []interface{}:
+		for i, value := range typed {
+			consider(strconv.Itoa(i), value)
+		}
+	}
+	return bestKey, best, bestSize
+}
+
+// holdsIdentity reports whether an identity field is below path.
+func holdsIdentity(path []string) bool {
+	pointer := formatPointer(path) + "/"
+	for _, identity := range identityPaths {
+		if strings.HasPrefix(identity, pointer) {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdentityPath(path []string) bool {
+	pointer := formatPointer(path)
+	for _, identity := range identityPaths {
+		if pointer == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") || pointer == "/" {
+		return nil, fmt.Errorf("Invalid JSON pointer [%s], expected a path like /metadata/labels", pointer)
+	}
+	path := strings.Split(pointer[1:], "/")
+	for i, segment := range path {
+		path[i] = strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+	}
+	return path, nil
+}
+
+func formatPointer(path []string) string {
+	var buffer bytes.Buffer
+	for _, segment := range path {
+		buffer.WriteString("/")
+		buffer.WriteString(strings.Replace(strings.Replace(segment, "~", "~0", -1), "/", "~1", -1))
+	}
+	return buffer.String()
+}
+
+// objectPath shortens path to end at the first list along it, since only
+// maps can be created to hold included values. Included paths into a list
+// include the whole list.
+func objectPath(node interface{}, path []string) []string {
+	for i, segment := range path {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return path[:i]
+		}
+		node = object[segment]
+	}
+	return path
+}
+
+func getPath(node interface{}, path []string) (interface{}, bool) {
+	for _, segment := range path {
+		switch typed := node.(type) {
+		case map[string]interface{}:
+			value, ok := typed[segment]
+			if !ok {
+				return nil, false
+			}
+			node = value
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(typed) {
+				return nil, false
+			}
+			node = typed[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// setPath returns a copy of node with value at path, copying only the maps
+// and lists along the path. With create, missing maps along the path are
+// created.
+func setPath(node interface{}, path []string, value interface{}, create bool) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typed)+1)
+		for key, child := range typed {
+			copied[key] = child
+		}
+		child, ok := typed[path[0]]
+		if !ok && create {
+			child = map[string]interface{}{}
+		}
+		copied[path[0]] = setPath(child, path[1:], value, create)
+		return copied
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(typed) {
+			return node
+		}
+		copied := append([]interface{}{}, typed...)
+		copied[i] = setPath(typed[i], path[1:], value, create)
+		return copied
+	}
+	return node
+}
+
+// removePath returns a copy of node without the value at path, copying only
+// the maps and lists along the path.
+func removePath(node interface{}, path []string) interface{} {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typed))
+		for key, child := range typed {
+			copied[key] = child
+		}
+		if len(path) == 1 {
+			delete(copied, path[0])
+		} else if child, ok := typed[path[0]]; ok {
+			copied[path[0]] = removePath(child, path[1:])
+		}
+		return copied
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(typed) {
+			return node
+		}
+		if len(path) == 1 {
+			return append(append([]interface{}{}, typed[:i]...), typed[i+1:]...)
+		}
+		copied := append([]interface{}{}, typed...)
+		copied[i] = removePath(typed[i], path[1:])
+		return copied
+	}
+	return node
+}
@@ -0,0 +1,184 @@
+package kubernetesevents
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/v2"
+
+	"github.com/rancher/kubernetes-agent/config"
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+func jsonObject(t *testing.T, data string) map[string]interface{} {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+const testPod = `{
+	"kind": "Pod",
+	"apiVersion": "v1",
+	"metadata": {
+		"name": "web-1",
+		"namespace": "default",
+		"uid": "p1",
+		"resourceVersion": "7",
+		"labels": {"app": "web"},
+		"annotations": {
+			"kubectl.kubernetes.io/last-applied-configuration": "{}",
+			"team": "a"
+		},
+		"managedFields": [{"manager": "kubectl"}]
+	},
+	"spec": {"nodeName": "node-1", "containers": [{"name": "web", "image": "nginx"}]},
+	"status": {"phase": "Running", "podIP": "10.42.0.5"}
+}`
+
+func TestProjections(t *testing.T) {
+	tests := []struct {
+		projection Projection
+		expected   string
+	}{
+		{
+			projection: DefaultProjection,
+			expected: `{
+				"kind": "Pod",
+				"apiVersion": "v1",
+				"metadata": {
+					"name": "web-1",
+					"namespace": "default",
+					"uid": "p1",
+					"resourceVersion": "7",
+					"labels": {"app": "web"},
+					"annotations": {"team": "a"}
+				},
+				"spec": {"nodeName": "node-1", "containers": [{"name": "web", "image": "nginx"}]}
+			}`,
+		},
+		{
+			projection: Projection{
+				Include: []string{"/metadata/labels", "/spec/nodeName", "/spec/containers/0/image", "/status/podIP", "/missing/field"},
+				Exclude: []string{"/metadata/name"},
+			},
+			expected: `{
+				"kind": "Pod",
+				"apiVersion": "v1",
+				"metadata": {"name": "web-1", "namespace": "default", "uid": "p1", "labels": {"app": "web"}},
+				"spec": {"nodeName": "node-1", "containers": [{"name": "web", "image": "nginx"}]},
+				"status": {"podIP": "10.42.0.5"}
+			}`,
+		},
+	}
+	for i, test := range tests {
+		pod := jsonObject(t, testPod)
+		projected := test.projection.apply(pod)
+		if expected := jsonObject(t, test.expected); !reflect.DeepEqual(projected, expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, expected, projected)
+		}
+		if !reflect.DeepEqual(pod, jsonObject(t, testPod)) {
+			t.Errorf("Test %d: projecting modified the object", i)
+		}
+	}
+}
+
+func TestLoadPayloadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "projection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rules.yaml")
+	ioutil.WriteFile(file, []byte(`
+kinds:
+  configmaps:
+    exclude: [/data, /binaryData]
+`), 0600)
+	rules, err := LoadPayloadRules(config.Config{ChangeProjectionFile: file, ChangeMaxPayloadSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.MaxSize != 1024 {
+		t.Errorf("Expected the size limit from the config, got %d", rules.MaxSize)
+	}
+	if !reflect.DeepEqual(rules.Projection("pods"), DefaultProjection) {
+		t.Errorf("Expected the default projection for pods, got %+v", rules.Projection("pods"))
+	}
+	if exclude := rules.Projection("configmaps").Exclude; !reflect.DeepEqual(exclude, []string{"/data", "/binaryData"}) {
+		t.Errorf("Unexpected configmaps exclusions %v", exclude)
+	}
+
+	ioutil.WriteFile(file, []byte(`default: {exclude: [status]}`), 0600)
+	if _, err := LoadPayloadRules(config.Config{ChangeProjectionFile: file}); err == nil {
+		t.Error("Expected a path that isn't a JSON pointer to be rejected")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	configMap := jsonObject(t, `{
+		"kind": "ConfigMap",
+		"metadata": {"name": "big", "namespace": "default", "uid": "c1", "labels": {"app": "web"}},
+		"data": {"small": "x", "large": "`+strings.Repeat("a", 4000)+`", "medium": "`+strings.Repeat("b", 1000)+`"}
+	}`)
+
+	truncated, paths, err := truncate(configMap, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"/data/large"}) {
+		t.Errorf("Expected only the large value to be truncated, got %v", paths)
+	}
+	data, _ := json.Marshal(truncated)
+	if len(data) > 1500 {
+		t.Errorf("Expected at most 1500 bytes, got %d", len(data))
+	}
+	if marker := truncated["data"].(map[string]interface{})["large"]; marker != "[truncated 4002 bytes]" {
+		t.Errorf("Unexpected marker %v", marker)
+	}
+	if configMap["data"].(map[string]interface{})["large"] == truncated["data"].(map[string]interface{})["large"] {
+		t.Error("Truncating modified the object")
+	}
+
+	// Identity fields survive even when nothing else is left
+	truncated, _, err = truncate(configMap, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := truncated["metadata"].(map[string]interface{})
+	if truncated["kind"] != "ConfigMap" || metadata["name"] != "big" || metadata["uid"] != "c1" {
+		t.Errorf("Expected the identity fields to be kept, got %v", truncated)
+	}
+}
+
+func TestChangeHandlerPublishesProjectedObjects(t *testing.T) {
+	publish := &MockPublishOperations{}
+	rules := &PayloadRules{Default: DefaultProjection, MaxSize: 400}
+	kClient := kubernetesclient.NewClient("http://127.0.0.1:1", false)
+	handler := NewChangeHandler(&client.RancherClient{Publish: publish}, kClient, cachedNamespaces(kClient, "default"), "pods", rules)
+
+	pod := jsonObject(t, testPod)
+	pod["spec"].(map[string]interface{})["nodeName"] = strings.Repeat("n", 500)
+	if err := handler.Handle(model.WatchEvent{Type: "ADDED", Object: pod}); err != nil {
+		t.Fatal(err)
+	}
+	if len(publish.published) != 1 {
+		t.Fatalf("Expected one publish, got %d", len(publish.published))
+	}
+	data := publish.published[0].Data
+	object := data["object"].(map[string]interface{})
+	if _, ok := object["status"]; ok {
+		t.Error("Expected the status to be left out")
+	}
+	if !reflect.DeepEqual(data["truncated"], []string{"/spec/nodeName"}) {
+		t.Errorf("Expected the node name to be truncated, got %v", data["truncated"])
+	}
+}
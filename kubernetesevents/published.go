@@ -0,0 +1,121 @@
+package kubernetesevents
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"sync"
+)
+
+// publishStats counts the changes not published to Rancher because nothing
+// Rancher sees changed.
+var publishStats = expvar.NewMap("published")
+
+// publishedCache remembers a hash of the last payload successfully published
+// to Rancher for each object, by UID, so that changes to fields Rancher
+// doesn't see, like resourceVersion and status, aren't published again. It
+// lives as long as its handler, so relists after a reconnect don't publish
+// every object again.
+type publishedCache struct {
+	sync.Mutex
+	hashes map[string]string
+}
+
+func newPublishedCache() *publishedCache {
+	return &publishedCache{
+		hashes: map[string]string{},
+	}
+}
+
+// unchanged reports whether hash was the last one published for uid.
+func (c *publishedCache) unchanged(uid string, hash string) bool {
+	c.Lock()
+	defer c.Unlock()
+	published, ok := c.hashes[uid]
+	if ok && published == hash {
+		publishStats.Add("skipped", 1)
+		return true
+	}
+	return false
+}
+
+// has reports whether anything was published for uid since it was last
+// forgotten, which the service handler takes as Rancher having created it.
+func (c *publishedCache) has(uid string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.hashes[uid]
+	return ok
+}
+
+// seed records that Rancher has the objects with uids, without knowing what
+// was published for them, so has reports them while their next change is
+// still published.
+func (c *publishedCache) seed(uids []string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, uid := range uids {
+		if _, ok := c.hashes[uid]; !ok {
+			c.hashes[uid] = ""
+		}
+	}
+}
+
+// uids returns the UIDs of the objects has reports.
+func (c *publishedCache) uids() []string {
+	c.Lock()
+	defer c.Unlock()
+	uids := make([]string, 0, len(c.hashes))
+	for uid := range c.hashes {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+func (c *publishedCache) set(uid string, hash string) {
+	c.Lock()
+	defer c.Unlock()
+	c.hashes[uid] = hash
+}
+
+func (c *publishedCache) forget(uid string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.hashes, uid)
+}
+
+// payloadHash hashes the JSON encoding of v, which is canonical since maps
+// are encoded with sorted keys.
+func payloadHash(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// changeFields returns the parts of a projected object whose changes are
+// published. Bookkeeping metadata is left out, since it changes with every
+// write without anything Rancher uses changing.
+func changeFields(obj map[string]interface{}) map[string]interface{} {
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		return obj
+	}
+	fields := map[string]interface{}{}
+	for key, value := range obj {
+		fields[key] = value
+	}
+	fieldsMetadata := map[string]interface{}{}
+	for key, value := range metadata {
+		switch key {
+		case "resourceVersion", "generation", "managedFields":
+			continue
+		}
+		fieldsMetadata[key] = value
+	}
+	fields["metadata"] = fieldsMetadata
+	return fields
+}
@@ -0,0 +1,106 @@
+package kubernetesevents
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher/v2"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+// changedService returns service a at version, with a status and port that
+// can be changed independently.
+func changedService(t *testing.T, eventType string, version string, port int, loadBalancerIP string) model.WatchEvent {
+	obj := unstructuredService(t, "a")
+	obj.SetResourceVersion(version)
+	obj.Object["spec"].(map[string]interface{})["ports"] = []interface{}{map[string]interface{}{"port": port}}
+	obj.Object["status"] = map[string]interface{}{
+		"loadBalancer": map[string]interface{}{
+			"ingress": []interface{}{map[string]interface{}{"ip": loadBalancerIP}},
+		},
+	}
+	event, err := toModelEvent(kubernetesclient.WatchEvent{Type: eventType, Object: obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestServiceHandlerSkipsUnchangedServices(t *testing.T) {
+	handler, events, stop := newTestServiceHandler()
+	defer stop()
+
+	steps := []struct {
+		event    model.WatchEvent
+		expected string
+	}{
+		{changedService(t, "ADDED", "1", 80, "1.1.1.1"), "service.create"},
+		// Only the status and resourceVersion changed
+		{changedService(t, "MODIFIED", "2", 80, "2.2.2.2"), ""},
+		{changedService(t, "MODIFIED", "3", 8080, "2.2.2.2"), "service.update"},
+		{changedService(t, "DELETED", "4", 8080, "2.2.2.2"), "service.remove"},
+		// Rancher forgot the service, so the same state is sent again
+		{changedService(t, "ADDED", "5", 8080, "2.2.2.2"), "service.create"},
+	}
+	for i, step := range steps {
+		svc, err := handler.Decode(step.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step.event.Type == "DELETED" {
+			err = handler.Delete(svc)
+		} else {
+			err = handler.Add(svc, DeltaType(step.event.Type))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sent := ""
+		select {
+		case event := <-events:
+			sent = event.EventType
+		default:
+		}
+		if sent != step.expected {
+			t.Errorf("Step %d: expected %q to be sent, got %q", i, step.expected, sent)
+		}
+	}
+}
+
+type MockPublishOperations struct {
+	client.PublishClient
+	published []*client.Publish
+}
+
+func (m *MockPublishOperations) Create(publish *client.Publish) (*client.Publish, error) {
+	m.published = append(m.published, publish)
+	return publish, nil
+}
+
+func TestChangeHandlerSkipsUnchangedObjects(t *testing.T) {
+	publish := &MockPublishOperations{}
+	kClient := kubernetesclient.NewClient("http://127.0.0.1:1", false)
+	handler := NewChangeHandler(&client.RancherClient{Publish: publish}, kClient, cachedNamespaces(kClient, "default"), "services", nil)
+
+	steps := []struct {
+		event    model.WatchEvent
+		expected bool
+	}{
+		{changedService(t, "ADDED", "1", 80, "1.1.1.1"), true},
+		{changedService(t, "MODIFIED", "2", 80, "2.2.2.2"), false},
+		{changedService(t, "MODIFIED", "3", 8080, "2.2.2.2"), true},
+		{changedService(t, "DELETED", "4", 8080, "2.2.2.2"), true},
+		{changedService(t, "ADDED", "5", 8080, "2.2.2.2"), true},
+	}
+	for i, step := range steps {
+		before := len(publish.published)
+		if err := handler.Handle(step.event); err != nil {
+			t.Fatal(err)
+		}
+		if published := len(publish.published) > before; published != step.expected {
+			t.Errorf("Step %d: expected %s published to be %v", i, step.event.Type, step.expected)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package kubernetesevents
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/kubernetes-agent/config"
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+const stackExternalIdPrefix = "kubernetes://"
+
+// Orphans are the Rancher records whose kubernetes objects are gone, by
+// ExternalId.
+type Orphans struct {
+	Services []string
+	Stacks   []string
+}
+
+// Reconciler finds the kubernetesService services and kubernetes:// stacks
+// Rancher still has for services and namespaces that are gone from the
+// cluster, which happens when the agent misses a delete, and removes them.
+// Services and namespaces that opted out of syncing count as gone, since an
+// agent that restarted doesn't know it sent them before they opted out. In
+// dry run mode it only reports them.
+type Reconciler struct {
+	rClient *client.RancherClient
+	kClient *kubernetesclient.Client
+	scope   *Scope
+	dryRun  bool
+}
+
+func NewReconciler(rClient *client.RancherClient, kClient *kubernetesclient.Client, conf config.Config) (*Reconciler, error) {
+	scope, err := NewScope(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Reconciler{
+		rClient: rClient,
+		kClient: kClient,
+		scope:   scope,
+		dryRun:  conf.ReconcileDryRun,
+	}, nil
+}
+
+// Run reconciles right away and then every interval until ctx is done. A
+// zero interval only reconciles once. Failed reconciliations are retried
+// with the next one.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := r.Reconcile(ctx); err != nil {
+			log.Errorf("Error reconciling Rancher services with the cluster: %v", err)
+		}
+		if interval <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Reconcile removes the orphaned records, unless in dry run mode, and
+// returns them.
+func (r *Reconciler) Reconcile(ctx context.Context) (*Orphans, error) {
+	// Rancher is listed first, so any record seen was sent for an object
+	// that is in the cluster list unless it was deleted
+	services, err := rancherServices(r.rClient)
+	if err != nil {
+		return nil, err
+	}
+	stacks, err := r.rancherStacks()
+	if err != nil {
+		return nil, err
+	}
+
+	// Namespaces are cluster scoped, so this needs cluster level read access
+	// even when the watched namespaces are scoped
+	namespaces, err := r.kClient.Resource(kubernetesclient.NamespaceResource).ListContext(ctx, kubernetesclient.ListOptions{
+		Limit: reflectorListPageSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Stacks are named by the namespace UID, except kube-system's, which is
+	// never looked up for opting out
+	liveNamespaces := map[string]string{"kube-system": "kube-system"}
+	optedOutNamespaces := map[string]bool{}
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		liveNamespaces[namespace.GetUID()] = namespace.GetName()
+		if namespace.GetName() != "kube-system" && unstructuredOptedOut(namespace) {
+			optedOutNamespaces[namespace.GetName()] = true
+		}
+	}
+
+	liveServices := map[string]bool{}
+	for _, resource := range r.scope.resources(r.kClient.Resource(kubernetesclient.ServiceResource), true) {
+		list, err := resource.ListContext(ctx, kubernetesclient.ListOptions{
+			Limit: reflectorListPageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			service := &list.Items[i]
+			if unstructuredOptedOut(service) || optedOutNamespaces[service.GetNamespace()] {
+				continue
+			}
+			liveServices[service.GetUID()] = true
+		}
+	}
+
+	orphans := &Orphans{}
+	stackNamespaces := map[string]string{}
+	for _, stack := range stacks {
+		id := strings.TrimPrefix(stack.ExternalId, stackExternalIdPrefix)
+		namespace, ok := liveNamespaces[id]
+		if ok {
+			stackNamespaces[stack.Id] = namespace
+		}
+		if !ok || optedOutNamespaces[namespace] {
+			orphans.Stacks = append(orphans.Stacks, stack.ExternalId)
+		}
+	}
+	// Only watched namespaces are listed, so services elsewhere can't be
+	// told apart from orphans
+	listedAll := r.scope.Namespaces() == nil
+	for _, service := range services {
+		if liveServices[service.ExternalId] {
+			continue
+		}
+		if namespace, ok := stackNamespaces[service.StackId]; !listedAll && (!ok || !r.scope.IncludesNamespace(namespace)) {
+			continue
+		}
+		orphans.Services = append(orphans.Services, service.ExternalId)
+	}
+
+	for _, externalId := range orphans.Services {
+		r.remove(&client.ExternalServiceEvent{
+			ExternalId: externalId,
+			EventType:  eventTypePrefix + "remove",
+			Service:    client.Service{Kind: kubernetesServiceKind},
+		})
+	}
+	for _, externalId := range orphans.Stacks {
+		r.remove(&client.ExternalServiceEvent{
+			ExternalId:  externalId,
+			EventType:   namespaceEventTypePrefix + "remove",
+			Environment: &client.Stack{Kind: "environment"},
+			Service:     client.Service{Kind: kubernetesServiceKind},
+		})
+	}
+	return orphans, nil
+}
+
+func (r *Reconciler) remove(event *client.ExternalServiceEvent) {
+	if r.dryRun {
+		log.Infof("Dry run: would send %s for orphaned %s", event.EventType, event.ExternalId)
+		return
+	}
+	log.Infof("Sending %s for orphaned %s", event.EventType, event.ExternalId)
+	if _, err := r.rClient.ExternalServiceEvent.Create(event); err != nil {
+		log.Errorf("Error removing orphaned %s: %v", event.ExternalId, err)
+	}
+}
+
+// rancherServices lists the live kubernetesService services in Rancher.
+func rancherServices(rClient *client.RancherClient) ([]client.Service, error) {
+	var services []client.Service
+	collection, err := rClient.Service.List(&client.ListOpts{
+		Filters: map[string]interface{}{"kind": kubernetesServiceKind},
+	})
+	for ; collection != nil && err == nil; collection, err = collection.Next() {
+		for _, service := range collection.Data {
+			if service.Kind == kubernetesServiceKind && service.Removed == "" && service.ExternalId != "" {
+				services = append(services, service)
+			}
+		}
+	}
+	return services, err
+}
+
+// rancherStacks lists the live stacks in Rancher made for namespaces.
+func (r *Reconciler) rancherStacks() ([]client.Stack, error) {
+	var stacks []client.Stack
+	collection, err := r.rClient.Stack.List(&client.ListOpts{})
+	for ; collection != nil && err == nil; collection, err = collection.Next() {
+		for _, stack := range collection.Data {
+			if strings.HasPrefix(stack.ExternalId, stackExternalIdPrefix) && stack.Removed == "" {
+				stacks = append(stacks, stack)
+			}
+		}
+	}
+	return stacks, err
+}
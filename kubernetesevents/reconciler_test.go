@@ -0,0 +1,195 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/rancher/go-rancher/v2"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+type MockServiceOperations struct {
+	client.ServiceClient
+	services []client.Service
+}
+
+func (m *MockServiceOperations) List(opts *client.ListOpts) (*client.ServiceCollection, error) {
+	return &client.ServiceCollection{Data: m.services}, nil
+}
+
+type MockStackOperations struct {
+	client.StackClient
+	stacks []client.Stack
+}
+
+func (m *MockStackOperations) List(opts *client.ListOpts) (*client.StackCollection, error) {
+	return &client.StackCollection{Data: m.stacks}, nil
+}
+
+// reconcileServer has the default, team-a and kube-system namespaces, with
+// service live-a in team-a and live-b in default.
+func reconcileServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"kind": "Namespace", "metadata": {"name": "default", "uid": "ns-default"}},
+				{"kind": "Namespace", "metadata": {"name": "team-a", "uid": "ns-team-a"}}]}`)
+		case "/api/v1/services":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"kind": "Service", "metadata": {"name": "a", "namespace": "team-a", "uid": "live-a"}},
+				{"kind": "Service", "metadata": {"name": "b", "namespace": "default", "uid": "live-b"}}]}`)
+		case "/api/v1/namespaces/team-a/services":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"kind": "Service", "metadata": {"name": "a", "namespace": "team-a", "uid": "live-a"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestReconciler(t *testing.T) {
+	server := reconcileServer()
+	defer server.Close()
+
+	stacks := []client.Stack{
+		{Resource: client.Resource{Id: "1st1"}, ExternalId: "kubernetes://ns-default"},
+		{Resource: client.Resource{Id: "1st2"}, ExternalId: "kubernetes://ns-team-a"},
+		{Resource: client.Resource{Id: "1st3"}, ExternalId: "kubernetes://kube-system"},
+		{Resource: client.Resource{Id: "1st4"}, ExternalId: "kubernetes://ns-gone"},
+		{Resource: client.Resource{Id: "1st5"}, ExternalId: "kubernetes://ns-removed", Removed: "2017-01-01T00:00:00Z"},
+		{Resource: client.Resource{Id: "1st6"}, ExternalId: "compose://not-kubernetes"},
+	}
+	services := []client.Service{
+		{Kind: kubernetesServiceKind, StackId: "1st2", ExternalId: "live-a"},
+		{Kind: kubernetesServiceKind, StackId: "1st1", ExternalId: "live-b"},
+		{Kind: kubernetesServiceKind, StackId: "1st2", ExternalId: "gone-a"},
+		{Kind: kubernetesServiceKind, StackId: "1st1", ExternalId: "gone-b"},
+		{Kind: kubernetesServiceKind, StackId: "1st1", ExternalId: "removed", Removed: "2017-01-01T00:00:00Z"},
+		{Kind: "service", StackId: "1st6", ExternalId: "not-kubernetes"},
+	}
+
+	tests := []struct {
+		include  []string
+		dryRun   bool
+		services []string
+		stacks   []string
+	}{
+		{
+			services: []string{"gone-a", "gone-b"},
+			stacks:   []string{"kubernetes://ns-gone"},
+		},
+		{
+			dryRun:   true,
+			services: []string{"gone-a", "gone-b"},
+			stacks:   []string{"kubernetes://ns-gone"},
+		},
+		// Only team-a's services are listed, so gone-b can't be judged
+		{
+			include:  []string{"team-a"},
+			services: []string{"gone-a"},
+			stacks:   []string{"kubernetes://ns-gone"},
+		},
+	}
+	for _, test := range tests {
+		events := make(chan client.ExternalServiceEvent, 10)
+		reconciler := &Reconciler{
+			rClient: &client.RancherClient{
+				Service:              &MockServiceOperations{services: services},
+				Stack:                &MockStackOperations{stacks: stacks},
+				ExternalServiceEvent: &MockServiceEventOperations{events: events},
+			},
+			kClient: kubernetesclient.NewClient(server.URL, false),
+			scope:   &Scope{IncludeNamespaces: test.include},
+			dryRun:  test.dryRun,
+		}
+
+		orphans, err := reconciler.Reconcile(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(orphans.Services) != fmt.Sprint(test.services) || fmt.Sprint(orphans.Stacks) != fmt.Sprint(test.stacks) {
+			t.Errorf("include %v: expected orphans %v and %v, got %+v", test.include, test.services, test.stacks, orphans)
+		}
+
+		var sent []string
+		for len(events) > 0 {
+			event := <-events
+			sent = append(sent, event.EventType+" "+event.ExternalId)
+		}
+		sort.Strings(sent)
+		var expected []string
+		if !test.dryRun {
+			for _, id := range test.services {
+				expected = append(expected, "service.remove "+id)
+			}
+			for _, id := range test.stacks {
+				expected = append(expected, "stack.remove "+id)
+			}
+		}
+		if fmt.Sprint(sent) != fmt.Sprint(expected) {
+			t.Errorf("include %v dry run %v: expected %v to be sent, got %v", test.include, test.dryRun, expected, sent)
+		}
+	}
+}
+
+// optOutServer has the default namespace and the quiet namespace, which opted
+// out of syncing, with a service in each and a service in default that opted
+// out.
+func optOutServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"kind": "Namespace", "metadata": {"name": "default", "uid": "ns-default"}},
+				{"kind": "Namespace", "metadata": {"name": "quiet", "uid": "ns-quiet", "annotations": {"io.rancher.sync": "false"}}}]}`)
+		case "/api/v1/services", "/api/v1/namespaces/quiet/services", "/api/v1/namespaces/default/services":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"kind": "Service", "metadata": {"name": "a", "namespace": "default", "uid": "live-a"}},
+				{"kind": "Service", "metadata": {"name": "b", "namespace": "default", "uid": "opted-out-b", "annotations": {"io.rancher.sync": "false"}}},
+				{"kind": "Service", "metadata": {"name": "c", "namespace": "quiet", "uid": "quiet-c"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestReconcilerRemovesOptedOut(t *testing.T) {
+	server := optOutServer()
+	defer server.Close()
+
+	// Rancher heard of everything before the agent restarted
+	stacks := []client.Stack{
+		{Resource: client.Resource{Id: "1st1"}, ExternalId: "kubernetes://ns-default"},
+		{Resource: client.Resource{Id: "1st2"}, ExternalId: "kubernetes://ns-quiet"},
+	}
+	services := []client.Service{
+		{Kind: kubernetesServiceKind, StackId: "1st1", ExternalId: "live-a"},
+		{Kind: kubernetesServiceKind, StackId: "1st1", ExternalId: "opted-out-b"},
+		{Kind: kubernetesServiceKind, StackId: "1st2", ExternalId: "quiet-c"},
+	}
+	for _, include := range [][]string{nil, {"default", "quiet"}} {
+		reconciler := &Reconciler{
+			rClient: &client.RancherClient{
+				Service:              &MockServiceOperations{services: services},
+				Stack:                &MockStackOperations{stacks: stacks},
+				ExternalServiceEvent: &MockServiceEventOperations{events: make(chan client.ExternalServiceEvent, 10)},
+			},
+			kClient: kubernetesclient.NewClient(server.URL, false),
+			scope:   &Scope{IncludeNamespaces: include},
+		}
+
+		orphans, err := reconciler.Reconcile(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(orphans.Services) != "[opted-out-b quiet-c]" || fmt.Sprint(orphans.Stacks) != "[kubernetes://ns-quiet]" {
+			t.Errorf("include %v: expected the opted out services and namespace to be orphans, got %+v", include, orphans)
+		}
+	}
+}
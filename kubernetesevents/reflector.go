@@ -0,0 +1,305 @@
+package kubernetesevents
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+	"github.com/rancher/kubernetes-model/model"
+)
+
+const (
+	reflectorListPageSize = 500
+	reflectorMinBackoff   = time.Second
+	reflectorMaxBackoff   = 30 * time.Second
+)
+
+// Reflector keeps a resource's objects flowing to a callback. It lists the
+// resource once and then watches it from the resourceVersion of the list,
+// resuming from the last version it saw whenever the watch drops. When that
+// version has expired it lists again and only reports what changed in the
+// meantime. A reflector resumed from a checkpoint lists once, without
+// reporting anything, to fill the store, and then watches from the
+// checkpoint.
+type Reflector struct {
+	resource kubernetesclient.ResourceOperations
+	name     string
+	onEvent  func(kubernetesclient.WatchEvent)
+	// onSync, when set, is called after every complete list
+	onSync func()
+	// onFill, when set, is handed the objects of every complete list, to
+	// fill a store with
+	onFill func([]*kubernetesclient.Unstructured)
+	// labelSelector, when set, limits the objects listed and watched
+	labelSelector string
+	// listing is set while a list's events are reported. They come in no
+	// particular order, so their versions aren't checkpoints.
+	listing bool
+	// replaying is set while an event older than the object filled into
+	// the store is reported
+	replaying bool
+
+	// known holds the last version reported of every object, by UID
+	known           map[string]*kubernetesclient.Unstructured
+	resourceVersion string
+	// resumed is set until the store of a reflector resumed from a
+	// checkpoint is filled
+	resumed bool
+	// behind holds the resourceVersion an object was filled into the store
+	// at, by UID, until the watch reaches it, and "" for the objects gone by
+	// then
+	behind map[string]string
+}
+
+func NewReflector(resource kubernetesclient.ResourceOperations, onEvent func(kubernetesclient.WatchEvent)) *Reflector {
+	return &Reflector{
+		resource: resource,
+		name:     resource.GroupVersionResource().String(),
+		onEvent:  onEvent,
+		known:    map[string]*kubernetesclient.Unstructured{},
+	}
+}
+
+// Run lists and watches until ctx is done. Failures are retried with
+// backoff, so it only returns ctx's error.
+func (r *Reflector) Run(ctx context.Context) error {
+	backoff := reflectorMinBackoff
+	for {
+		if r.resumed {
+			if err := r.fill(ctx); err != nil {
+				log.Errorf("Error listing %s, retrying in %v: %v", r.name, backoff, err)
+				if err := r.wait(ctx, &backoff); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if r.resourceVersion == "" {
+			if err := r.relist(ctx); err != nil {
+				log.Errorf("Error listing %s, retrying in %v: %v", r.name, backoff, err)
+				if err := r.wait(ctx, &backoff); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		received, err := r.watch(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if received {
+			backoff = reflectorMinBackoff
+		}
+		if kubernetesclient.IsGone(err) {
+			log.Infof("Resource version %s of %s is too old, listing again", r.resourceVersion, r.name)
+			r.resourceVersion = ""
+			continue
+		}
+		if err != nil {
+			log.Warnf("Watch of %s from resource version %s ended, resuming in %v: %v", r.name, r.resourceVersion, backoff, err)
+		}
+		if err := r.wait(ctx, &backoff); err != nil {
+			return err
+		}
+	}
+}
+
+// list lists the current objects.
+func (r *Reflector) list(ctx context.Context) (*kubernetesclient.UnstructuredList, error) {
+	listCtx, call := kubernetesclient.WithCallStats(ctx)
+	list, err := r.resource.ListContext(listCtx, kubernetesclient.ListOptions{
+		LabelSelector: r.labelSelector,
+		Limit:         reflectorListPageSize,
+	})
+	if call.Retries() > 0 {
+		log.Infof("Listing %s took %d attempts, %d of them throttled", r.name, call.Attempts(), call.Throttled())
+	}
+	return list, err
+}
+
+// fill hands the current objects of a reflector resumed from a checkpoint to
+// onFill, and remembers the ones the watch from the checkpoint has yet to
+// catch up with. Nothing is reported, the watch does that.
+func (r *Reflector) fill(ctx context.Context) error {
+	list, err := r.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.behind = map[string]string{}
+	current := make(map[string]bool, len(list.Items))
+	objs := make([]*kubernetesclient.Unstructured, 0, len(list.Items))
+	for i := range list.Items {
+		obj := &list.Items[i]
+		current[obj.GetUID()] = true
+		objs = append(objs, obj)
+		if old, ok := r.known[obj.GetUID()]; ok && old.GetResourceVersion() == obj.GetResourceVersion() {
+			r.known[obj.GetUID()] = obj
+		} else {
+			r.behind[obj.GetUID()] = obj.GetResourceVersion()
+		}
+	}
+	for uid := range r.known {
+		if !current[uid] {
+			r.behind[uid] = ""
+		}
+	}
+
+	r.resumed = false
+	if r.onFill != nil {
+		r.onFill(objs)
+	}
+	return nil
+}
+
+// relist reports the difference between the current objects and the ones
+// already known as ADDED, MODIFIED and DELETED events.
+func (r *Reflector) relist(ctx context.Context) error {
+	list, err := r.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.behind = nil
+	r.listing = true
+	defer func() {
+		r.listing = false
+	}()
+	current := make(map[string]*kubernetesclient.Unstructured, len(list.Items))
+	for i := range list.Items {
+		obj := &list.Items[i]
+		current[obj.GetUID()] = obj
+	}
+	for uid, obj := range current {
+		old, ok := r.known[uid]
+		switch {
+		case !ok:
+			r.deliver(kubernetesclient.WatchEvent{Type: kubernetesclient.EventAdded, Object: obj})
+		case old.GetResourceVersion() != obj.GetResourceVersion():
+			r.deliver(kubernetesclient.WatchEvent{Type: kubernetesclient.EventModified, Object: obj})
+		}
+	}
+	for uid, old := range r.known {
+		if _, ok := current[uid]; !ok {
+			r.deliver(kubernetesclient.WatchEvent{Type: kubernetesclient.EventDeleted, Object: old})
+		}
+	}
+
+	r.resourceVersion = list.GetResourceVersion()
+	if r.onFill != nil {
+		objs := make([]*kubernetesclient.Unstructured, 0, len(current))
+		for _, obj := range current {
+			objs = append(objs, obj)
+		}
+		r.onFill(objs)
+	}
+	if r.onSync != nil {
+		r.onSync()
+	}
+	return nil
+}
+
+// watch streams events from the current resourceVersion until the watch
+// ends. It reports whether any event was received.
+func (r *Reflector) watch(ctx context.Context) (bool, error) {
+	watcher, err := r.resource.WatchContext(ctx, kubernetesclient.ListOptions{
+		LabelSelector:   r.labelSelector,
+		ResourceVersion: r.resourceVersion,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer watcher.Stop()
+
+	received := false
+	for event := range watcher.ResultChan() {
+		received = true
+		if event.Object == nil {
+			continue
+		}
+		if event.Type == kubernetesclient.EventError {
+			return received, statusError(event.Object)
+		}
+		if version := event.Object.GetResourceVersion(); version != "" {
+			r.resourceVersion = version
+		}
+		if old, ok := r.known[event.Object.GetUID()]; ok && event.Type != kubernetesclient.EventDeleted &&
+			old.GetResourceVersion() == event.Object.GetResourceVersion() {
+			// Already reported by a list
+			continue
+		}
+		r.replaying = r.isBehind(event)
+		r.deliver(event)
+		r.replaying = false
+	}
+	return received, watcher.Err()
+}
+
+// isBehind reports whether event is older than what was filled into the
+// store, and forgets the object once the watch caught up with it.
+func (r *Reflector) isBehind(event kubernetesclient.WatchEvent) bool {
+	uid := event.Object.GetUID()
+	version, ok := r.behind[uid]
+	if !ok {
+		return false
+	}
+	if event.Type == kubernetesclient.EventDeleted || event.Object.GetResourceVersion() == version {
+		delete(r.behind, uid)
+		return false
+	}
+	return true
+}
+
+func (r *Reflector) deliver(event kubernetesclient.WatchEvent) {
+	if event.Type == kubernetesclient.EventDeleted {
+		delete(r.known, event.Object.GetUID())
+	} else {
+		r.known[event.Object.GetUID()] = event.Object
+	}
+	r.onEvent(event)
+}
+
+func (r *Reflector) wait(ctx context.Context, backoff *time.Duration) error {
+	timer := time.NewTimer(*backoff)
+	defer timer.Stop()
+	*backoff *= 2
+	if *backoff > reflectorMaxBackoff {
+		*backoff = reflectorMaxBackoff
+	}
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// statusError turns the Status sent in an ERROR event into an error.
+func statusError(obj *kubernetesclient.Unstructured) error {
+	status := &model.Status{}
+	if err := convert(obj, status); err != nil {
+		return err
+	}
+	return kubernetesclient.NewApiErrorFromStatus(status)
+}
+
+// toModelEvent converts an event for the handlers, which decode objects with
+// mapstructure and so can't take the json.Number values of unstructured
+// objects.
+func toModelEvent(event kubernetesclient.WatchEvent) (model.WatchEvent, error) {
+	modelEvent := model.WatchEvent{}
+	err := convert(event, &modelEvent)
+	return modelEvent, err
+}
+
+func convert(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,136 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+func testService(uid, version string) string {
+	return fmt.Sprintf(`{"kind": "Service", "metadata": {"name": "svc-%s", "namespace": "default", "uid": "%s", "resourceVersion": "%s"}, "spec": {"clusterIP": "10.43.0.1", "ports": [{"port": 80}]}}`, uid, uid, version)
+}
+
+// fakeWatchServer plays a scripted sequence: an initial list, a watch that
+// drops after one event, a resumed watch whose version has expired, and a
+// second list that shows what changed in the gap.
+type fakeWatchServer struct {
+	sync.Mutex
+	lists         int
+	watchVersions []string
+	// listHandled, when set, holds back the first watch's change until it is
+	// closed
+	listHandled chan struct{}
+}
+
+func (f *fakeWatchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Query().Get("watch") != "true" {
+		f.lists++
+		if f.lists == 1 {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s, %s]}`, testService("a", "1"), testService("b", "2"))
+		} else {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "20"}, "items": [%s, %s]}`, testService("a", "11"), testService("c", "15"))
+		}
+		return
+	}
+
+	f.watchVersions = append(f.watchVersions, r.URL.Query().Get("resourceVersion"))
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	switch len(f.watchVersions) {
+	case 1:
+		if f.listHandled != nil {
+			f.Unlock()
+			<-f.listHandled
+			f.Lock()
+		}
+		// Drop the connection after one change
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "MODIFIED", "object": `+testService("a", "11")+`}`))
+	case 2:
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "ERROR", "object": {"kind": "Status", "status": "Failure", "code": 410, "reason": "Expired"}}`))
+	default:
+		f.Unlock()
+		conn.ReadMessage()
+		f.Lock()
+	}
+}
+
+func TestReflectorResumesAndRelists(t *testing.T) {
+	fake := &fakeWatchServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kClient := kubernetesclient.NewClient(server.URL, false)
+	events := make(chan string, 10)
+	reflector := NewReflector(kClient.Resource(kubernetesclient.ServiceResource), func(event kubernetesclient.WatchEvent) {
+		events <- event.Type + " " + event.Object.GetUID() + "@" + event.Object.GetResourceVersion()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- reflector.Run(ctx)
+	}()
+
+	var received []string
+	for len(received) < 5 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %v", received)
+		}
+	}
+	// Wait for the watch that follows the relist before stopping
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		fake.Lock()
+		watches := len(fake.watchVersions)
+		fake.Unlock()
+		if watches == 3 {
+			break
+		}
+	}
+	cancel()
+	<-done
+
+	initial := map[string]bool{received[0]: true, received[1]: true}
+	if !initial["ADDED a@1"] || !initial["ADDED b@2"] {
+		t.Errorf("Unexpected initial events %v", received[:2])
+	}
+	if received[2] != "MODIFIED a@11" {
+		t.Errorf("Expected the watched change, got %v", received[2])
+	}
+	// a is unchanged since the watch, so the relist only reports c and b
+	gap := map[string]bool{received[3]: true, received[4]: true}
+	if !gap["ADDED c@15"] || !gap["DELETED b@2"] {
+		t.Errorf("Unexpected events after relisting %v", received[3:])
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %v", event)
+	default:
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	expectedVersions := []string{"10", "11", "20"}
+	if fmt.Sprint(fake.watchVersions) != fmt.Sprint(expectedVersions) {
+		t.Errorf("Expected watches from %v, got %v", expectedVersions, fake.watchVersions)
+	}
+	if fake.lists != 2 {
+		t.Errorf("Expected 2 lists, got %d", fake.lists)
+	}
+}
@@ -0,0 +1,149 @@
+package kubernetesevents
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rancher/kubernetes-agent/config"
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+// Scope narrows down the objects reported to Rancher to the namespaces and
+// labels the agent was configured with.
+type Scope struct {
+	// IncludeNamespaces are globs of the namespaces to report, all of them
+	// when empty
+	IncludeNamespaces []string
+	// ExcludeNamespaces are globs of the namespaces never to report
+	ExcludeNamespaces []string
+	// LabelSelectors holds the label selector of a kind by resource name
+	LabelSelectors map[string]string
+}
+
+// NewScope builds the Scope of the agent's configuration. Label selectors
+// are given as kind:selector entries separated by semicolons, e.g.
+// "services:app=web,tier!=cache;pods:app=web".
+func NewScope(conf config.Config) (*Scope, error) {
+	s := &Scope{
+		IncludeNamespaces: conf.IncludeNamespaces,
+		ExcludeNamespaces: conf.ExcludeNamespaces,
+		LabelSelectors:    map[string]string{},
+	}
+	for _, pattern := range append(append([]string{}, s.IncludeNamespaces...), s.ExcludeNamespaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern [%s]: %v", pattern, err)
+		}
+	}
+	for _, entry := range strings.Split(conf.LabelSelectors, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid label selector [%s], expected kind:selector", entry)
+		}
+		s.LabelSelectors[parts[0]] = strings.TrimSpace(parts[1])
+	}
+	return s, nil
+}
+
+// IncludesNamespace reports whether objects in namespace are reported.
+func (s *Scope) IncludesNamespace(namespace string) bool {
+	if matchesAny(s.ExcludeNamespaces, namespace) {
+		return false
+	}
+	return len(s.IncludeNamespaces) == 0 || matchesAny(s.IncludeNamespaces, namespace)
+}
+
+// Includes reports whether obj, an object of resource gvr, is in one of the
+// reported namespaces. Namespaces are matched by their own name and other
+// cluster scoped objects are always included. The resource decides, since
+// the items of a list carry no kind.
+func (s *Scope) Includes(gvr kubernetesclient.GroupVersionResource, obj *kubernetesclient.Unstructured) bool {
+	namespace := obj.GetNamespace()
+	if gvr.Group == "" && gvr.Resource == kubernetesclient.NamespaceResource.Resource {
+		namespace = obj.GetName()
+	}
+	if namespace == "" {
+		return true
+	}
+	return s.IncludesNamespace(namespace)
+}
+
+// LabelSelector returns the label selector configured for a resource, by
+// its plain resource name or its resource.version.group form.
+func (s *Scope) LabelSelector(gvr kubernetesclient.GroupVersionResource) string {
+	if selector, ok := s.LabelSelectors[gvr.String()]; ok {
+		return selector
+	}
+	return s.LabelSelectors[gvr.Resource]
+}
+
+// narrows reports whether the scope leaves out some objects of resource gvr.
+func (s *Scope) narrows(gvr kubernetesclient.GroupVersionResource) bool {
+	return len(s.IncludeNamespaces) > 0 || len(s.ExcludeNamespaces) > 0 || s.LabelSelector(gvr) != ""
+}
+
+// Namespaces returns the namespaces to watch one by one, or nil to watch
+// across all namespaces. Only an allowlist of plain names can be watched
+// namespace by namespace, which lets the agent list and watch namespaced
+// kinds with namespace level RBAC. Globs have to be matched against every
+// namespace. Cluster scoped kinds, like the namespaces and nodes the agent
+// always reads, are still read cluster wide.
+func (s *Scope) Namespaces() []string {
+	if len(s.IncludeNamespaces) == 0 {
+		return nil
+	}
+	var namespaces []string
+	for _, pattern := range s.IncludeNamespaces {
+		if isGlob(pattern) {
+			return nil
+		}
+		if !matchesAny(s.ExcludeNamespaces, pattern) {
+			namespaces = append(namespaces, pattern)
+		}
+	}
+	return namespaces
+}
+
+// resources returns the clients to list and watch a resource through, one
+// per namespace when the namespaces can be watched one by one.
+func (s *Scope) resources(resource kubernetesclient.ResourceOperations, namespaced bool) []kubernetesclient.ResourceOperations {
+	namespaces := s.Namespaces()
+	if !namespaced || namespaces == nil {
+		return []kubernetesclient.ResourceOperations{resource}
+	}
+	resources := make([]kubernetesclient.ResourceOperations, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		resources = append(resources, resource.Namespace(namespace))
+	}
+	return resources
+}
+
+// newReflector returns a Reflector of resource that only lists, watches and
+// reports objects in the scope.
+func (s *Scope) newReflector(resource kubernetesclient.ResourceOperations, onEvent func(kubernetesclient.WatchEvent)) *Reflector {
+	gvr := resource.GroupVersionResource()
+	reflector := NewReflector(resource, func(event kubernetesclient.WatchEvent) {
+		if s.Includes(gvr, event.Object) {
+			onEvent(event)
+		}
+	})
+	reflector.labelSelector = s.LabelSelector(resource.GroupVersionResource())
+	return reflector
+}
+
+func matchesAny(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
@@ -0,0 +1,178 @@
+package kubernetesevents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/v2"
+
+	"github.com/rancher/kubernetes-agent/config"
+	"github.com/rancher/kubernetes-agent/kubernetesclient"
+)
+
+func TestNewScope(t *testing.T) {
+	scope, err := NewScope(config.Config{
+		LabelSelectors: "services:app=web,tier!=cache; deployments.v1.apps:app=api;",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selector := scope.LabelSelector(kubernetesclient.ServiceResource); selector != "app=web,tier!=cache" {
+		t.Errorf("Unexpected services selector %q", selector)
+	}
+	deployments := kubernetesclient.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	if selector := scope.LabelSelector(deployments); selector != "app=api" {
+		t.Errorf("Unexpected deployments selector %q", selector)
+	}
+	if selector := scope.LabelSelector(kubernetesclient.NamespaceResource); selector != "" {
+		t.Errorf("Unexpected namespaces selector %q", selector)
+	}
+
+	for _, conf := range []config.Config{
+		{LabelSelectors: "app=web"},
+		{LabelSelectors: "services:"},
+		{IncludeNamespaces: []string{"team-["}},
+		{ExcludeNamespaces: []string{"kube-[system"}},
+	} {
+		if _, err := NewScope(conf); err == nil {
+			t.Errorf("Expected %+v to be rejected", conf)
+		}
+	}
+}
+
+func TestScopeNamespaces(t *testing.T) {
+	tests := []struct {
+		include    []string
+		exclude    []string
+		namespaces []string
+		included   map[string]bool
+	}{
+		{
+			namespaces: nil,
+			included:   map[string]bool{"default": true, "kube-system": true},
+		},
+		{
+			exclude:    []string{"kube-*"},
+			namespaces: nil,
+			included:   map[string]bool{"default": true, "kube-system": false, "kube-public": false},
+		},
+		{
+			include:    []string{"team-a", "team-b"},
+			exclude:    []string{"team-b"},
+			namespaces: []string{"team-a"},
+			included:   map[string]bool{"team-a": true, "team-b": false, "default": false},
+		},
+		{
+			include:    []string{"team-a", "team-*"},
+			namespaces: nil,
+			included:   map[string]bool{"team-a": true, "team-c": true, "default": false},
+		},
+	}
+	for _, test := range tests {
+		scope := &Scope{IncludeNamespaces: test.include, ExcludeNamespaces: test.exclude}
+		if namespaces := scope.Namespaces(); fmt.Sprint(namespaces) != fmt.Sprint(test.namespaces) {
+			t.Errorf("include %v exclude %v: expected to watch %v, got %v", test.include, test.exclude, test.namespaces, namespaces)
+		}
+		for namespace, included := range test.included {
+			if scope.IncludesNamespace(namespace) != included {
+				t.Errorf("include %v exclude %v: expected %s included to be %v", test.include, test.exclude, namespace, included)
+			}
+		}
+	}
+
+	scope := &Scope{IncludeNamespaces: []string{"team-a"}}
+	// Listed items have no kind
+	namespace := &kubernetesclient.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "team-b"},
+	}}
+	if scope.Includes(kubernetesclient.NamespaceResource, namespace) {
+		t.Error("Expected namespaces to be matched by name")
+	}
+	volumes := kubernetesclient.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"}
+	volume := &kubernetesclient.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pv1"},
+	}}
+	if !scope.Includes(volumes, volume) {
+		t.Error("Expected cluster scoped objects to be included")
+	}
+}
+
+// scopedListServer lists a service in each of team-a and other, and records
+// the lists it gets. Watches fail.
+type scopedListServer struct {
+	sync.Mutex
+	requests []string
+}
+
+func (s *scopedListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("watch") == "true" {
+		http.Error(w, "watch not supported", http.StatusInternalServerError)
+		return
+	}
+	s.Lock()
+	s.requests = append(s.requests, r.URL.Path+"?"+r.URL.Query().Get("labelSelector"))
+	s.Unlock()
+	fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+		{"kind": "Service", "metadata": {"name": "web", "namespace": "team-a", "uid": "a", "resourceVersion": "1"}, "spec": {"clusterIP": "10.43.0.1"}},
+		{"kind": "Service", "metadata": {"name": "web", "namespace": "other", "uid": "b", "resourceVersion": "2"}, "spec": {"clusterIP": "10.43.0.2"}}]}`)
+}
+
+func TestScopedSyncQueue(t *testing.T) {
+	tests := []struct {
+		include  []string
+		requests []string
+	}{
+		{
+			include:  []string{"team-a"},
+			requests: []string{"/api/v1/namespaces/team-a/services?app=web"},
+		},
+		{
+			include:  []string{"team-*"},
+			requests: []string{"/api/v1/services?app=web"},
+		},
+	}
+	for _, test := range tests {
+		fake := &scopedListServer{}
+		server := httptest.NewServer(fake)
+		kClient := kubernetesclient.NewClient(server.URL, false)
+		handler := &serviceHandler{
+			rClient:   &client.RancherClient{Service: &MockServiceOperations{}},
+			kClient:   kClient,
+			published: newPublishedCache(),
+		}
+		scope := &Scope{
+			IncludeNamespaces: test.include,
+			LabelSelectors:    map[string]string{"services": "app=web"},
+		}
+		informer := NewSharedInformer(handler.Resource(), true, scope, nil)
+		fifo := NewDeltaFIFO(handler, informer, 0, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		go informer.Run(ctx)
+		syncCtx, syncCancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := informer.WaitForSync(syncCtx); err != nil {
+			t.Fatalf("include %v: informer didn't sync: %v", test.include, err)
+		}
+		syncCancel()
+		fake.Lock()
+		if fmt.Sprint(fake.requests) != fmt.Sprint(test.requests) {
+			t.Errorf("include %v: expected requests %v, got %v", test.include, test.requests, fake.requests)
+		}
+		fake.Unlock()
+		// The list was queued already, so a resync, which lists the same
+		// way, adds nothing
+		fifo.resync()
+		cancel()
+		server.Close()
+		fifo.l.Lock()
+		queued := append([]string{}, fifo.queue...)
+		fifo.l.Unlock()
+		if fmt.Sprint(queued) != "[a]" {
+			t.Errorf("include %v: expected only the service in team-a to be queued, got %v", test.include, queued)
+		}
+	}
+}
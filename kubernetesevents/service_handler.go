@@ -1,10 +1,9 @@
 package kubernetesevents
 
 import (
-	"bytes"
 	"fmt"
-	"net/url"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
@@ -20,39 +19,63 @@ const (
 )
 
 type SyncHandler interface {
-	Add(interface{}) error
+	// Add tells Rancher about a new or changed object. deltaType is never
+	// Deleted.
+	Add(obj interface{}, deltaType DeltaType) error
 	Delete(interface{}) error
 	Decode(model.WatchEvent) (interface{}, error)
-	GetListURL() string
-	GetWatchURL() string
+	// OptedOut reports whether a decoded object is to be kept out of
+	// Rancher, see SyncAnnotation
+	OptedOut(interface{}) (bool, error)
+	Resource() kubernetesclient.ResourceOperations
 	GetKey(model.WatchEvent) (string, error)
+	// Published returns the keys of the objects Rancher has, as far as the
+	// handler can tell, including the ones it had before the agent started
+	Published() ([]string, error)
 }
 
 type serviceHandler struct {
-	rClient *client.RancherClient
-	kClient *kubernetesclient.Client
-	baseURL string
+	rClient   *client.RancherClient
+	kClient   *kubernetesclient.Client
+	informers *SharedInformerFactory
+	published *publishedCache
+	baseURL   string
+
+	// seeded is set once published holds the services Rancher had when the
+	// handler started
+	seedLock sync.Mutex
+	seeded   bool
 }
 
-func NewServiceHandler(rClient *client.RancherClient, kClient *kubernetesclient.Client, conf config.Config) *serviceHandler {
+func NewServiceHandler(rClient *client.RancherClient, kClient *kubernetesclient.Client, informers *SharedInformerFactory, conf config.Config) *serviceHandler {
 	sHandler := &serviceHandler{
-		rClient: rClient,
-		kClient: kClient,
-		baseURL: conf.KubernetesURL,
+		rClient:   rClient,
+		kClient:   kClient,
+		informers: informers,
+		published: newPublishedCache(),
+		baseURL:   conf.KubernetesURL,
 	}
 	return sHandler
 }
 
 func (s *serviceHandler) Decode(event model.WatchEvent) (interface{}, error) {
+	if svc, ok := event.Object.(model.Service); ok {
+		return svc, nil
+	}
+	if tombstone, ok := event.Object.(DeletedFinalStateUnknown); ok {
+		return tombstone, nil
+	}
+
 	i, ok := event.Object.(map[string]interface{})
 
 	if !ok {
-		return nil, fmt.Errorf("Couldn't decode service event [#v]", event)
+		return nil, fmt.Errorf("Couldn't decode service event [%#v]", event)
 	}
 
 	var svc model.Service
 	mapstructure.Decode(i, &svc)
-	if svc == (model.Service{}) || svc.Spec == nil {
+	// Services deleted while the agent was down are only known by UID
+	if svc.Metadata == nil || (svc.Spec == nil && event.Type != "DELETED") {
 		log.Infof("Couldn't decode %+v to service.", i)
 		return nil, fmt.Errorf("Service object is empty")
 	}
@@ -65,10 +88,21 @@ func (s *serviceHandler) GetKey(event model.WatchEvent) (string, error) {
 		log.Errorf("Error computing key for event %v", err)
 		return "", err
 	}
+	if tombstone, ok := val.(DeletedFinalStateUnknown); ok {
+		return tombstone.Key, nil
+	}
 	return val.(model.Service).Metadata.Uid, nil
 }
 
-func (s *serviceHandler) Add(svc interface{}) error {
+func (s *serviceHandler) OptedOut(svc interface{}) (bool, error) {
+	realSVC, ok := svc.(model.Service)
+	if !ok {
+		return false, nil
+	}
+	return objectOptedOut(s.informers, realSVC.Metadata)
+}
+
+func (s *serviceHandler) Add(svc interface{}, deltaType DeltaType) error {
 	realSVC := svc.(model.Service)
 
 	kind := kubernetesServiceKind
@@ -78,23 +112,25 @@ func (s *serviceHandler) Add(svc interface{}) error {
 
 	var serviceEvent = &client.ExternalServiceEvent{}
 	serviceEvent.ExternalId = metadata.Uid
+	// Services Rancher has, because this handler created them or they were
+	// there when it started, are updated, even when a relist reports them
+	// again. Others are created, even on an update,
+	// since Rancher can't update a service it never heard of.
 	serviceEvent.EventType = "service.create"
+	if err := s.seedPublished(); err != nil {
+		return err
+	}
+	if s.published.has(metadata.Uid) {
+		serviceEvent.EventType = "service.update"
+	} else if deltaType == Updated {
+		log.Debugf("Creating service %s, which changed before Rancher heard of it", metadata.Uid)
+	}
 
 	if selectorMap != nil {
 		selectorMap["io.kubernetes.pod.namespace"] = metadata.Namespace
 	}
 
-	var buffer bytes.Buffer
-	for key, v := range selectorMap {
-		if val, ok := v.(string); ok {
-			buffer.WriteString(key)
-			buffer.WriteString("=")
-			buffer.WriteString(val)
-			buffer.WriteString(",")
-		}
-	}
-	selector := buffer.String()
-	selector = strings.TrimSuffix(selector, ",")
+	selector := encodeSelector(selectorMap, metadata)
 
 	fields := map[string]interface{}{"template": realSVC}
 	data := map[string]interface{}{"fields": fields}
@@ -121,7 +157,7 @@ func (s *serviceHandler) Add(svc interface{}) error {
 		env["name"] = metadata.Namespace
 		env["externalId"] = "kubernetes://" + metadata.Namespace
 	} else {
-		namespace, err := s.kClient.Namespace.ByName(metadata.Namespace)
+		namespace, err := getNamespace(s.informers, metadata.Namespace)
 		if err != nil {
 			return err
 		}
@@ -131,11 +167,70 @@ func (s *serviceHandler) Add(svc interface{}) error {
 		env["uuid"] = rancherUuid
 	}
 	serviceEvent.Environment = env
-	_, err := s.rClient.ExternalServiceEvent.Create(serviceEvent)
-	return err
+
+	// Changes to the rest of the service, like its status, don't reach
+	// Rancher
+	hash, err := payloadHash(map[string]interface{}{
+		"name":        metadata.Name,
+		"selector":    selector,
+		"vip":         vip,
+		"uuid":        rancherUuid,
+		"spec":        realSVC.Spec,
+		"environment": env,
+	})
+	if err != nil {
+		return err
+	}
+	if s.published.unchanged(metadata.Uid, hash) {
+		return nil
+	}
+	if _, err := s.rClient.ExternalServiceEvent.Create(serviceEvent); err != nil {
+		return err
+	}
+	s.published.set(metadata.Uid, hash)
+	return nil
+}
+
+// seedPublished adds the kubernetesService services Rancher already has to
+// the published cache the first time it is called, so that an agent that
+// restarted updates the services it created before instead of creating them
+// again. A failed listing is tried again with the next service.
+func (s *serviceHandler) seedPublished() error {
+	s.seedLock.Lock()
+	defer s.seedLock.Unlock()
+	if s.seeded {
+		return nil
+	}
+	services, err := rancherServices(s.rClient)
+	if err != nil {
+		return fmt.Errorf("Couldn't list the services Rancher has: %v", err)
+	}
+	uids := make([]string, 0, len(services))
+	for _, service := range services {
+		uids = append(uids, service.ExternalId)
+	}
+	s.published.seed(uids)
+	s.seeded = true
+	return nil
+}
+
+// Published returns the UIDs of the services Rancher had when the handler
+// started and of the ones published since.
+func (s *serviceHandler) Published() ([]string, error) {
+	if err := s.seedPublished(); err != nil {
+		return nil, err
+	}
+	return s.published.uids(), nil
 }
 
 func (s *serviceHandler) Delete(svc interface{}) error {
+	if tombstone, ok := svc.(DeletedFinalStateUnknown); ok {
+		svc = tombstone.Obj
+		if svc == nil {
+			// Only Rancher knew of it
+			svc = model.Service{Metadata: &model.ObjectMeta{Uid: tombstone.Key}}
+		}
+	}
 	realSVC := svc.(model.Service)
 
 	kind := kubernetesServiceKind
@@ -149,22 +244,13 @@ func (s *serviceHandler) Delete(svc interface{}) error {
 	}
 	serviceEvent.Service = service
 
-	_, err := s.rClient.ExternalServiceEvent.Create(serviceEvent)
-	return err
-}
-
-func (s *serviceHandler) GetListURL() string {
-	return fmt.Sprintf("%s/api/v1/services", s.baseURL)
+	if _, err := s.rClient.ExternalServiceEvent.Create(serviceEvent); err != nil {
+		return err
+	}
+	s.published.forget(metadata.Uid)
+	return nil
 }
 
-func (s *serviceHandler) GetWatchURL() string {
-	baseURL := strings.Replace(s.GetListURL(), "http", "ws", 1)
-	u, err := url.Parse(baseURL)
-	if err != nil {
-		log.Fatalf("Couldn't parse URL, err: %v", err)
-	}
-	q := u.Query()
-	q.Set("watch", "true")
-	u.RawQuery = q.Encode()
-	return u.String()
+func (s *serviceHandler) Resource() kubernetesclient.ResourceOperations {
+	return s.kClient.Resource(kubernetesclient.ServiceResource)
 }
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 
 	"github.com/rancher/kubernetes-agent/config"
+	"github.com/rancher/kubernetes-agent/deadletter"
 	"github.com/rancher/kubernetes-agent/healthcheck"
 	"github.com/rancher/kubernetes-agent/hostlabels"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
@@ -19,6 +22,7 @@ func main() {
 	app.Name = "kubernetes-agent"
 	app.Usage = "Start the Rancher kubernetes agent"
 	app.Action = launch
+	app.Commands = []cli.Command{deadLetterCommand}
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -27,6 +31,61 @@ func main() {
 			Usage:  "URL for kubernetes API",
 			EnvVar: "KUBERNETES_URL",
 		},
+		cli.StringFlag{
+			Name:   "kubeconfig",
+			Usage:  "Path to a kubeconfig file to load the kubernetes API URL and credentials from, instead of reading a token from stdin. An explicit --kubernetes-url overrides its server",
+			EnvVar: "KUBECONFIG",
+		},
+		cli.StringFlag{
+			Name:  "kubeconfig-context",
+			Usage: "The kubeconfig context to use. Defaults to the current-context",
+		},
+		cli.BoolFlag{
+			Name:   "in-cluster",
+			Usage:  "Run inside the managed cluster, authenticating with the pod's service account",
+			EnvVar: "IN_CLUSTER",
+		},
+		cli.BoolFlag{
+			Name:   "client-cert-auth",
+			Usage:  "Present the Rancher issued cert.pem and key.pem as a client certificate to the kubernetes API, instead of reading a token from stdin",
+			EnvVar: "CLIENT_CERT_AUTH",
+		},
+		cli.IntFlag{
+			Name:   "kubernetes-dial-timeout",
+			Value:  30,
+			Usage:  "Seconds to wait for a connection to the kubernetes API to be established",
+			EnvVar: "KUBERNETES_DIAL_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "kubernetes-tls-timeout",
+			Value:  10,
+			Usage:  "Seconds to wait for the TLS handshake with the kubernetes API",
+			EnvVar: "KUBERNETES_TLS_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "kubernetes-response-timeout",
+			Value:  30,
+			Usage:  "Seconds to wait for the kubernetes API to start responding to a request",
+			EnvVar: "KUBERNETES_RESPONSE_TIMEOUT",
+		},
+		cli.Float64Flag{
+			Name:   "kubernetes-qps",
+			Value:  20,
+			Usage:  "Maximum sustained requests per second to the kubernetes API, 0 to disable the limit",
+			EnvVar: "KUBERNETES_QPS",
+		},
+		cli.IntFlag{
+			Name:   "kubernetes-burst",
+			Value:  40,
+			Usage:  "Maximum burst of requests to the kubernetes API above the QPS limit",
+			EnvVar: "KUBERNETES_BURST",
+		},
+		cli.IntFlag{
+			Name:   "kubernetes-max-retries",
+			Value:  5,
+			Usage:  "Times to retry a kubernetes API request that was throttled or failed transiently",
+			EnvVar: "KUBERNETES_MAX_RETRIES",
+		},
 		cli.StringFlag{
 			Name:   "cattle-url",
 			Usage:  "URL for cattle API",
@@ -45,9 +104,64 @@ func main() {
 		cli.IntFlag{
 			Name:   "worker-count",
 			Value:  50,
-			Usage:  "Number of workers for handling events",
+			Usage:  "Number of workers for handling Rancher events and syncing kubernetes services",
 			EnvVar: "WORKER_COUNT",
 		},
+		cli.IntFlag{
+			Name:   "resync-interval",
+			Value:  300,
+			Usage:  "Seconds between resyncs that list the services again and send Rancher the changes given up on after retries and the deletions missed while the agent was down, 0 to disable",
+			EnvVar: "RESYNC_INTERVAL",
+		},
+		cli.StringSliceFlag{
+			Name:   "include-namespace",
+			Usage:  "Namespace to report to Rancher, globs allowed. Repeat for more, all namespaces when unset. Without globs namespaced kinds are only watched in these namespaces, so namespace level RBAC is enough for them. Namespaces and nodes are still read cluster wide and need cluster level read access",
+			EnvVar: "INCLUDE_NAMESPACES",
+		},
+		cli.StringSliceFlag{
+			Name:   "exclude-namespace",
+			Usage:  "Namespace never to report to Rancher, globs allowed, e.g. kube-*. Repeat for more",
+			EnvVar: "EXCLUDE_NAMESPACES",
+		},
+		cli.StringFlag{
+			Name:   "label-selector",
+			Usage:  "Label selectors of the watched kinds as kind:selector entries separated by semicolons, e.g. services:app=web,tier!=cache;pods:app=web",
+			EnvVar: "LABEL_SELECTORS",
+		},
+		cli.StringFlag{
+			Name:   "change-projection-file",
+			Usage:  "YAML file with the JSON paths of each watched kind to include in or exclude from change events sent to Rancher. By default status, managedFields and the last applied configuration are left out",
+			EnvVar: "CHANGE_PROJECTION_FILE",
+		},
+		cli.IntFlag{
+			Name:   "change-max-payload-size",
+			Value:  65536,
+			Usage:  "Bytes a change event object may take before its biggest values are truncated, 0 for no limit",
+			EnvVar: "CHANGE_MAX_PAYLOAD_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "data-dir",
+			Value:  "/var/lib/rancher/kubernetes-agent",
+			Usage:  "Directory for state kept across restarts, like watch checkpoints and events Rancher failed to accept. Empty to keep nothing",
+			EnvVar: "DATA_DIR",
+		},
+		cli.IntFlag{
+			Name:   "dead-letter-max-entries",
+			Value:  10000,
+			Usage:  "Events Rancher failed to accept to keep for replay, 0 for no limit. A full queue drops the oldest events Rancher rejected first, and then the oldest events still waiting",
+			EnvVar: "DEAD_LETTER_MAX_ENTRIES",
+		},
+		cli.IntFlag{
+			Name:   "reconcile-interval",
+			Value:  3600,
+			Usage:  "Seconds between removals of the services and stacks Rancher still has for objects gone from the cluster, 0 to only remove them at startup",
+			EnvVar: "RECONCILE_INTERVAL",
+		},
+		cli.BoolFlag{
+			Name:   "reconcile-dry-run",
+			Usage:  "Only log the orphaned services and stacks instead of removing them from Rancher",
+			EnvVar: "RECONCILE_DRY_RUN",
+		},
 		cli.IntFlag{
 			Name:   "health-check-port",
 			Value:  10240,
@@ -59,7 +173,7 @@ func main() {
 			Value: &cli.StringSlice{"namespaces", "services", "replicationcontrollers", "pods",
 				"deployments", "ingresses", "jobs", "horizontalpodautoscalers", "persistentvolumes",
 				"persistentvolumeclaims", "replicasets", "secrets"},
-			Usage: "Which k8s kinds to watch and report changes to Rancher",
+			Usage: "Which k8s kinds to watch and report changes to Rancher. A version can be pinned as resource.version.group, e.g. deployments.v1.apps",
 		},
 		cli.IntFlag{
 			Name:  "host-labels-update-interval",
@@ -81,33 +195,92 @@ func launch(c *cli.Context) {
 		log.Fatal(err)
 	}
 
-	if err = kubernetesclient.Init(); err != nil {
-		log.Fatal(err)
+	if conf.DataDir != "" {
+		queue, err := deadletter.Open(deadLetterDir(conf.DataDir), conf.DeadLetterMaxEntries)
+		if err == nil {
+			err = queue.Claim()
+		}
+		if err != nil {
+			log.Warnf("Events Rancher fails to accept won't be kept for replay: %v", err)
+		} else {
+			outbox := deadletter.NewOutbox(queue, rClient)
+			rClient = outbox.Client()
+			go outbox.Run(context.Background())
+		}
+	}
+
+	switch {
+	case conf.InCluster:
+		server, err := kubernetesclient.InitInCluster()
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.KubernetesURL = server
+	case conf.Kubeconfig != "":
+		server, err := kubernetesclient.InitFromKubeconfig(conf.Kubeconfig, conf.KubeconfigContext)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// An explicit --kubernetes-url wins over the kubeconfig's server,
+		// like kubectl's --server
+		if kubernetesURLSet(c) {
+			log.Infof("Using kubernetes API %s from --kubernetes-url instead of kubeconfig server %s", conf.KubernetesURL, server)
+		} else {
+			log.Infof("Using kubernetes API %s from kubeconfig %s", server, conf.Kubeconfig)
+			conf.KubernetesURL = server
+		}
+	default:
+		if err = kubernetesclient.Init(conf.ClientCertAuth); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	kubernetesclient.ConfigureTransport(kubernetesclient.TransportOptions{
+		DialTimeout:           conf.DialTimeout,
+		TLSHandshakeTimeout:   conf.TLSTimeout,
+		ResponseHeaderTimeout: conf.ResponseTimeout,
+	})
+
+	kClient := config.GetKubernetesClient(conf, true)
+
+	var checkpoints *kubernetesevents.Checkpoints
+	if conf.DataDir != "" {
+		checkpoints, err = kubernetesevents.LoadCheckpoints(filepath.Join(conf.DataDir, "checkpoints.json"))
+		if err != nil {
+			log.Warnf("Watches will start over instead of resuming: %v", err)
+		}
 	}
 
-	kClient := kubernetesclient.NewClient(conf.KubernetesURL, true)
+	scope, err := kubernetesevents.NewScope(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Every watch goes through the informers, which are started once all
+	// the handlers are registered
+	informers := kubernetesevents.NewSharedInformerFactory(kClient, scope, checkpoints)
+	nodeInformer := informers.ForResource(kubernetesclient.NodeResource, false)
+	informers.ForResource(kubernetesclient.NamespaceResource, false)
 
-	svcHandler := kubernetesevents.NewServiceHandler(rClient, kClient, conf)
+	svcHandler := kubernetesevents.NewServiceHandler(rClient, kClient, informers, conf)
 
-	nsHandler := kubernetesevents.NewHandler(rClient, kClient, kubernetesevents.NamespaceKind)
+	nsHandler := kubernetesevents.NewHandler(rClient, kClient, informers, kubernetesevents.NamespaceKind)
 	handlers := []kubernetesevents.Handler{nsHandler}
 
+	payloadRules, err := kubernetesevents.LoadPayloadRules(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Info("Watching changes for kinds: ", c.StringSlice("watch-kind"))
 	for _, kind := range c.StringSlice("watch-kind") {
-		handlers = append(handlers, kubernetesevents.NewChangeHandler(rClient, kClient, kind))
+		handlers = append(handlers, kubernetesevents.NewChangeHandler(rClient, kClient, informers, kind, payloadRules))
 	}
 
-	go func(rc chan error) {
-		err := kubernetesevents.SyncAndWatchEventStream([]kubernetesevents.SyncHandler{svcHandler})
-		log.Errorf("kubernetes Sync and stream listener exited with error: %s", err)
-		rc <- err
-	}(resultChan)
-
-	go func(rc chan error) {
-		err := kubernetesevents.ConnectToEventStream(handlers, conf)
-		log.Errorf("Kubernetes stream listener exited with error: %s", err)
-		rc <- err
-	}(resultChan)
+	kubernetesevents.SyncAndWatchEventStream([]kubernetesevents.SyncHandler{svcHandler}, informers, conf)
+	if err := kubernetesevents.ConnectToEventStream(context.Background(), handlers, informers, conf); err != nil {
+		log.Fatal(err)
+	}
+	informers.Start(context.Background())
 
 	go func(rc chan error) {
 		err := rancherevents.ConnectToEventStream(conf)
@@ -115,6 +288,12 @@ func launch(c *cli.Context) {
 		rc <- err
 	}(resultChan)
 
+	reconciler, err := kubernetesevents.NewReconciler(rClient, kClient, conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go reconciler.Run(context.Background(), conf.ReconcileInterval)
+
 	go func(rc chan error) {
 		err := healthcheck.StartHealthCheck(conf.HealthCheckPort)
 		log.Errorf("Rancher healthcheck exited with error: %s", err)
@@ -122,7 +301,10 @@ func launch(c *cli.Context) {
 	}(resultChan)
 
 	go func(rc chan error) {
-		err := hostlabels.StartHostLabelSync(c.Int("host-labels-update-interval"), kClient)
+		// Nodes missing from the cache would be skipped by the first sync
+		log.Info("Waiting for the node cache to fill")
+		nodeInformer.WaitForSync(context.Background())
+		err := hostlabels.StartHostLabelSync(c.Int("host-labels-update-interval"), kClient, nodeInformer)
 		log.Errorf("Rancher hostLabel sync service exited with error: %s", err)
 		rc <- err
 	}(resultChan)
@@ -130,3 +312,9 @@ func launch(c *cli.Context) {
 	<-resultChan
 	log.Info("Exiting.")
 }
+
+// kubernetesURLSet reports whether --kubernetes-url was given, on the command
+// line or in the environment, rather than left at its default.
+func kubernetesURLSet(c *cli.Context) bool {
+	return c.IsSet("kubernetes-url") || os.Getenv("KUBERNETES_URL") != ""
+}
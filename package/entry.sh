@@ -1,6 +1,11 @@
 #!/bin/bash
 set -ex
 
+if [ "$IN_CLUSTER" = "true" ]; then
+    # Credentials come from the pod's service account
+    exec "$@"
+fi
+
 MD=${RANCHER_METADATA_ADDRESS:-169.254.169.250}
 while ! curl -s -f http://${MD}/2015-12-19/stacks/Kubernetes/services/kubernetes/uuid; do
     echo Waiting for metadata
@@ -1,6 +1,10 @@
 package eventhandlers
 
 import (
+	"context"
+	"strings"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
@@ -8,9 +12,10 @@ import (
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/kubernetes-agent/kubernetesclient"
 	util "github.com/rancher/kubernetes-agent/rancherevents/util"
-	"strings"
 )
 
+const podLookupTimeout = 30 * time.Second
+
 type syncHandler struct {
 	kClient *kubernetesclient.Client
 }
@@ -32,7 +37,7 @@ func (h *syncHandler) Handler(event *events.Event, cli *client.RancherClient) er
 
 	containerLabels, err := h.parseContainerLabels(event)
 	if err != nil {
-		log.Errorf("Failed to read labels", err)
+		log.Errorf("Failed to read labels: %v", err)
 		return util.CreateAndPublishReply(event, cli)
 	}
 
@@ -68,9 +73,11 @@ func isPodContainer(containerLabels map[string]string) bool {
 }
 
 func (h *syncHandler) copyPodLabels(namespace, name string, labels map[string]string) (bool, error) {
-	pod, err := h.kClient.Pod.ByName(namespace, name)
+	ctx, cancel := context.WithTimeout(context.Background(), podLookupTimeout)
+	defer cancel()
+	pod, err := h.kClient.Pod.ByNameContext(ctx, namespace, name)
 	if err != nil {
-		if apiErr, ok := err.(*kubernetesclient.ApiError); ok && apiErr.StatusCode == 404 {
+		if kubernetesclient.IsNotFound(err) {
 			return false, nil
 		}
 		return true, errors.Wrap(err, "lookup pod")
@@ -3,13 +3,12 @@ package rancherevents
 import (
 	revents "github.com/rancher/event-subscriber/events"
 	"github.com/rancher/kubernetes-agent/config"
-	"github.com/rancher/kubernetes-agent/kubernetesclient"
 	"github.com/rancher/kubernetes-agent/rancherevents/eventhandlers"
 )
 
 func ConnectToEventStream(conf config.Config) error {
 
-	kClient := kubernetesclient.NewClient(conf.KubernetesURL, false)
+	kClient := config.GetKubernetesClient(conf, false)
 
 	eventHandlers := map[string]revents.EventHandler{
 		"compute.instance.providelabels": eventhandlers.NewProvideLablesHandler(kClient).Handler,
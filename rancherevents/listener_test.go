@@ -191,7 +191,7 @@ func cleanup(client *kubernetesclient.Client, resourceType string, namespace str
 		c.Fatalf("Unknown type for cleanup: %s", resourceType)
 	}
 	if err != nil {
-		if apiError, ok := err.(*kubernetesclient.ApiError); ok && apiError.StatusCode == 404 {
+		if kubernetesclient.IsNotFound(err) {
 			return nil
 		} else {
 			return err
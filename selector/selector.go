@@ -0,0 +1,315 @@
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Operator relates a label to the values of a Requirement.
+type Operator string
+
+const (
+	Equals       Operator = "="
+	NotEquals    Operator = "!="
+	In           Operator = "in"
+	NotIn        Operator = "notin"
+	Exists       Operator = "exists"
+	DoesNotExist Operator = "!"
+)
+
+// operatorOrder sorts requirements on the same key.
+var operatorOrder = map[Operator]int{
+	Equals:       0,
+	NotEquals:    1,
+	In:           2,
+	NotIn:        3,
+	Exists:       4,
+	DoesNotExist: 5,
+}
+
+// expressionOperators are the operators of kubernetes matchExpressions.
+var expressionOperators = map[string]Operator{
+	"In":           In,
+	"NotIn":        NotIn,
+	"Exists":       Exists,
+	"DoesNotExist": DoesNotExist,
+}
+
+var (
+	nameRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	prefixRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	setRegexp    = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+// Requirement is one term of a selector, like app=web or tier in (a,b).
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Selector matches the labels that meet all of its requirements. It's
+// encoded in Rancher's selector syntax, with terms separated by commas:
+//
+//	app=web,tier!=cache,env in (prod,staging),track notin (canary),release,!legacy
+//
+// Requirements are encoded sorted by key and their values sorted, so equal
+// selectors always encode the same way.
+type Selector []Requirement
+
+// FromMap returns the equality selector of a service's spec.selector or a
+// matchLabels map.
+func FromMap(labels map[string]interface{}) (Selector, error) {
+	selector := Selector{}
+	for key, value := range labels {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("Value of selector label %s is a %T, not a string", key, value)
+		}
+		selector = append(selector, Requirement{Key: key, Operator: Equals, Values: []string{s}})
+	}
+	return selector.normalize()
+}
+
+// FromLabelSelector translates the matchLabels and matchExpressions of a
+// kubernetes label selector, like the spec.selector of a Deployment,
+// ReplicaSet or Job, as decoded from JSON.
+func FromLabelSelector(labelSelector map[string]interface{}) (Selector, error) {
+	selector := Selector{}
+	if matchLabels, ok := labelSelector["matchLabels"].(map[string]interface{}); ok {
+		labels, err := FromMap(matchLabels)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, labels...)
+	}
+
+	expressions, _ := labelSelector["matchExpressions"].([]interface{})
+	for _, e := range expressions {
+		expression, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid matchExpression %v", e)
+		}
+		key, _ := expression["key"].(string)
+		name, _ := expression["operator"].(string)
+		operator, ok := expressionOperators[name]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported matchExpression operator [%s] for %s", name, key)
+		}
+		requirement := Requirement{Key: key, Operator: operator}
+		values, _ := expression["values"].([]interface{})
+		for _, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("Value of matchExpression %s is a %T, not a string", key, value)
+			}
+			requirement.Values = append(requirement.Values, s)
+		}
+		selector = append(selector, requirement)
+	}
+	return selector.normalize()
+}
+
+// Parse reads a selector in Rancher's syntax, returning its requirements
+// in encoding order.
+func Parse(s string) (Selector, error) {
+	selector := Selector{}
+	for _, term := range splitTerms(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		requirement, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, requirement)
+	}
+	return selector.normalize()
+}
+
+// String encodes the selector. Invalid selectors should be rejected before
+// with Validate, since they can't be parsed back.
+func (s Selector) String() string {
+	normalized := s.sorted()
+	terms := make([]string, 0, len(normalized))
+	for _, requirement := range normalized {
+		terms = append(terms, requirement.String())
+	}
+	return strings.Join(terms, ",")
+}
+
+func (r Requirement) String() string {
+	switch r.Operator {
+	case Equals, NotEquals:
+		value := ""
+		if len(r.Values) > 0 {
+			value = r.Values[0]
+		}
+		return r.Key + string(r.Operator) + value
+	case In, NotIn:
+		return r.Key + " " + string(r.Operator) + " (" + strings.Join(sortedValues(r.Values), ",") + ")"
+	case Exists:
+		return r.Key
+	case DoesNotExist:
+		return "!" + r.Key
+	}
+	return ""
+}
+
+// Validate checks that keys and values are valid label keys and values, and
+// that each operator has the number of values it takes.
+func (s Selector) Validate() error {
+	for _, requirement := range s {
+		if err := validateKey(requirement.Key); err != nil {
+			return err
+		}
+		switch requirement.Operator {
+		case Equals, NotEquals:
+			if len(requirement.Values) != 1 {
+				return fmt.Errorf("Selector %s %s takes one value, got %d", requirement.Key, requirement.Operator, len(requirement.Values))
+			}
+		case In, NotIn:
+			if len(requirement.Values) == 0 {
+				return fmt.Errorf("Selector %s %s takes at least one value", requirement.Key, requirement.Operator)
+			}
+		case Exists, DoesNotExist:
+			if len(requirement.Values) != 0 {
+				return fmt.Errorf("Selector %s %s takes no values, got %d", requirement.Key, requirement.Operator, len(requirement.Values))
+			}
+		default:
+			return fmt.Errorf("Unknown selector operator [%s] for %s", requirement.Operator, requirement.Key)
+		}
+		for _, value := range requirement.Values {
+			if err := validateValue(value); err != nil {
+				return fmt.Errorf("Invalid value for selector label %s: %v", requirement.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// normalize validates the selector and returns it in encoding order.
+func (s Selector) normalize() (Selector, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s.sorted(), nil
+}
+
+// sorted returns a copy of the selector with its requirements and their
+// values in encoding order, without duplicate values.
+func (s Selector) sorted() Selector {
+	sorted := make(Selector, 0, len(s))
+	for _, requirement := range s {
+		if requirement.Operator == In || requirement.Operator == NotIn {
+			requirement.Values = sortedValues(requirement.Values)
+		}
+		sorted = append(sorted, requirement)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Operator != b.Operator {
+			return operatorOrder[a.Operator] < operatorOrder[b.Operator]
+		}
+		return strings.Join(a.Values, ",") < strings.Join(b.Values, ",")
+	})
+	return sorted
+}
+
+func sortedValues(values []string) []string {
+	sorted := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			sorted = append(sorted, value)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// splitTerms splits a selector at the commas outside of value sets.
+func splitTerms(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func parseRequirement(term string) (Requirement, error) {
+	if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+		return Requirement{Key: strings.TrimSpace(term[1:]), Operator: DoesNotExist}, nil
+	}
+	if match := setRegexp.FindStringSubmatch(term); match != nil {
+		requirement := Requirement{Key: match[1], Operator: Operator(match[2])}
+		for _, value := range strings.Split(match[3], ",") {
+			requirement.Values = append(requirement.Values, strings.TrimSpace(value))
+		}
+		return requirement, nil
+	}
+	if i := strings.Index(term, "!="); i >= 0 {
+		return Requirement{
+			Key:      strings.TrimSpace(term[:i]),
+			Operator: NotEquals,
+			Values:   []string{strings.TrimSpace(term[i+2:])},
+		}, nil
+	}
+	if i := strings.Index(term, "="); i >= 0 {
+		value := strings.TrimPrefix(term[i+1:], "=")
+		return Requirement{
+			Key:      strings.TrimSpace(term[:i]),
+			Operator: Equals,
+			Values:   []string{strings.TrimSpace(value)},
+		}, nil
+	}
+	if strings.ContainsAny(term, " ()") {
+		return Requirement{}, fmt.Errorf("Invalid selector term [%s]", term)
+	}
+	return Requirement{Key: term, Operator: Exists}, nil
+}
+
+// validateKey checks a label key: a name, optionally after a DNS subdomain
+// prefix and a slash.
+func validateKey(key string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if len(prefix) == 0 || len(prefix) > 253 || !prefixRegexp.MatchString(prefix) {
+			return fmt.Errorf("Invalid selector label key [%s]: bad prefix", key)
+		}
+	}
+	if len(name) == 0 || len(name) > 63 || !nameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid selector label key [%s]", key)
+	}
+	return nil
+}
+
+func validateValue(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > 63 || !nameRegexp.MatchString(value) {
+		return fmt.Errorf("[%s] isn't a valid label value", value)
+	}
+	return nil
+}
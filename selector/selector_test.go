@@ -0,0 +1,176 @@
+package selector
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+var (
+	testKeys   = []string{"app", "tier", "io.rancher.uuid", "app.kubernetes.io/name", "io.kubernetes.pod.namespace", "a-b_c.d"}
+	testValues = []string{"", "web", "cache", "v1.2", "my-app_2", "A"}
+	operators  = []Operator{Equals, NotEquals, In, NotIn, Exists, DoesNotExist}
+)
+
+// Generate makes random valid selectors for quick.Check.
+func (Selector) Generate(r *rand.Rand, size int) reflect.Value {
+	selector := Selector{}
+	for i := r.Intn(size + 1); i > 0; i-- {
+		requirement := Requirement{
+			Key:      testKeys[r.Intn(len(testKeys))],
+			Operator: operators[r.Intn(len(operators))],
+		}
+		switch requirement.Operator {
+		case Equals, NotEquals:
+			requirement.Values = []string{testValues[r.Intn(len(testValues))]}
+		case In, NotIn:
+			for j := r.Intn(3) + 1; j > 0; j-- {
+				requirement.Values = append(requirement.Values, testValues[r.Intn(len(testValues))])
+			}
+		}
+		selector = append(selector, requirement)
+	}
+	return reflect.ValueOf(selector)
+}
+
+func TestRoundTrip(t *testing.T) {
+	roundTrip := func(selector Selector) bool {
+		parsed, err := Parse(selector.String())
+		if err != nil {
+			t.Logf("Error parsing %q: %v", selector.String(), err)
+			return false
+		}
+		return reflect.DeepEqual(parsed, selector.sorted()) && parsed.String() == selector.String()
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodingIgnoresOrder(t *testing.T) {
+	shuffled := func(selector Selector, seed int64) bool {
+		shuffled := append(Selector{}, selector...)
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		return shuffled.String() == selector.String()
+	}
+	if err := quick.Check(shuffled, nil); err != nil {
+		t.Error(err)
+	}
+
+	labels := map[string]interface{}{}
+	for i, key := range testKeys {
+		labels[key] = testValues[i]
+	}
+	first, err := FromMap(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		selector, err := FromMap(labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selector.String() != first.String() {
+			t.Fatalf("Expected %q, got %q", first.String(), selector.String())
+		}
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	selector, err := FromMap(map[string]interface{}{"tier": "web", "app": "shop", "io.kubernetes.pod.namespace": "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded := selector.String(); encoded != "app=shop,io.kubernetes.pod.namespace=default,tier=web" {
+		t.Errorf("Unexpected selector %q", encoded)
+	}
+
+	for _, labels := range []map[string]interface{}{
+		{"replicas": 3},
+		{"app": "a,b"},
+		{"app": "web) or (x"},
+		{"bad key": "web"},
+		{"/app": "web"},
+	} {
+		if selector, err := FromMap(labels); err == nil {
+			t.Errorf("Expected %v to be rejected, got %q", labels, selector.String())
+		}
+	}
+}
+
+func TestFromLabelSelector(t *testing.T) {
+	tests := []struct {
+		labelSelector map[string]interface{}
+		expected      string
+	}{
+		{
+			labelSelector: map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "web"},
+			},
+			expected: "app=web",
+		},
+		{
+			labelSelector: map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "web"},
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "tier", "operator": "In", "values": []interface{}{"frontend", "backend"}},
+					map[string]interface{}{"key": "track", "operator": "NotIn", "values": []interface{}{"canary"}},
+					map[string]interface{}{"key": "release", "operator": "Exists"},
+					map[string]interface{}{"key": "legacy", "operator": "DoesNotExist"},
+				},
+			},
+			expected: "app=web,!legacy,release,tier in (backend,frontend),track notin (canary)",
+		},
+		{
+			labelSelector: map[string]interface{}{},
+			expected:      "",
+		},
+	}
+	for _, test := range tests {
+		selector, err := FromLabelSelector(test.labelSelector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded := selector.String(); encoded != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, encoded)
+		}
+	}
+
+	for _, labelSelector := range []map[string]interface{}{
+		{"matchExpressions": []interface{}{map[string]interface{}{"key": "tier", "operator": "Gt", "values": []interface{}{"1"}}}},
+		{"matchExpressions": []interface{}{map[string]interface{}{"key": "tier", "operator": "In"}}},
+		{"matchExpressions": []interface{}{map[string]interface{}{"key": "tier", "operator": "Exists", "values": []interface{}{"a"}}}},
+	} {
+		if _, err := FromLabelSelector(labelSelector); err == nil {
+			t.Errorf("Expected %v to be rejected", labelSelector)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]string{
+		"tier = web , app==shop":            "app=shop,tier=web",
+		"env in ( prod , staging, prod )":   "env in (prod,staging)",
+		"app!=,release":                     "app!=,release",
+		"!legacy, app.kubernetes.io/name=x": "app.kubernetes.io/name=x,!legacy",
+		"":                                  "",
+	}
+	for s, expected := range tests {
+		selector, err := Parse(s)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", s, err)
+			continue
+		}
+		if encoded := selector.String(); encoded != expected {
+			t.Errorf("Expected %q to parse as %q, got %q", s, expected, encoded)
+		}
+	}
+
+	for _, s := range []string{"env in (prod", "env in (a b)", "app=a b", "tier (web)", "bad key=web"} {
+		if selector, err := Parse(s); err == nil {
+			t.Errorf("Expected %q to be rejected, got %+v", s, selector)
+		}
+	}
+}